@@ -7,11 +7,30 @@ import (
 
 var ErrNotImplemented = builtinerrors.New("not implemented")
 
+// ErrQuotaExhausted is returned once a client has made as many requests as
+// it was allowed to
+var ErrQuotaExhausted = builtinerrors.New("quota budget exhausted")
+
+// ErrConflict is returned when a file can't be updated because it has
+// changed since it was read
+var ErrConflict = builtinerrors.New("changed since it was read")
+
+// ErrDivergentDuplicate is returned when the copies of a duplicated file
+// have different contents, so that one can't just be kept
+var ErrDivergentDuplicate = builtinerrors.New("copies have different contents")
+
 // ErrNotFound is returned when a file or directory does not exist
 type ErrNotFound struct {
 	Path string
 }
 
+// ErrLocked is returned when a file can't be updated because its lock file,
+// at Path, exists. Whoever made it may still be updating the file, or may
+// have been killed and left it behind.
+type ErrLocked struct {
+	Path string
+}
+
 type ErrInvalidObject struct {
 	Sha string
 }
@@ -20,6 +39,10 @@ func (err ErrNotFound) Error() string {
 	return fmt.Sprintf("%s: no such file or directory", err.Path)
 }
 
+func (err ErrLocked) Error() string {
+	return fmt.Sprintf("Unable to create '%s': File exists", err.Path)
+}
+
 func (err ErrInvalidObject) Error() string {
 	return fmt.Sprintf("%s: sha1 of contents does not match", err.Sha)
 }
@@ -27,3 +50,15 @@ func (err ErrInvalidObject) Error() string {
 func NotImplemented() error {
 	return ErrNotImplemented
 }
+
+// Is reports whether err, or any error it wraps, is target. See the standard
+// library's errors.Is.
+func Is(err, target error) bool {
+	return builtinerrors.Is(err, target)
+}
+
+// As finds the first error in err's chain that matches target. See the
+// standard library's errors.As.
+func As(err error, target interface{}) bool {
+	return builtinerrors.As(err, target)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// how many objects or packs to download at once, see drive.downloads
+const defaultDownloads = 8
+
+// fetch handles a batch of fetch commands of the form
+//
+//	fetch <sha1> <name>
+//
+// by copying every object reachable from the requested objects that is not
+// already in the local repository out of the remote.
+func fetch(batch []string, remote storeManager, local localGit) error {
+	var wants []string
+	for _, line := range batch {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "fetch" {
+			return fmt.Errorf("invalid fetch command: \"%s\"", line)
+		}
+		wants = append(wants, fields[1])
+	}
+	workers, err := local.ConfigInt("drive.downloads", defaultDownloads)
+	if err != nil {
+		return err
+	}
+	if err := fetchPacks(remote, local, int(workers)); err != nil {
+		return err
+	}
+	if err := fetchReachable(remote, local, wants, int(workers)); err != nil {
+		return err
+	}
+	if options.followtags {
+		return fetchFollowedTags(remote, local, int(workers))
+	}
+	return nil
+}
+
+// fetchPacks downloads each pack in the remote which contains objects that
+// we don't have, up to workers at a time.
+//
+// We can't tell from an index which objects are reachable from what we were
+// asked for, so this may fetch more than is strictly needed.
+func fetchPacks(remote storeManager, local localGit, workers int) error {
+	packs, err := remote.ListPacks()
+	if err != nil {
+		return err
+	}
+	packErrors := forEach(workers, packs, func(name string) error {
+		var idx bytes.Buffer
+		if err := remote.ReadPackFile(name, ".idx", &idx); err != nil {
+			return fmt.Errorf("reading %s.idx: %v", name, err)
+		}
+		shas, err := readPackIndex(&idx)
+		if err != nil {
+			return fmt.Errorf("%s.idx: %v", name, err)
+		}
+		missing, err := local.MissingObjects(shas)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+
+		log.Printf("fetching %s (%d new objects)", name, len(missing))
+		return downloadPack(remote, name, local)
+	})
+	if len(packErrors) > 0 {
+		for name, err := range packErrors {
+			log.Printf("error fetching %s: %v", name, err)
+		}
+		return fmt.Errorf("error fetching packs")
+	}
+	return nil
+}
+
+// downloadPack streams a pack from the remote into the local repository
+func downloadPack(remote storeManager, name string, local localGit) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(remote.ReadPackFile(name, ".pack", pw))
+	}()
+	_, err := local.IndexPack(pr)
+	// stop the download if indexing gave up early
+	pr.CloseWithError(fmt.Errorf("indexing stopped"))
+	if err != nil {
+		return fmt.Errorf("fetching %s: %v", name, err)
+	}
+	return nil
+}
+
+// fetchReachable makes sure that, once we have the packs, we also have any
+// loose objects reachable from wants
+func fetchReachable(remote storeManager, local localGit, wants []string, workers int) error {
+	hasLoose, err := remote.HasLooseObjects()
+	if err != nil {
+		return err
+	}
+	if hasLoose {
+		complete, err := local.ReachableCommits()
+		if err != nil {
+			return err
+		}
+		return fetchObjects(remote, local, wants, complete, workers)
+	}
+	// Everything is in the packs, which we already have
+	missing, err := local.MissingObjects(wants)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("objects missing from remote: %s", strings.Join(missing, " "))
+	}
+	return nil
+}
+
+// fetchFollowedTags fetches the annotated tags in the remote which point at
+// objects that we now have, so that git can create the tags without asking
+// for them separately.
+func fetchFollowedTags(remote storeManager, local localGit, workers int) error {
+	refs, err := remote.ListRefs()
+	if err != nil {
+		return err
+	}
+	var wants []string
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.Name, "refs/tags/") || ref.Peeled == "" {
+			continue
+		}
+		hasTag, err := local.HasObject(ref.Value)
+		if err != nil {
+			return err
+		}
+		if hasTag {
+			continue
+		}
+		hasTarget, err := local.HasObject(ref.Peeled)
+		if err != nil {
+			return err
+		}
+		if hasTarget {
+			wants = append(wants, ref.Value)
+		}
+	}
+	if len(wants) == 0 {
+		return nil
+	}
+	return fetchReachable(remote, local, wants, workers)
+}
+
+// localObjects is a local repository as fetchObjects needs it: besides
+// reading and writing objects, it can find what's missing below a tree
+type localObjects interface {
+	Manager
+	MissingBelow(tree string) ([]string, error)
+}
+
+// objectRef is an object for the walk to look at, with its type if we know
+// it from what refers to it
+type objectRef struct {
+	sha     string
+	objType ObjectType
+	typed   bool
+}
+
+// fetchObjects walks the remote object graph starting at wants, downloading
+// and writing to local each object that local does not already have.
+//
+// Having an object doesn't mean having what it refers to: a fetch that was
+// interrupted, or a pack that refers to loose objects, leaves objects behind
+// without their trees, blobs or history. So the walk only stops at the
+// commits in complete, which are reachable from local's refs, and at blobs.
+// Other commits, and tags, that local has are read from local and walked
+// through, and the trees that local has are checked for anything missing
+// below them.
+//
+// Up to workers objects are fetched at once. The children of each object
+// are queued as soon as it arrives, so the walk fans out across trees and
+// history rather than waiting on one object at a time.
+func fetchObjects(remote Manager, local localObjects, wants []string, complete map[string]bool, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		sha      string
+		children []objectRef
+		err      error
+	}
+	jobs := make(chan objectRef)
+	results := make(chan result)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for obj := range jobs {
+				children, err := fetchObject(remote, local, obj, complete[obj.sha])
+				results <- result{obj.sha, children, err}
+			}
+		}()
+	}
+	defer close(jobs)
+
+	seen := map[string]bool{}
+	var pending []objectRef
+	queue := func(objs []objectRef) {
+		for _, obj := range objs {
+			if !seen[obj.sha] {
+				seen[obj.sha] = true
+				pending = append(pending, obj)
+			}
+		}
+	}
+	for _, sha := range wants {
+		queue([]objectRef{{sha: sha}})
+	}
+
+	var firstErr error
+	inFlight := 0
+	for len(pending) > 0 || inFlight > 0 {
+		// only offer a job when there is one to give
+		var send chan objectRef
+		var next objectRef
+		if len(pending) > 0 {
+			send, next = jobs, pending[len(pending)-1]
+		}
+		select {
+		case send <- next:
+			pending = pending[:len(pending)-1]
+			inFlight++
+		case r := <-results:
+			inFlight--
+			if r.err != nil {
+				// let what's in flight finish, but start nothing new
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				pending = nil
+				continue
+			}
+			if firstErr == nil {
+				queue(r.children)
+			}
+		}
+	}
+	return firstErr
+}
+
+// fetchObject copies a single object from remote to local, unless local has
+// it already, and returns the objects it refers to that need looking at.
+// complete says whether the object is a commit reachable from local's refs.
+func fetchObject(remote Manager, local localObjects, obj objectRef, complete bool) ([]objectRef, error) {
+	sha := obj.sha
+	has, err := local.HasObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if has && (complete || obj.typed && obj.objType == BLOB) {
+		return nil, nil
+	}
+	if has && obj.typed && obj.objType == TREE {
+		missing, err := local.MissingBelow(sha)
+		if err != nil {
+			return nil, err
+		}
+		var children []objectRef
+		for _, sha := range missing {
+			children = append(children, objectRef{sha: sha})
+		}
+		return children, nil
+	}
+
+	var buf bytes.Buffer
+	if has {
+		if err := local.ReadRaw(sha, &buf); err != nil {
+			return nil, fmt.Errorf("reading object %s: %v", sha, err)
+		}
+	} else {
+		if options.verbosity >= 1 {
+			log.Println("fetching object", sha)
+		}
+		if err := remote.ReadRaw(sha, &buf); err != nil {
+			return nil, fmt.Errorf("reading remote object %s: %v", sha, err)
+		}
+	}
+	objType, content, err := decodeObject(sha, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	children, err := objectChildren(objType, content)
+	if err != nil {
+		return nil, fmt.Errorf("object %s: %v", sha, err)
+	}
+	if !has {
+		if err := local.WriteRaw(sha, &buf); err != nil {
+			return nil, fmt.Errorf("writing object %s: %v", sha, err)
+		}
+	}
+	return children, nil
+}
+
+// objectChildren lists the objects directly referenced by an object with
+// the given type and uncompressed content
+func objectChildren(objType ObjectType, content []byte) ([]objectRef, error) {
+	switch objType {
+	case BLOB:
+		return nil, nil
+	case TREE:
+		tree, err := ReadRawTree(content)
+		if err != nil {
+			return nil, err
+		}
+		var children []objectRef
+		for _, item := range tree {
+			// submodule commits are not in this repository
+			if item.Type != COMMIT {
+				children = append(children, objectRef{item.Ref, item.Type, true})
+			}
+		}
+		return children, nil
+	case COMMIT:
+		commit, err := ReadCommit(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		children := []objectRef{{commit.Tree, TREE, true}}
+		for _, parent := range commit.Parents {
+			children = append(children, objectRef{parent, COMMIT, true})
+		}
+		return children, nil
+	case TAG:
+		tag, err := ReadTag(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		return []objectRef{{tag.Object, tag.Type, true}}, nil
+	}
+	return nil, fmt.Errorf("unsupported object type: %d", objType)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	store "github.com/cakemanny/git-remote-drive/store"
+)
+
+// encodeObject builds a raw object as it would be stored in
+// objects/xx/xxxxxxxx...
+func encodeObject(objType string, content []byte) (string, []byte) {
+	data := append([]byte(fmt.Sprintf("%s %d\x00", objType, len(content))), content...)
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return fmt.Sprintf("%x", sha1.Sum(data)), buf.Bytes()
+}
+
+func rawTreeEntry(mode, name, sha string) []byte {
+	ref, _ := hex.DecodeString(sha)
+	return append([]byte(mode+" "+name+"\x00"), ref...)
+}
+
+// objectRecorder is a local Manager which only remembers the objects
+// written to it
+type objectRecorder struct {
+	Manager
+	mu      *sync.Mutex
+	objects map[string][]byte
+}
+
+func newObjectRecorder(objects map[string][]byte) objectRecorder {
+	return objectRecorder{mu: &sync.Mutex{}, objects: objects}
+}
+
+func (r objectRecorder) HasObject(sha string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.objects[sha]
+	return ok, nil
+}
+// MissingBelow finds nothing missing, as the recorder can't look inside
+// trees
+func (r objectRecorder) MissingBelow(tree string) ([]string, error) {
+	return nil, nil
+}
+func (r objectRecorder) WriteRaw(sha string, contents io.Reader) error {
+	b, err := ioutil.ReadAll(contents)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.objects[sha] = b
+	return err
+}
+
+// slowStore makes each read take a while, and records how many reads
+// were happening at once
+type slowStore struct {
+	store.SimpleFileStore
+	mu                  *sync.Mutex
+	reading, maxReading *int
+}
+
+func (s slowStore) Read(p string, contents io.Writer) error {
+	s.mu.Lock()
+	*s.reading++
+	if *s.reading > *s.maxReading {
+		*s.maxReading = *s.reading
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		*s.reading--
+		s.mu.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	return s.SimpleFileStore.Read(p, contents)
+}
+
+func TestFetchObjects(t *testing.T) {
+	blobSha, blob := encodeObject("blob", []byte("hi\n"))
+	treeSha, tree := encodeObject("tree", rawTreeEntry("100644", "test.txt", blobSha))
+	commitSha, commit := encodeObject("commit", []byte(
+		"tree "+treeSha+"\n"+
+			"author A U Thor <author@example.com> 31536000 +0000\n"+
+			"committer A U Thor <author@example.com> 31536000 +0000\n"+
+			"\n"+
+			"initial commit\n"))
+
+	remoteStore := store.NewMemStore()
+	for sha, raw := range map[string][]byte{
+		blobSha: blob, treeSha: tree, commitSha: commit,
+	} {
+		remoteStore.Create("objects/"+sha[:2]+"/"+sha[2:], bytes.NewReader(raw))
+	}
+	remote := storeManager{"", remoteStore}
+
+	local := newObjectRecorder(map[string][]byte{})
+	err := fetchObjects(remote, local, []string{commitSha}, nil, 4)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, sha := range []string{blobSha, treeSha, commitSha} {
+		if _, ok := local.objects[sha]; !ok {
+			t.Error("expected object to be fetched:", sha)
+		}
+	}
+
+	// Nothing should be requested from the remote for objects we have
+	remoteStore.Delete("objects/" + blobSha[:2] + "/" + blobSha[2:])
+	local = newObjectRecorder(map[string][]byte{blobSha: blob})
+	err = fetchObjects(remote, local, []string{commitSha}, nil, 4)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(local.objects) != 3 {
+		t.Error("expected 3 objects, actual:", len(local.objects))
+	}
+}
+
+func TestFetchObjectsConcurrently(t *testing.T) {
+	remoteStore := store.NewMemStore()
+	var tree []byte
+	for i := 0; i < 40; i++ {
+		sha, blob := encodeObject("blob", []byte(fmt.Sprintln(i)))
+		remoteStore.Create("objects/"+sha[:2]+"/"+sha[2:], bytes.NewReader(blob))
+		tree = append(tree, rawTreeEntry("100644", fmt.Sprint(i), sha)...)
+	}
+	treeSha, treeRaw := encodeObject("tree", tree)
+	remoteStore.Create("objects/"+treeSha[:2]+"/"+treeSha[2:], bytes.NewReader(treeRaw))
+
+	var reading, maxReading int
+	remote := storeManager{"", slowStore{remoteStore, &sync.Mutex{}, &reading, &maxReading}}
+	local := newObjectRecorder(map[string][]byte{})
+	if err := fetchObjects(remote, local, []string{treeSha}, nil, 8); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(local.objects) != 41 {
+		t.Error("expected 41 objects, actual:", len(local.objects))
+	}
+	if maxReading < 2 || maxReading > 8 {
+		t.Error("expected between 2 and 8 reads at once, actual:", maxReading)
+	}
+
+	// a missing object stops the fetch
+	remoteStore.Delete("objects/" + treeSha[:2] + "/" + treeSha[2:])
+	local = newObjectRecorder(map[string][]byte{})
+	if err := fetchObjects(remote, local, []string{treeSha}, nil, 8); err == nil {
+		t.Error("expected error fetching missing object")
+	}
+}
+
+// gitTestEnv makes commits in tests independent of the user's git config
+var gitTestEnv = []string{
+	"GIT_AUTHOR_NAME=A U Thor", "GIT_AUTHOR_EMAIL=author@example.com",
+	"GIT_COMMITTER_NAME=C O Mitter", "GIT_COMMITTER_EMAIL=committer@example.com",
+	"GIT_AUTHOR_DATE=1971-01-01 00:00:00 +0000",
+	"GIT_COMMITTER_DATE=1971-01-01 00:00:00 +0000",
+}
+
+// gitRepo creates a repository in a new temporary directory and runs script
+// inside it. It returns the path to the repository's .git directory
+func gitRepo(t *testing.T, script string) string {
+	dir := t.TempDir()
+	cmd := exec.Command("/bin/sh", "-c", "git init -q && "+script)
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Environ(), gitTestEnv...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v\n%s", script, err, out)
+	}
+	return filepath.Join(dir, ".git")
+}
+
+// gitOutput runs a git command against a repository, failing the test
+// if it fails. It runs in the repository's work tree, so that commands
+// like reset --hard never touch the directory the tests run in.
+func gitOutput(t *testing.T, gitDir string, args ...string) string {
+	cmd := localGit{gitDir: gitDir}.git(args...)
+	cmd.Dir = filepath.Dir(gitDir)
+	cmd.Env = append(cmd.Environ(), gitTestEnv...)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimRight(string(out), "\n")
+}
+
+// storeFromRepo copies every object of a local repository into a MemStore
+// laid out the same way as the remote
+func storeFromRepo(t *testing.T, gitDir string) *store.MemStore {
+	s := store.NewMemStore()
+	lg := localGit{gitDir: gitDir}
+	objects := gitOutput(t, gitDir, "cat-file", "--batch-all-objects",
+		"--batch-check=%(objectname)")
+	for _, sha := range strings.Fields(objects) {
+		var buf bytes.Buffer
+		if err := lg.ReadRaw(sha, &buf); err != nil {
+			t.Fatal("reading", sha, err)
+		}
+		s.Create("objects/"+sha[:2]+"/"+sha[2:], &buf)
+	}
+	return s
+}
+
+func TestFetchIntoLocalGit(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && mkdir dir && "+
+		"echo there > dir/test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && "+
+		"echo bye >> test.txt && git commit -q -a -m 'second commit' && "+
+		"git gc -q")
+	head := gitOutput(t, srcDir, "rev-parse", "HEAD")
+	remote := storeManager{"", storeFromRepo(t, srcDir)}
+
+	dstDir := gitRepo(t, "true")
+	local := localGit{gitDir: dstDir}
+
+	if err := fetch([]string{"fetch " + head + " refs/heads/master"}, remote, local); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// fsck fails if any object is missing or corrupt
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+	expected := gitOutput(t, srcDir, "rev-list", "--objects", head)
+	actual := gitOutput(t, dstDir, "rev-list", "--objects", head)
+	if expected != actual {
+		t.Errorf("expected:\n%s\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestFetchLooseAndPacked(t *testing.T) {
+	// A remote written before packs were used, which has since been
+	// pushed to
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	remoteStore := storeFromRepo(t, srcDir)
+	remote := storeManager{"", remoteStore}
+	local := localGit{gitDir: srcDir}
+	if err := remote.WriteRef(Ref{
+		Value: gitOutput(t, srcDir, "rev-parse", "master"),
+		Name:  "refs/heads/master",
+	}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", "second commit")
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+	if packs, _ := remote.ListPacks(); len(packs) != 1 {
+		t.Fatal("expected 1 pack, actual:", packs)
+	}
+
+	head := gitOutput(t, srcDir, "rev-parse", "master")
+	dstDir := gitRepo(t, "true")
+	err := fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+}
+
+func TestFetchAfterInterruptedFetch(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && mkdir dir && "+
+		"echo there > dir/test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && "+
+		"echo bye >> test.txt && git commit -q -a -m 'second commit'")
+	head := gitOutput(t, srcDir, "rev-parse", "HEAD")
+	objects := strings.Split(gitOutput(t, srcDir, "rev-list", "--objects", head), "\n")
+
+	// Interrupt the fetch at each point in turn. One object is fetched at
+	// a time, so each object is written before what it refers to.
+	for after := 1; after < len(objects); after++ {
+		remoteStore := storeFromRepo(t, srcDir)
+		remote := storeManager{"", remoteStore}
+		dstDir := gitRepo(t, "git config drive.downloads 1")
+		local := localGit{gitDir: dstDir}
+		remoteStore.Inject(store.Fault{
+			Op: "Read", Path: "objects/*/*", After: after, Times: 1,
+			Err: fmt.Errorf("connection reset"),
+		})
+		err := fetch([]string{"fetch " + head + " refs/heads/master"}, remote, local)
+		if err == nil {
+			t.Fatal("expected the first fetch to fail after", after, "objects")
+		}
+
+		err = fetch([]string{"fetch " + head + " refs/heads/master"}, remote, local)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+	}
+}
+
+func TestFetchAfterInterruptedConcurrentFetch(t *testing.T) {
+	// A remote with loose objects, and a pack pushed on top of them which
+	// refers to them
+	srcDir := gitRepo(t, "for i in 1 2 3 4 5 6 7 8; do echo $i > $i.txt; done && "+
+		"git add . && git commit -q -m 'initial commit'")
+	remoteStore := storeFromRepo(t, srcDir)
+	remote := storeManager{"", remoteStore}
+	local := localGit{gitDir: srcDir}
+	if err := remote.WriteRef(Ref{
+		Value: gitOutput(t, srcDir, "rev-parse", "master"),
+		Name:  "refs/heads/master",
+	}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", "second commit")
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+	head := gitOutput(t, srcDir, "rev-parse", "master")
+
+	// the pack arrives, but not all the loose objects
+	remoteStore.Inject(store.Fault{
+		Op: "Read", Path: "objects/[0-9a-f][0-9a-f]/*", After: 4, Times: 1,
+		Err: fmt.Errorf("connection reset"),
+	})
+	dstDir := gitRepo(t, "true")
+	err := fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err == nil {
+		t.Fatal("expected the first fetch to fail")
+	}
+	if has, _ := (localGit{gitDir: dstDir}).HasObject(head); !has {
+		t.Fatal("expected the first fetch to leave the pack behind")
+	}
+
+	err = fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+}
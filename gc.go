@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// gc consolidates the loose objects and small packs in a remote into a single
+// pack, e.g.
+//
+//	$ git-remote-drive --admin gc drive://path/to/repo.git
+//
+// The objects are gathered into a scratch repository, packed and sent back.
+// Nothing is deleted from the remote until the new pack has been read back
+// and checked to contain every object it replaces. Packs and loose objects
+// pushed while gc is running are left alone.
+func gc(remote storeManager, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	smallPack := flags.Int("small-pack", 1000,
+		"repack packs with fewer than this many objects")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("usage: git-remote-drive --admin gc <url> [--small-pack=<objects>]")
+	}
+
+	loose, err := remote.ListLooseObjects()
+	if err != nil {
+		return err
+	}
+	packs, err := remote.ListPacks()
+	if err != nil {
+		return err
+	}
+	var small []string
+	var shas []string
+	for _, name := range packs {
+		var idx bytes.Buffer
+		if err := remote.ReadPackFile(name, ".idx", &idx); err != nil {
+			return fmt.Errorf("reading %s.idx: %v", name, err)
+		}
+		packed, err := readPackIndex(&idx)
+		if err != nil {
+			return fmt.Errorf("%s.idx: %v", name, err)
+		}
+		if len(packed) < *smallPack {
+			small = append(small, name)
+			shas = append(shas, packed...)
+		}
+	}
+	if len(loose) == 0 && len(small) < 2 {
+		log.Println("nothing to do")
+		return nil
+	}
+	log.Printf("repacking %d loose objects and %d packs", len(loose), len(small))
+
+	tmpDir, err := ioutil.TempDir("", "git-remote-drive")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	scratch, err := scratchRepo(path.Join(tmpDir, "gc.git"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range small {
+		if err := downloadPack(remote, name, scratch); err != nil {
+			return err
+		}
+	}
+	// settings come from the repository we're run in, as in newRemote
+	local := localGit{gitDir: os.Getenv("GIT_DIR")}
+	workers, err := local.ConfigInt("drive.downloads", defaultDownloads)
+	if err != nil {
+		return err
+	}
+	looseErrors := forEach(int(workers), loose, func(sha string) error {
+		var buf bytes.Buffer
+		if err := remote.ReadRaw(sha, &buf); err != nil {
+			return err
+		}
+		return scratch.WriteRaw(sha, &buf)
+	})
+	// objects we couldn't copy, e.g. because they're corrupt, are left
+	// where they are for someone to look at
+	var copied []string
+	for _, sha := range loose {
+		if err, failed := looseErrors[sha]; failed {
+			log.Printf("warning: leaving object %s: %v", sha, err)
+			continue
+		}
+		copied = append(copied, sha)
+	}
+	shas = append(shas, copied...)
+
+	// one pack, however big, is the point
+	names, err := scratch.PackObjects(shas, tmpDir, 0)
+	if err != nil {
+		return err
+	}
+	name := names[0]
+	log.Printf("sending %s (%d objects)", name, len(shas))
+	if err := uploadPack(remote, tmpDir, name); err != nil {
+		return err
+	}
+	if err := verifyPack(remote, name, shas, path.Join(tmpDir, "verify.git")); err != nil {
+		return fmt.Errorf("verifying %s, nothing was removed: %v", name, err)
+	}
+
+	// The list is made from what is in the store now, rather than from what
+	// was there when we started, so that packs pushed meanwhile stay listed
+	if err := remote.UpdatePackList(); err != nil {
+		return err
+	}
+	for _, pack := range small {
+		// the same objects packed the same way give the same name
+		if pack == name {
+			continue
+		}
+		log.Println("removing", pack)
+		if err := remote.DeletePack(pack); err != nil {
+			return err
+		}
+	}
+	if err := remote.UpdatePackList(); err != nil {
+		return err
+	}
+	log.Printf("removing %d loose objects", len(copied))
+	return remote.DeleteLooseObjects(copied)
+}
+
+// scratchRepo creates an empty bare repository to work in
+func scratchRepo(gitDir string) (localGit, error) {
+	lg := localGit{gitDir: gitDir}
+	if out, err := lg.git("init", "-q", "--bare").CombinedOutput(); err != nil {
+		return lg, fmt.Errorf("git init: %v: %s", err, out)
+	}
+	return lg, nil
+}
+
+// verifyPack reads a pack back out of the remote into a new repository at
+// gitDir, and checks that it contains all of shas
+func verifyPack(remote storeManager, name string, shas []string, gitDir string) error {
+	lg, err := scratchRepo(gitDir)
+	if err != nil {
+		return err
+	}
+	if err := downloadPack(remote, name, lg); err != nil {
+		return err
+	}
+	missing, err := lg.MissingObjects(shas)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("objects missing from pack: %s", strings.Join(missing, " "))
+	}
+	return nil
+}
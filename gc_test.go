@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	store "github.com/cakemanny/git-remote-drive/store"
+)
+
+func TestGC(t *testing.T) {
+	// loose objects from an old version, followed by two pushes
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	remoteStore := storeFromRepo(t, srcDir)
+	remote := storeManager{"", remoteStore}
+	local := localGit{gitDir: srcDir}
+	if err := remote.WriteRef(Ref{
+		Value: gitOutput(t, srcDir, "rev-parse", "master"),
+		Name:  "refs/heads/master",
+	}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, msg := range []string{"second commit", "third commit"} {
+		gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", msg)
+		var out strings.Builder
+		push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+		if out.String() != "ok refs/heads/master\n\n" {
+			t.Fatalf("unexpected push result: %q", out.String())
+		}
+	}
+
+	if err := gc(remote, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	packs, err := remote.ListPacks()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(packs) != 1 {
+		t.Fatal("expected a single pack, actual:", packs)
+	}
+	if hasLoose, _ := remote.HasLooseObjects(); hasLoose {
+		t.Error("expected loose objects to be removed")
+	}
+	var packList strings.Builder
+	if err := remoteStore.Read("objects/info/packs", &packList); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if expected := "P " + packs[0] + ".pack\n\n"; packList.String() != expected {
+		t.Errorf("expected: %q, actual: %q", expected, packList.String())
+	}
+
+	head := gitOutput(t, srcDir, "rev-parse", "master")
+	dstDir := gitRepo(t, "true")
+	err = fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+
+	// running again finds nothing more to do
+	if err := gc(remote, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if after, _ := remote.ListPacks(); len(after) != 1 || after[0] != packs[0] {
+		t.Error("expected pack to be left alone, actual:", after)
+	}
+
+	if err := gc(remote, []string{"extra"}); err == nil {
+		t.Error("expected usage error")
+	}
+}
+
+// pushDuringUpload runs push just before the first pack is uploaded
+type pushDuringUpload struct {
+	store.SimpleFileStore
+	once *sync.Once
+	push func()
+}
+
+func (s pushDuringUpload) Create(p string, contents io.Reader) error {
+	if strings.HasSuffix(p, ".pack") {
+		s.once.Do(s.push)
+	}
+	return s.SimpleFileStore.Create(p, contents)
+}
+
+func TestGCKeepsConcurrentPush(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	remoteStore := store.NewMemStore()
+	local := localGit{gitDir: srcDir}
+	for _, msg := range []string{"second commit", "third commit"} {
+		gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", msg)
+		var out strings.Builder
+		push([]string{"push refs/heads/master:refs/heads/master"}, &out,
+			storeManager{"", remoteStore}, local)
+		if out.String() != "ok refs/heads/master\n\n" {
+			t.Fatalf("unexpected push result: %q", out.String())
+		}
+	}
+
+	const pushed = "pack-c5d2d737af4b6203aa37ca2ca13476624d11f4ee"
+	concurrent := storeManager{"", remoteStore}
+	remote := storeManager{"", pushDuringUpload{remoteStore, &sync.Once{}, func() {
+		if err := concurrent.WritePack(pushed, strings.NewReader("pack"),
+			strings.NewReader("idx")); err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if err := concurrent.UpdatePackList(); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}}}
+	if err := gc(remote, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	packs, _ := remote.ListPacks()
+	if len(packs) != 2 {
+		t.Fatal("expected gc's pack and the one pushed, actual:", packs)
+	}
+	var packList strings.Builder
+	if err := remoteStore.Read("objects/info/packs", &packList); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, name := range packs {
+		if !strings.Contains(packList.String(), "P "+name+".pack\n") {
+			t.Errorf("expected %s to be listed, actual: %q", name, packList.String())
+		}
+	}
+}
+
+func TestGCDownloadsSetting(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && "+
+		"git config drive.downloads lots")
+	remote := storeManager{"", storeFromRepo(t, srcDir)}
+
+	// the setting is read from the repository we're run in
+	t.Setenv("GIT_DIR", srcDir)
+	err := gc(remote, nil)
+	if err == nil || !strings.Contains(err.Error(), "drive.downloads") {
+		t.Error("expected an error reading drive.downloads, actual:", err)
+	}
+}
@@ -4,15 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+
+	errors "github.com/cakemanny/git-remote-drive/errors"
 )
 
 // localGit is a Manager implementation for a local git repo.
@@ -24,9 +25,17 @@ type localGit struct {
 	gitDir string
 }
 
+// git prepares a git command to be run against our repository
+func (lg localGit) git(args ...string) *exec.Cmd {
+	if lg.gitDir != "" {
+		args = append([]string{"--git-dir=" + lg.gitDir}, args...)
+	}
+	return exec.Command("git", args...)
+}
+
 func (lg localGit) ListRefs() ([]Ref, error) {
 	// git show-ref
-	out, err := exec.Command("git", "show-ref").Output()
+	out, err := lg.git("show-ref").Output()
 	if err != nil {
 		return nil, fmt.Errorf("ListRefs: %v", err)
 	}
@@ -38,8 +47,8 @@ func (lg localGit) ListRefs() ([]Ref, error) {
 		line := scanner.Text()
 		var value, name string
 		if _, err := fmt.Sscanf(line, "%s %s", &value, &name); err != nil {
-			log.Fatalf(
-				`git show-ref output not in expected format: "%s": %v`,
+			return nil, fmt.Errorf(
+				`ListRefs: git show-ref output not in expected format: "%s": %v`,
 				line, err,
 			)
 		}
@@ -52,16 +61,12 @@ func (lg localGit) ListRefs() ([]Ref, error) {
 }
 
 func (lg localGit) ReadRef(name string) (string, error) {
-	// Maybe we should be using git-rev-parse?
-	// read file
-	bs, err := ioutil.ReadFile(path.Join(lg.gitDir, name))
+	// rev-parse also finds packed refs
+	out, err := lg.git("rev-parse", "--verify", "--quiet", name).Output()
 	if err != nil {
-		//var op errors.Op = "localGit.ReadRef"
-		//var param errors.Param = name
-		//return "", errors.E(op,err)
 		return "", fmt.Errorf("ReadRef: reading ref %s: %v", name, err)
 	}
-	return strings.TrimRight(string(bs), "\n"), nil
+	return strings.TrimRight(string(out), "\n"), nil
 }
 
 func (lg localGit) WriteRef(ref Ref) error {
@@ -75,19 +80,214 @@ func (lg localGit) WriteRef(ref Ref) error {
 	return nil
 }
 
+func (lg localGit) DeleteRef(name string) error {
+	if err := lg.git("update-ref", "-d", name).Run(); err != nil {
+		return fmt.Errorf("DeleteRef: deleting %s: %v", name, err)
+	}
+	return nil
+}
+
+func (lg localGit) ReadSymbolicRef(name string) (string, error) {
+	out, err := lg.git("symbolic-ref", "--quiet", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("ReadSymbolicRef: reading %s: %v", name, err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+func (lg localGit) WriteSymbolicRef(name string, target string) error {
+	if err := lg.git("symbolic-ref", name, target).Run(); err != nil {
+		return fmt.Errorf("WriteSymbolicRef: writing %s: %v", name, err)
+	}
+	return nil
+}
+
 func (lg localGit) GetType(sha string) (string, error) {
 	if len(sha) != 40 {
 		return "", fmt.Errorf(`invalid sha: "%s"`, sha)
 	}
-	res, err := exec.Command("git", "cat-file", "-t", sha).Output()
+	res, err := lg.git("cat-file", "-t", sha).Output()
 	if err != nil {
 		return "", fmt.Errorf("getting type of %s", sha)
 	}
 	return strings.TrimRight(string(res), "\n"), nil
 }
 
+func (lg localGit) HasObject(sha string) (bool, error) {
+	if len(sha) != 40 {
+		return false, fmt.Errorf(`invalid sha: "%s"`, sha)
+	}
+	err := lg.git("cat-file", "-e", sha).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		// cat-file -e exits non-zero without complaint if the object
+		// is missing
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("checking for object %s: %v", sha, err)
+	}
+	return true, nil
+}
+
+// Peel follows an annotated tag, and any tags it points at, to the object
+// at the end of the chain
+func (lg localGit) Peel(sha string) (string, error) {
+	out, err := lg.git("rev-parse", "--verify", "--quiet", sha+"^{}").Output()
+	if err != nil {
+		return "", fmt.Errorf("peeling %s: %v", sha, err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// IsAncestor reports whether the commit ancestor is reachable from the
+// commit descendant
+func (lg localGit) IsAncestor(ancestor, descendant string) (bool, error) {
+	err := lg.git("merge-base", "--is-ancestor", ancestor, descendant).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("git merge-base --is-ancestor %s %s: %v",
+			ancestor, descendant, err)
+	}
+	return true, nil
+}
+
+// MissingObjects returns those of shas which are not in the repository
+func (lg localGit) MissingObjects(shas []string) ([]string, error) {
+	cmd := lg.git("cat-file", "--batch-check=%(objectname)")
+	cmd.Stdin = strings.NewReader(strings.Join(shas, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file --batch-check: %v", err)
+	}
+	var missing []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// c5d2d737af4b6203aa37ca2ca13476624d11f4ee missing
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[1] == "missing" {
+			missing = append(missing, fields[0])
+		}
+	}
+	return missing, scanner.Err()
+}
+
+// ReachableCommits returns the set of commits reachable from the refs. git
+// makes sure that everything these refer to is in the repository too.
+func (lg localGit) ReachableCommits() (map[string]bool, error) {
+	out, err := lg.git("rev-list", "--all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-list --all: %v", err)
+	}
+	commits := map[string]bool{}
+	for _, sha := range strings.Fields(string(out)) {
+		commits[sha] = true
+	}
+	return commits, nil
+}
+
+// MissingBelow returns the trees and blobs, found beneath a tree which is in
+// the repository, that are not in the repository
+func (lg localGit) MissingBelow(tree string) ([]string, error) {
+	out, err := lg.git("rev-list", "--objects", "--missing=print", tree).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git rev-list --objects %s: %v", tree, err)
+	}
+	var missing []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// ?c5d2d737af4b6203aa37ca2ca13476624d11f4ee
+		if strings.HasPrefix(line, "?") {
+			missing = append(missing, line[1:])
+		}
+	}
+	return missing, nil
+}
+
+// PackObjects creates packs, and their indexes, containing the given objects
+// in the directory dir, returning the names of the packs, e.g.
+// "pack-579aa09dc6014769ca718bb648dff8cbdbd844e7". There is only one pack
+// unless maxPackSize, in bytes, is set and the objects don't fit.
+func (lg localGit) PackObjects(shas []string, dir string, maxPackSize int64) ([]string, error) {
+	args := []string{"pack-objects", "-q"}
+	if maxPackSize > 0 {
+		args = append(args, fmt.Sprintf("--max-pack-size=%d", maxPackSize))
+	}
+	cmd := lg.git(append(args, path.Join(dir, "pack"))...)
+	cmd.Stdin = strings.NewReader(strings.Join(shas, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git pack-objects: %v", err)
+	}
+	var names []string
+	for _, sha := range strings.Fields(string(out)) {
+		names = append(names, "pack-"+sha)
+	}
+	return names, nil
+}
+
+// Config reads a setting, such as drive.apiUrl, from the git config,
+// returning def if it isn't set
+func (lg localGit) Config(name string, def string) (string, error) {
+	out, err := lg.git("config", "--get", name).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return def, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading %s from git config: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ConfigInt reads an integer setting, such as drive.uploads, from the git
+// config, returning def if it isn't set. Sizes like "64m" are understood.
+func (lg localGit) ConfigInt(name string, def int64) (int64, error) {
+	out, err := lg.git("config", "--int", "--get", name).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return def, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("reading %s from git config: %v", name, err)
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s from git config: %v", name, err)
+	}
+	return value, nil
+}
+
+// ConfigBool reads a boolean setting, such as drive.trash, from the git
+// config, returning def if it isn't set
+func (lg localGit) ConfigBool(name string, def bool) (bool, error) {
+	out, err := lg.git("config", "--bool", "--get", name).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return def, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("reading %s from git config: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
+// IndexPack adds a pack read from r to the repository. git checks every
+// object as it builds the index, and only moves the pack into place once
+// it's complete.
+func (lg localGit) IndexPack(r io.Reader) (string, error) {
+	cmd := lg.git("index-pack", "--stdin")
+	cmd.Stdin = r
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git index-pack: %v", err)
+	}
+	// pack	579aa09dc6014769ca718bb648dff8cbdbd844e7
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected output from git index-pack: %s", out)
+	}
+	return "pack-" + fields[1], nil
+}
+
 func (lg localGit) ReadObject(sha string, contents io.Writer) error {
-	cmd := exec.Command("git", "cat-file", "-p", sha)
+	cmd := lg.git("cat-file", "-p", sha)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("redirecting stdout: %v", err)
@@ -102,6 +302,107 @@ func (lg localGit) ReadObject(sha string, contents io.Writer) error {
 	return nil
 }
 
+// catFile is a localGit that reads objects through one long-lived
+// git cat-file --batch, rather than starting a process for each object as
+// ReadObject does. Walking history reads thousands of objects.
+type catFile struct {
+	localGit
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// startCatFile starts git cat-file --batch. The process runs until Close.
+func (lg localGit) startCatFile() (*catFile, error) {
+	cmd := lg.git("cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("redirecting stdin: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("redirecting stdout: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting git cat-file --batch: %v", err)
+	}
+	return &catFile{lg, cmd, stdin, bufio.NewReader(stdout)}, nil
+}
+
+// ReadObject reads an object in the same form as git cat-file -p
+func (cf *catFile) ReadObject(sha string, contents io.Writer) error {
+	if len(sha) != 40 {
+		return fmt.Errorf(`invalid sha: "%s"`, sha)
+	}
+	if _, err := io.WriteString(cf.stdin, sha+"\n"); err != nil {
+		return fmt.Errorf("git cat-file --batch: %v", err)
+	}
+	// <sha> <type> <size>, or <sha> missing
+	header, err := cf.stdout.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("git cat-file --batch: %v", err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return fmt.Errorf("git cat-file --batch: %s is missing", sha)
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("git cat-file --batch: unexpected header: %q", header)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("git cat-file --batch: unexpected header: %q", header)
+	}
+	// the contents are followed by a newline
+	body := make([]byte, size+1)
+	if _, err := io.ReadFull(cf.stdout, body); err != nil {
+		return fmt.Errorf("git cat-file --batch: reading %s: %v", sha, err)
+	}
+	body = body[:size]
+	if fields[1] == "tree" {
+		return printTree(body, contents)
+	}
+	_, err = contents.Write(body)
+	return err
+}
+
+// printTree writes a raw tree out the way git cat-file -p shows it
+//
+//	<mode> <type> <sha1>	<filename>
+func printTree(content []byte, out io.Writer) error {
+	for len(content) > 0 {
+		sp := bytes.IndexByte(content, ' ')
+		nul := bytes.IndexByte(content, 0)
+		if sp < 0 || nul < sp || len(content) < nul+21 {
+			return fmt.Errorf("malformed tree entry: %q", content)
+		}
+		mode := string(content[:sp])
+		objType := "blob"
+		switch mode {
+		case "40000":
+			objType = "tree"
+		case "160000":
+			objType = "commit"
+		}
+		_, err := fmt.Fprintf(out, "%06s %s %x\t%s\n",
+			mode, objType, content[nul+1:nul+21], content[sp+1:nul])
+		if err != nil {
+			return err
+		}
+		content = content[nul+21:]
+	}
+	return nil
+}
+
+// Close stops git cat-file
+func (cf *catFile) Close() error {
+	cf.stdin.Close()
+	if err := cf.cmd.Wait(); err != nil {
+		return fmt.Errorf("git cat-file --batch: %v", err)
+	}
+	return nil
+}
+
 func (lg localGit) ReadRaw(sha string, contents io.Writer) error {
 	if len(sha) != 40 {
 		return fmt.Errorf(`invalid sha: "%s"`, sha)
@@ -136,13 +437,13 @@ func (lg localGit) readPacked(sha string, contents io.Writer) error {
 	if err != nil {
 		return err
 	}
-	sizeRes, err := exec.Command("git", "cat-file", "-s", sha).Output()
+	sizeRes, err := lg.git("cat-file", "-s", sha).Output()
 	if err != nil {
 		return fmt.Errorf("getting size of object %s: %v", sha, err)
 	}
 	size := strings.TrimRight(string(sizeRes), "\n")
 
-	content, err := exec.Command("git", "cat-file", objectType, sha).Output()
+	content, err := lg.git("cat-file", objectType, sha).Output()
 	if err != nil {
 		return fmt.Errorf("getting content of object %s: %v", sha, err)
 	}
@@ -161,6 +462,60 @@ func (lg localGit) readPacked(sha string, contents io.Writer) error {
 	return nil
 }
 
+// WriteRaw stores a compressed object as a loose object. The object is
+// written to a temporary file which is only renamed into place once we've
+// checked the sha1 of the content, so an interrupted write never leaves a
+// truncated object behind.
 func (lg localGit) WriteRaw(sha string, contents io.Reader) error {
-	return errors.New("not implemented")
+	if len(sha) != 40 {
+		return fmt.Errorf(`invalid sha: "%s"`, sha)
+	}
+	raw, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("reading object %s: %v", sha, err)
+	}
+	actualSha, err := sha1Bytes(raw)
+	if err != nil {
+		return fmt.Errorf("object %s: %v", sha, err)
+	}
+	if actualSha != sha {
+		return errors.ErrInvalidObject{Sha: sha}
+	}
+
+	dir := path.Join(lg.gitDir, "objects", sha[:2])
+	fullPath := path.Join(dir, sha[2:])
+	if _, err := os.Stat(fullPath); err == nil {
+		// objects are immutable, so nothing to do
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf(`creating "%s": %v`, dir, err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "tmp_obj_")
+	if err != nil {
+		return fmt.Errorf("creating temporary object file: %v", err)
+	}
+	// After a successful rename this fails harmlessly
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf(`writing "%s": %v`, tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf(`writing "%s": %v`, tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf(`writing "%s": %v`, tmp.Name(), err)
+	}
+	// git makes its objects read-only
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return fmt.Errorf(`moving object into place "%s": %v`, fullPath, err)
+	}
+	return nil
 }
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
-	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	errors "github.com/cakemanny/git-remote-drive/errors"
 )
 
 func TestLocalGit(t *testing.T) {
@@ -14,15 +16,8 @@ func TestLocalGit(t *testing.T) {
 }
 
 func testLocalGit(t *testing.T, gc bool) {
-	startDir := os.Getenv("PWD")
-
 	tmpDir := t.TempDir()
 
-	if err := os.Chdir(tmpDir); err != nil {
-		t.Fatal("cd", tmpDir, err)
-	}
-	defer os.Chdir(startDir)
-
 	script := "git init && " +
 		"echo hi > test.txt && " +
 		"git add test.txt && " +
@@ -33,11 +28,13 @@ func testLocalGit(t *testing.T, gc bool) {
 		// gc so we test with packs instead of loose objects
 		script += " && git gc"
 	}
-	if err := exec.Command("/bin/sh", "-c", script).Run(); err != nil {
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Dir = tmpDir
+	if err := cmd.Run(); err != nil {
 		t.Fatal("git init add and commit:", err)
 	}
 
-	var lg = localGit{gitDir: ".git"}
+	var lg = localGit{gitDir: filepath.Join(tmpDir, ".git")}
 
 	t.Run("TestReadRef", func(t *testing.T) {
 		refs, err := lg.ListRefs()
@@ -67,6 +64,38 @@ func testLocalGit(t *testing.T, gc bool) {
 			t.Errorf(`expected: "%s", actual: "%s"`, expected, sb.String())
 		}
 	})
+	t.Run("TestCatFile", func(t *testing.T) {
+		objects, err := lg.startCatFile()
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		defer objects.Close()
+		for _, name := range []string{"HEAD", "HEAD^{tree}", hisha} {
+			sha, err := lg.ReadRef(name)
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			var expected, actual strings.Builder
+			if err := lg.ReadObject(sha, &expected); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if err := objects.ReadObject(sha, &actual); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if actual.String() != expected.String() {
+				t.Errorf("%s: expected: %q, actual: %q", name, expected.String(), actual.String())
+			}
+		}
+		const missing = "c5d2d737af4b6203aa37ca2ca13476624d11f4ee"
+		var sb strings.Builder
+		if err := objects.ReadObject(missing, &sb); err == nil {
+			t.Error("expected an error for a missing object")
+		}
+		// still usable afterwards
+		if err := objects.ReadObject(hisha, &sb); err != nil || sb.String() != "hi\n" {
+			t.Errorf("unexpected: %q %v", sb.String(), err)
+		}
+	})
 	t.Run("TestReadRaw", func(t *testing.T) {
 		var buf bytes.Buffer
 		err := lg.ReadRaw(hisha, &buf)
@@ -95,6 +124,34 @@ func testLocalGit(t *testing.T, gc bool) {
 			t.Error("expected-sha1:", hisha, "actual-sha1:", actualSha)
 		}
 	})
+	t.Run("TestWriteRaw", func(t *testing.T) {
+		sha, raw := encodeObject("blob", []byte("hello\n"))
+		if err := lg.WriteRaw(sha, bytes.NewReader(raw)); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		var sb strings.Builder
+		if err := lg.ReadObject(sha, &sb); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if sb.String() != "hello\n" {
+			t.Errorf(`expected: "hello\n", actual: "%s"`, sb.String())
+		}
+		// writing again is harmless
+		if err := lg.WriteRaw(sha, bytes.NewReader(raw)); err != nil {
+			t.Error("unexpected error", err)
+		}
+	})
+	t.Run("TestWriteRawInvalid", func(t *testing.T) {
+		_, raw := encodeObject("blob", []byte("hello again\n"))
+		const wrongSha = "c5d2d737af4b6203aa37ca2ca13476624d11f4ee"
+		err := lg.WriteRaw(wrongSha, bytes.NewReader(raw))
+		if _, ok := err.(errors.ErrInvalidObject); !ok {
+			t.Error("expected ErrInvalidObject, actual:", err)
+		}
+		if has, _ := lg.HasObject(wrongSha); has {
+			t.Error("invalid object should not have been written")
+		}
+	})
 	t.Run("TestGetType", func(t *testing.T) {
 		refType, err := lg.GetType(hisha)
 		if err != nil {
@@ -2,14 +2,14 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"os"
-
+	"strconv"
 	"strings"
 
+	errors "github.com/cakemanny/git-remote-drive/errors"
 	"github.com/cakemanny/git-remote-drive/store"
 )
 
@@ -30,34 +30,161 @@ If the URL is of the form drive::<path>
     $ git-remote-drive <remote> <path>
     $ git-remote-drive <path> <path>
 
+
+A URL of the form drive+file://<dir>, or drive::file://<dir>, keeps the
+repository in a directory on the local filesystem instead of in Drive. So
+does setting GIT_DRIVE_LOCAL_ROOT, under which drive://<path> is then kept.
+
+It can also be run by hand to maintain a remote, see manage.go
+
+	$ git-remote-drive --admin <command> drive://<path> [<args>...]
+
+git always runs us with exactly two arguments, and the remote can have any
+name, even that of a command, so commands are only run after --admin.
 */
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalf("Not enough command line arguments. Was: %v", os.Args)
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		log.Fatalln(err)
 	}
-	remoteName := os.Args[1]
-	_ = remoteName
-	driveUrl := os.Args[2]
+}
 
-	var fileStore store.SimpleFileStore = store.NewClient()
-	var manager Manager = storeManager{
-		strings.TrimPrefix(driveUrl, "drive://"),
-		fileStore,
+// run runs the command line args, talking to git over in and out
+func run(args []string, in io.Reader, out io.Writer) error {
+	if len(args) != 2 || args[0] == "--admin" {
+		return runAdmin(args)
 	}
+	remoteName := args[0]
+	_ = remoteName
+	driveUrl := args[1]
 
-	scanner := bufio.NewScanner(os.Stdin)
+	manager := newRemote(driveUrl)
+
+	scanner := bufio.NewScanner(in)
 	for scanner.Scan() {
 		line := scanner.Text()
 		log.Printf(line)
-		dispatch(line, os.Stdout, manager)
+		dispatch(line, scanner, out, manager)
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("reading standard input: %s", err)
 	}
 	log.Printf("exiting gracefully")
+	return nil
+}
+
+// runAdmin runs one of the adminCommands
+func runAdmin(args []string) error {
+	if len(args) < 3 || args[0] != "--admin" {
+		return fmt.Errorf("usage: git-remote-drive <remote> <url>\n" +
+			"   or: git-remote-drive --admin <command> <url> [<args>...]")
+	}
+	name, url := args[1], args[2]
+	command, ok := adminCommands[name]
+	if !ok {
+		return fmt.Errorf("unknown command: %s", name)
+	}
+	if err := command(newRemote(url), args[3:]); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// newRemote creates a Manager for the repository at the given URL
+func newRemote(driveUrl string) storeManager {
+	if root, basePath, ok := localRoot(driveUrl, os.Getenv("GIT_DRIVE_LOCAL_ROOT")); ok {
+		return storeManager{basePath, store.NewLocalStore(root)}
+	}
+
+	// git sets GIT_DIR when running us. When run by hand we use whichever
+	// repository we are in, if any, for our settings
+	local := localGit{gitDir: os.Getenv("GIT_DIR")}
+	requestsPerSecond, err := setting(local, "GIT_DRIVE_REQUESTS_PER_SECOND",
+		"drive.requestsPerSecond", defaultRequestsPerSecond)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	requestBudget, err := setting(local, "GIT_DRIVE_REQUEST_BUDGET",
+		"drive.requestBudget", 0)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	trash, err := local.ConfigBool("drive.trash", false)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	options := []store.ClientOption{
+		store.WithRateLimit(float64(requestsPerSecond), int(requestsPerSecond)),
+		store.WithRequestBudget(requestBudget),
+		store.WithTrash(trash),
+	}
+	apiURL := os.Getenv("GIT_DRIVE_API_URL")
+	if apiURL == "" {
+		if apiURL, err = local.Config("drive.apiUrl", ""); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if apiURL != "" {
+		options = append(options, store.WithBaseURL(apiURL))
+	}
+	fileStore, err := store.NewClient(options...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return storeManager{
+		strings.TrimPrefix(driveUrl, "drive://"),
+		fileStore,
+	}
+}
+
+// localRoot works out whether the repository at url is kept on the local
+// filesystem, and if so in which directory and at what path inside it.
+// envRoot is the value of GIT_DRIVE_LOCAL_ROOT.
+func localRoot(url string, envRoot string) (root string, basePath string, ok bool) {
+	for _, prefix := range []string{"drive+file://", "file://"} {
+		if strings.HasPrefix(url, prefix) {
+			return strings.TrimPrefix(url, prefix), "", true
+		}
+	}
+	if envRoot != "" {
+		return envRoot, strings.TrimPrefix(url, "drive://"), true
+	}
+	return "", "", false
+}
+
+// Drive allows around 10 requests a second per user before it starts
+// telling us to slow down
+const defaultRequestsPerSecond = 10
+
+// setting reads an integer setting from the environment variable env if it
+// is set, or otherwise from the git config
+func setting(local localGit, env string, name string, def int64) (int64, error) {
+	if value := os.Getenv(env); value != "" {
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %v", env, err)
+		}
+		return v, nil
+	}
+	return local.ConfigInt(name, def)
+}
+
+// readBatch collects a batch of commands, such as a series of fetch or push
+// commands, which is terminated by a blank line. first is the line which
+// has already been read.
+func readBatch(first string, in *bufio.Scanner) []string {
+	batch := []string{first}
+	for in.Scan() {
+		line := in.Text()
+		if line == "" {
+			break
+		}
+		log.Printf(line)
+		batch = append(batch, line)
+	}
+	return batch
 }
 
-func dispatch(line string, out io.Writer, manager Manager) {
+func dispatch(line string, in *bufio.Scanner, out io.Writer, manager storeManager) {
 	fields := strings.Fields(line)
 	if len(fields) == 0 {
 		log.Println("warning: command was only whitespace")
@@ -102,132 +229,25 @@ func dispatch(line string, out io.Writer, manager Manager) {
 		default:
 			fmt.Fprintln(out, "unsupported")
 		}
-	case "fetch":
-	case "push": // push refs/heads/master:refs/heads/master
-		// ok looks like we need to do all the hard work
-
-		// Idea: find out local and remote commits.
-		//       work backwards from local adding all reachable objects to a
-		//       set of objects to send.
-		//		 ?- if we hit the remote commit, stop following that branch.
-		//		 ?- if we hit a parent of remote, stop following that branch.
-		//		 work from remote commit backwards removing all reachable
-		//		 objects from the set.
-		//		 raw copy all the objects.
-		//		 update the remote ref.
-		//
-
-		// Space and colons are invalid branch names - so we are all good with
-		// this logic
-		if strings.Count(fields[1], ":") != 1 {
-			fmt.Fprintln(out, "error")
-			fmt.Fprintln(out)
-			return
-		}
-		localRefName, remoteRefName := func() (string, string) {
-			x := strings.SplitN(fields[1], ":", 2)
-			return x[0], x[1]
-		}()
+	case "fetch": // fetch c5d2d737af4b6203aa37ca2ca13476624d11f4ee refs/heads/master
+		batch := readBatch(line, in)
 
 		var localManager = localGit{
 			gitDir: os.Getenv("GIT_DIR"),
 		}
-
-		localRef, err := localManager.ReadRef(localRefName)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		remoteRef, err := manager.ReadRef(remoteRefName)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		log.Println("localRef", localRef)
-		log.Println("remoteRef", remoteRef)
-
-		// assumes ref points to a commit, what if the ref points to
-		// an annotated tag instead of a commit? bail for the moment
-		for _, ref := range []string{localRef, remoteRef} {
-			refType, err := localManager.GetType(ref)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			if refType != "commit" {
-				fmt.Fprintf(out, "error %s \"unsupported object type: %s\"\n", localRefName, refType)
-				fmt.Fprintln(out)
-				return
-			}
-		}
-
-		toSync, err := reachableObjects(localManager, localRef)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		toSync[localRef] = true
-		log.Println("localObjects:", toSync)
-		inRemote, err := reachableObjects(
-			// objects in remote are also in local, so use local since it will
-			// be nearer
-			localManager, remoteRef,
-		)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		inRemote[remoteRef] = true
-		log.Println("inRemote:", inRemote)
-		for k, _ := range inRemote {
-			delete(toSync, k)
-		}
-		log.Println("toSync:", toSync)
-
-		// Now send all the objects
-		// Then update the remote ref
-
-		localErrors := map[string]error{}
-		remoteErrors := map[string]error{}
-
-		for objectRef, doSync := range toSync {
-			if doSync {
-				var buf bytes.Buffer
-				err := localManager.ReadRaw(objectRef, &buf)
-				if err != nil {
-					localErrors[objectRef] = err
-					continue
-				}
-				err = manager.WriteRaw(objectRef, &buf)
-				if err != nil {
-					remoteErrors[objectRef] = err
-				}
-			}
-		}
-
-		if len(localErrors) > 0 {
-			for sha, err := range localErrors {
-				log.Printf("error reading object %s: %v", sha, err)
-			}
-			fmt.Fprintf(out, "error %s \"error reading local objects\"\n", localRefName)
-			fmt.Fprintln(out)
-			return
-		}
-		if len(remoteErrors) > 0 {
-			for sha, err := range remoteErrors {
-				log.Printf("error writing object %s: %v", sha, err)
-			}
-			fmt.Fprintf(out, "error %s \"error writing remote objects\"\n", localRefName)
-			fmt.Fprintln(out)
-			return
+		if err := fetch(batch, manager, localManager); err != nil {
+			// The protocol gives us no way to report a failed fetch other
+			// than to exit
+			log.Fatalln("fetch:", err)
 		}
+		fmt.Fprintln(out)
+	case "push": // push refs/heads/master:refs/heads/master
+		batch := readBatch(line, in)
 
-		err = manager.WriteRef(Ref{
-			Value: localRef,
-			Name:  remoteRefName,
-		})
-		if err != nil {
-			fmt.Fprintf(out, "error %s \"error updating remote reference\"\n", localRefName)
-			fmt.Fprintln(out)
+		var localManager = localGit{
+			gitDir: os.Getenv("GIT_DIR"),
 		}
-
-		fmt.Fprintf(out, "error %s \"implementation not finished\"\n", localRefName)
-		fmt.Fprintln(out)
+		push(batch, out, manager, localManager)
 	default:
 		// TODO: say we don't support the command
 	}
@@ -238,71 +258,32 @@ func listRefs(out io.Writer, lister RefLister) {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	if len(refs) == 0 {
-		log.Printf("warning: no remote refs found")
-	}
-	for _, ref := range refs {
-		fmt.Fprintf(out, "%s %s\n", ref.Value, ref.Name)
-	}
-	// End with blank line
-	fmt.Fprintln(out)
-}
-
-func mergeInto(dst, src map[string]bool) {
-	for k, v := range src {
-		// test v so that we don't add to dst unnecessarily
-		if v {
-			dst[k] = true
-		}
+	head, err := lister.ReadSymbolicRef("HEAD")
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		head, err = "", nil
 	}
-}
-
-func reachableObjects(m Manager, commitRef string) (map[string]bool, error) {
-	commit, err := GetCommit(m, commitRef)
 	if err != nil {
-		return nil, fmt.Errorf("getting commit %s: %v", commitRef, err)
-	}
-
-	result := map[string]bool{}
-
-	{
-		result[commit.Tree] = true
-		tobs, err := reachableObjectsFromTree(m, commit.Tree)
-		if err != nil {
-			return nil, fmt.Errorf("exploring tree %s: %v", commit.Tree, err)
-		}
-		mergeInto(result, tobs)
+		log.Fatalf("%v", err)
 	}
-
-	for _, parentRef := range commit.Parents {
-		result[parentRef] = true
-		pobs, err := reachableObjects(m, parentRef)
-		if err != nil {
-			return nil, fmt.Errorf("getting parent commits of %s: %v", commitRef, err)
+	for _, ref := range refs {
+		if ref.Name == head {
+			// lets git clone choose which branch to check out
+			fmt.Fprintf(out, "@%s HEAD\n", head)
 		}
-		mergeInto(result, pobs)
 	}
-
-	return result, nil
-}
-
-func reachableObjectsFromTree(m Manager, treeRef string) (map[string]bool, error) {
-	tree, err := GetTree(m, treeRef)
-	if err != nil {
-		return nil, fmt.Errorf("getting tree %s: %v", treeRef, err)
+	if len(refs) == 0 {
+		log.Printf("warning: no remote refs found")
 	}
-	result := map[string]bool{}
-	for _, item := range tree {
-		result[item.Ref] = true
-		if item.Type == TREE {
-			tobs, err := reachableObjectsFromTree(m, item.Ref)
-			if err != nil {
-				return nil, fmt.Errorf("exploring tree %s: %v", item.Ref, err)
-			}
-			mergeInto(result, tobs)
+	for _, ref := range refs {
+		fmt.Fprintf(out, "%s %s\n", ref.Value, ref.Name)
+		if ref.Peeled != "" {
+			// git ignores these when fetching but uses them to decide
+			// which tags to follow
+			fmt.Fprintf(out, "%s %s^{}\n", ref.Peeled, ref.Name)
 		}
 	}
-	return result, nil
+	// End with blank line
+	fmt.Fprintln(out)
 }
 
 //
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"strings"
 	"testing"
 )
@@ -16,7 +17,8 @@ func TestDispatch(t *testing.T) {
 	}
 	for _, v := range matrix {
 		var out strings.Builder
-		dispatch(v.command, &out, storeManager{"", fakeStore})
+		in := bufio.NewScanner(strings.NewReader(""))
+		dispatch(v.command, in, &out, storeManager{"", fakeStore})
 		result := out.String()
 		if result != v.expected {
 			t.Error("command:", v.command, "expected:", v.expected,
@@ -39,3 +41,89 @@ func TestListRefs(t *testing.T) {
 			expected, result)
 	}
 }
+
+func TestLocalRoot(t *testing.T) {
+	matrix := []struct {
+		url, envRoot, root, basePath string
+		ok                           bool
+	}{
+		{"drive+file:///tmp/remote.git", "", "/tmp/remote.git", "", true},
+		{"file:///tmp/remote.git", "", "/tmp/remote.git", "", true},
+		{"drive+file:///tmp/remote.git", "/srv", "/tmp/remote.git", "", true},
+		{"drive://git/remote.git", "/srv", "/srv", "git/remote.git", true},
+		{"drive://git/remote.git", "", "", "", false},
+	}
+	for _, v := range matrix {
+		root, basePath, ok := localRoot(v.url, v.envRoot)
+		if root != v.root || basePath != v.basePath || ok != v.ok {
+			t.Errorf("url: %s, env: %q, expected: %q %q %v, actual: %q %q %v",
+				v.url, v.envRoot, v.root, v.basePath, v.ok, root, basePath, ok)
+		}
+	}
+}
+
+func TestLocalRemote(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	remote := newRemote("drive+file://" + t.TempDir())
+
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote,
+		localGit{gitDir: srcDir})
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("expected: \"ok refs/heads/master\\n\\n\", actual: %q", out.String())
+	}
+
+	head := gitOutput(t, srcDir, "rev-parse", "master")
+	dstDir := gitRepo(t, "true")
+	err := fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+}
+
+func TestRunRemoteNamedLikeCommand(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	url := "drive+file://" + t.TempDir()
+	remote := newRemote(url)
+	local := localGit{gitDir: srcDir}
+	for _, msg := range []string{"second commit", "third commit"} {
+		gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", msg)
+		var out strings.Builder
+		push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+		if out.String() != "ok refs/heads/master\n\n" {
+			t.Fatalf("unexpected push result: %q", out.String())
+		}
+	}
+
+	// git fetch gc, for a remote called gc
+	var out strings.Builder
+	if err := run([]string{"gc", url}, strings.NewReader("capabilities\n"), &out); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if out.String() != "push\nfetch\noption\n\n" {
+		t.Errorf("expected the remote helper, actual: %q", out.String())
+	}
+	if packs, _ := remote.ListPacks(); len(packs) != 2 {
+		t.Error("expected the packs to be left alone, actual:", packs)
+	}
+
+	if err := run([]string{"--admin", "gc", url}, strings.NewReader(""), &out); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if packs, _ := remote.ListPacks(); len(packs) != 1 {
+		t.Error("expected a single pack, actual:", packs)
+	}
+	for _, args := range [][]string{
+		{"gc", url, "--small-pack=10"},
+		{"--admin", "frobnicate", url},
+		{"--admin"},
+		{"--admin", "gc"},
+	} {
+		if err := run(args, strings.NewReader(""), &out); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
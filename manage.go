@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	errors "github.com/cakemanny/git-remote-drive/errors"
+	store "github.com/cakemanny/git-remote-drive/store"
+)
+
+// adminCommands are run by hand, rather than by git, to look after a
+// remote, e.g.
+//
+//	$ git-remote-drive --admin set-head drive://path/to/repo.git main
+//
+// Each is given the remote and the remaining command line arguments.
+var adminCommands = map[string]func(remote storeManager, args []string) error{
+	"set-head": setHead,
+	"gc":       gc,
+	"dedupe":   dedupe,
+}
+
+// setHead changes the default branch of the remote, which is the branch that
+// git clone checks out
+func setHead(remote storeManager, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: git-remote-drive --admin set-head <url> <branch>")
+	}
+	branch := args[0]
+	if !strings.HasPrefix(branch, "refs/") {
+		branch = "refs/heads/" + branch
+	}
+	if _, err := remote.ReadRef(branch); err != nil {
+		if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+			return fmt.Errorf("no such branch in remote: %s", branch)
+		}
+		return err
+	}
+	if err := remote.WriteSymbolicRef("HEAD", branch); err != nil {
+		return err
+	}
+	log.Printf("HEAD now points at %s", branch)
+	return nil
+}
+
+// dedupe reports the paths in the remote which more than one file or folder
+// has, and, unless --dry-run is given, gets rid of the duplicates. Folders
+// are merged and, of files, the one that is already being read is kept.
+// Copies of a file with different contents, such as a ref that two pushes
+// wrote at once, are left for the user to choose between, unless
+// --keep-newest is given.
+func dedupe(remote storeManager, args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the duplicates")
+	keepNewest := flags.Bool("keep-newest", false,
+		"of copies with different contents, keep the newest")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("usage: git-remote-drive --admin dedupe <url> [--dry-run] [--keep-newest]")
+	}
+	repairer, ok := remote.store.(store.DuplicateRepairer)
+	if !ok {
+		log.Println("this remote can't have duplicates")
+		return nil
+	}
+	duplicates, err := repairer.FindDuplicates(remote.basePath)
+	if err != nil {
+		return err
+	}
+	if len(duplicates) == 0 {
+		log.Println("no duplicates found")
+		return nil
+	}
+	for _, dup := range duplicates {
+		kind := "files"
+		if dup.IsFolder {
+			kind = "folders"
+		}
+		log.Printf("%s: %d %s", dup.Path, dup.Count, kind)
+	}
+	if *dryRun {
+		return nil
+	}
+	// Parents come before their children, so merging a folder may leave
+	// nothing to do for the duplicates found inside it
+	failed, divergent := 0, 0
+	for _, dup := range duplicates {
+		if err := repairer.RepairDuplicate(dup.Path, *keepNewest); err != nil {
+			log.Println(err)
+			failed++
+			if errors.Is(err, errors.ErrDivergentDuplicate) {
+				divergent++
+			}
+		}
+	}
+	if divergent > 0 {
+		log.Printf("%d duplicates have copies with different contents, "+
+			"listed above. If the newest of each is the one to keep, run "+
+			"again with --keep-newest", divergent)
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to repair %d of %d duplicates", failed, len(duplicates))
+	}
+	log.Printf("repaired %d duplicates", len(duplicates))
+	return nil
+}
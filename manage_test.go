@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	store "github.com/cakemanny/git-remote-drive/store"
+)
+
+func TestSetHead(t *testing.T) {
+	remote := storeManager{"", memStoreWith(map[string]string{
+		"refs/heads/master": "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
+		"refs/heads/main":   "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
+	})}
+
+	for _, branch := range []string{"main", "refs/heads/master"} {
+		if err := setHead(remote, []string{branch}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	head, err := remote.ReadSymbolicRef("HEAD")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if head != "refs/heads/master" {
+		t.Error("expected: refs/heads/master actual:", head)
+	}
+
+	if err := setHead(remote, []string{"develop"}); err == nil {
+		t.Error("expected error setting HEAD to a missing branch")
+	}
+	if err := setHead(remote, nil); err == nil {
+		t.Error("expected usage error")
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	remoteStore := memStoreWith(map[string]string{
+		"repo.git/objects/info/packs": "",
+		"repo.git/refs/tags/v1":       "x",
+	})
+	remoteStore.Inject(store.Fault{Op: "Create", Path: "repo.git/*/*/*", Duplicate: true})
+	remoteStore.Create("repo.git/objects/ab/cdef", strings.NewReader("x"))
+	remoteStore.Create("repo.git/refs/heads/master", strings.NewReader("x"))
+	remote := storeManager{"repo.git", remoteStore}
+
+	repaired := func() []string {
+		var paths []string
+		for _, call := range remoteStore.Calls() {
+			if strings.HasPrefix(call, "RepairDuplicate ") {
+				paths = append(paths, strings.TrimPrefix(call, "RepairDuplicate "))
+			}
+		}
+		return paths
+	}
+	if err := dedupe(remote, []string{"--dry-run"}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(repaired()) != 0 {
+		t.Error("expected a dry run to change nothing, actual:", repaired())
+	}
+	if err := dedupe(remote, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expected := "[repo.git/objects/ab repo.git/objects/ab/cdef " +
+		"repo.git/refs/heads repo.git/refs/heads/master]"
+	if fmt.Sprint(repaired()) != expected {
+		t.Errorf("expected: %s, actual: %v", expected, repaired())
+	}
+	if duplicates, _ := remoteStore.FindDuplicates("repo.git"); len(duplicates) != 0 {
+		t.Error("expected no duplicates left, actual:", duplicates)
+	}
+	if err := dedupe(remote, []string{"extra"}); err == nil {
+		t.Error("expected usage error")
+	}
+}
+
+func TestDedupeDivergent(t *testing.T) {
+	remoteStore := memStoreWith(map[string]string{
+		"repo.git/refs/heads/master": "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
+	})
+	// two pushes that both thought they were creating the ref
+	remoteStore.Create("repo.git/refs/heads/master",
+		strings.NewReader("45b983be36b73c0788dc9cbcb76cbb80fc7bb057\n"))
+	remote := storeManager{"repo.git", remoteStore}
+
+	if err := dedupe(remote, nil); err == nil {
+		t.Fatal("expected copies with different contents to be refused")
+	}
+	if duplicates, _ := remoteStore.FindDuplicates("repo.git"); len(duplicates) != 1 {
+		t.Error("expected both copies to be kept, actual:", duplicates)
+	}
+	if err := dedupe(remote, []string{"--keep-newest"}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	value, err := remote.ReadRef("refs/heads/master")
+	if err != nil || value != "45b983be36b73c0788dc9cbcb76cbb80fc7bb057" {
+		t.Error("expected the newest copy to be kept, actual:", value, err)
+	}
+}
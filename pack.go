@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Pushes are stored in the remote as a pack and its index, e.g.
+//
+//	objects/pack/pack-579aa09dc6014769ca718bb648dff8cbdbd844e7.pack
+//	objects/pack/pack-579aa09dc6014769ca718bb648dff8cbdbd844e7.idx
+//
+// rather than one file per object. The pack is written before the index, so
+// a pack only counts once its index exists.
+
+var packIndexMagic = []byte{0377, 't', 'O', 'c'}
+
+// readPackIndex lists the objects in a pack from its (version 2) index, see
+// Documentation/technical/pack-format.txt in git
+func readPackIndex(r io.Reader) ([]string, error) {
+	rdr := bufio.NewReader(r)
+	var header struct {
+		Magic   [4]byte
+		Version uint32
+		Fanout  [256]uint32
+	}
+	if err := binary.Read(rdr, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("reading pack index header: %v", err)
+	}
+	if !bytes.Equal(header.Magic[:], packIndexMagic) || header.Version != 2 {
+		return nil, fmt.Errorf("unsupported pack index format")
+	}
+	// the last fanout entry is the number of objects
+	count := header.Fanout[255]
+	shas := make([]string, count)
+	var sha [20]byte
+	for i := range shas {
+		if _, err := io.ReadFull(rdr, sha[:]); err != nil {
+			return nil, fmt.Errorf("reading pack index: %v", err)
+		}
+		shas[i] = fmt.Sprintf("%x", sha)
+	}
+	return shas, nil
+}
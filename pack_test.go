@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReadPackIndex(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	local := localGit{gitDir: srcDir}
+	shas := strings.Fields(gitOutput(t, srcDir, "rev-list", "--objects",
+		"--no-object-names", "master"))
+	sort.Strings(shas)
+
+	dir := t.TempDir()
+	names, err := local.PackObjects(shas, dir, 0)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(names) != 1 {
+		t.Fatal("expected a single pack, actual:", names)
+	}
+	name := names[0]
+	idx, err := os.ReadFile(filepath.Join(dir, name+".idx"))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	actual, err := readPackIndex(bytes.NewReader(idx))
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if strings.Join(actual, " ") != strings.Join(shas, " ") {
+		t.Errorf("expected: %v, actual: %v", shas, actual)
+	}
+
+	// a v1 index, or anything else, is rejected
+	if _, err := readPackIndex(bytes.NewReader(idx[4:])); err == nil {
+		t.Error("expected error for index without magic number")
+	}
+	if _, err := readPackIndex(bytes.NewReader(idx[:100])); err == nil {
+		t.Error("expected error for truncated index")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+)
+
+// forEach calls do for each of items, with up to workers calls running at
+// once. A failure doesn't stop the other items; the errors are collected by
+// item for the caller to report.
+func forEach(workers int, items []string, do func(item string) error) map[string]error {
+	if workers < 1 {
+		workers = 1
+	}
+	type result struct {
+		item string
+		err  error
+	}
+	jobs := make(chan string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				results <- result{item, do(item)}
+			}
+		}()
+	}
+	go func() {
+		for _, item := range items {
+			jobs <- item
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	errs := map[string]error{}
+	for r := range results {
+		if r.err != nil {
+			errs[r.item] = r.err
+		}
+	}
+	return errs
+}
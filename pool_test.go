@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	var items []string
+	for i := 0; i < 20; i++ {
+		items = append(items, fmt.Sprint(i))
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	done := map[string]bool{}
+	errs := forEach(3, items, func(item string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		running--
+		done[item] = true
+		if item == "7" || item == "13" {
+			return fmt.Errorf("failed %s", item)
+		}
+		return nil
+	})
+
+	if len(done) != len(items) {
+		t.Error("expected every item to be done, actual:", len(done))
+	}
+	if maxRunning > 3 {
+		t.Error("expected at most 3 at once, actual:", maxRunning)
+	}
+	if len(errs) != 2 || errs["7"] == nil || errs["13"] == nil {
+		t.Error("expected errors for 7 and 13, actual:", errs)
+	}
+
+	if errs := forEach(0, nil, nil); len(errs) != 0 {
+		t.Error("expected no errors, actual:", errs)
+	}
+}
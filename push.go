@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	errors "github.com/cakemanny/git-remote-drive/errors"
+)
+
+const (
+	// how many packs to upload at once, see drive.uploads
+	defaultUploads = 4
+	// big pushes are split into packs of at most this many bytes, see
+	// drive.maxPackSize, so that they can be uploaded side by side
+	defaultMaxPackSize = 64 << 20
+)
+
+// pushCommand is a single refspec from a batch of push commands, e.g.
+//
+//	push refs/heads/master:refs/heads/master
+//	push +refs/heads/master:refs/heads/master
+//	push :refs/heads/master
+//
+// where the leading + means the update is forced and an empty source means
+// the remote ref should be deleted.
+type pushCommand struct {
+	src   string
+	dst   string
+	force bool
+
+	// filled in once we have looked at both repositories
+	localRef  string
+	localType ObjectType
+	peeled    string
+	remoteRef string
+}
+
+func (cmd pushCommand) isDelete() bool {
+	return cmd.src == ""
+}
+
+func parsePushCommand(line string) (pushCommand, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "push" {
+		return pushCommand{}, fmt.Errorf("invalid push command: \"%s\"", line)
+	}
+	refspec := fields[1]
+	force := strings.HasPrefix(refspec, "+")
+	refspec = strings.TrimPrefix(refspec, "+")
+	// Space and colons are invalid branch names - so we are all good with
+	// this logic
+	if strings.Count(refspec, ":") != 1 {
+		return pushCommand{}, fmt.Errorf("invalid refspec: \"%s\"", fields[1])
+	}
+	x := strings.SplitN(refspec, ":", 2)
+	return pushCommand{src: x[0], dst: x[1], force: force}, nil
+}
+
+// push handles a batch of push commands. The objects for all the refs are
+// sent together and then each ref is updated, reporting either
+//
+//	ok <dst>
+//	error <dst> <why>
+//
+// for each of them, followed by a blank line.
+func push(batch []string, out io.Writer, remote storeManager, local localGit) {
+	var commands []pushCommand
+	for _, line := range batch {
+		cmd, err := parsePushCommand(line)
+		if err != nil {
+			log.Println(err)
+			reportError(out, strings.TrimPrefix(line, "push "), "invalid push command")
+			continue
+		}
+		commands = append(commands, cmd)
+	}
+
+	// refs which fail early are reported as they fail and do not take
+	// part in the rest of the push
+	var ready []pushCommand
+	for _, cmd := range commands {
+		if err := preparePush(&cmd, remote, local); err != nil {
+			log.Printf("push %s:%s: %v", cmd.src, cmd.dst, err)
+			reportError(out, cmd.dst, err.Error())
+			continue
+		}
+		ready = append(ready, cmd)
+	}
+
+	if err := sendObjects(ready, remote, local); err != nil {
+		log.Println(err)
+		for _, cmd := range ready {
+			reportError(out, cmd.dst, err.Error())
+		}
+		fmt.Fprintln(out)
+		return
+	}
+
+	var pushedBranches []string
+	for _, cmd := range ready {
+		if cmd.isDelete() {
+			if err := remote.CompareAndDeleteRef(cmd.dst, cmd.remoteRef); err != nil {
+				log.Printf("deleting %s: %v", cmd.dst, err)
+				reportError(out, cmd.dst, remoteErrorReason(err, "error deleting remote reference"))
+				continue
+			}
+			fmt.Fprintf(out, "ok %s\n", cmd.dst)
+			continue
+		}
+		// Someone else may have pushed since we looked
+		err := remote.CompareAndSwapRef(Ref{
+			Value:  cmd.localRef,
+			Name:   cmd.dst,
+			Peeled: cmd.peeled,
+		}, cmd.remoteRef)
+		if err != nil {
+			log.Printf("updating %s: %v", cmd.dst, err)
+			reportError(out, cmd.dst, remoteErrorReason(err, "error updating remote reference"))
+			continue
+		}
+		fmt.Fprintf(out, "ok %s\n", cmd.dst)
+		if strings.HasPrefix(cmd.dst, "refs/heads/") {
+			pushedBranches = append(pushedBranches, cmd.dst)
+		}
+	}
+	fmt.Fprintln(out)
+
+	if len(pushedBranches) > 0 {
+		if err := initRemoteHead(pushedBranches, remote, local); err != nil {
+			log.Println("warning: unable to set remote HEAD:", err)
+		}
+	}
+}
+
+// initRemoteHead points the remote HEAD at one of the branches just pushed,
+// if it doesn't point anywhere yet. We prefer the branch checked out locally.
+func initRemoteHead(pushedBranches []string, remote Manager, local localGit) error {
+	_, err := remote.ReadSymbolicRef("HEAD")
+	if err == nil {
+		return nil
+	}
+	if _, isNotFound := err.(errors.ErrNotFound); !isNotFound {
+		return err
+	}
+	head := pushedBranches[0]
+	if localHead, err := local.ReadSymbolicRef("HEAD"); err == nil {
+		for _, branch := range pushedBranches {
+			if branch == localHead {
+				head = branch
+			}
+		}
+	}
+	log.Println("setting remote HEAD to", head)
+	return remote.WriteSymbolicRef("HEAD", head)
+}
+
+// reportError writes the status line for a ref which could not be pushed.
+// git understands C-style quoting of the reason, which for the ASCII messages
+// we produce is the same as go's.
+func reportError(out io.Writer, dst string, why string) {
+	fmt.Fprintf(out, "error %s %q\n", dst, why)
+}
+
+// remoteErrorReason is the reason to give git when something went wrong in
+// the remote. Most errors are only interesting in the log, but running out
+// of quota, losing a race with another push, or a lock left behind by one,
+// is something the user can act on.
+func remoteErrorReason(err error, why string) string {
+	if errors.Is(err, errors.ErrQuotaExhausted) {
+		return errors.ErrQuotaExhausted.Error()
+	}
+	if errors.Is(err, errors.ErrConflict) {
+		// git suggests fetching and integrating before pushing again
+		return "fetch first"
+	}
+	var locked errors.ErrLocked
+	if errors.As(err, &locked) {
+		return locked.Error()
+	}
+	return why
+}
+
+// preparePush resolves the local and remote values of the refs in cmd and
+// checks that we are able to push them
+func preparePush(cmd *pushCommand, remote Manager, local localGit) error {
+	if cmd.isDelete() {
+		remoteRef, err := remote.ReadRef(cmd.dst)
+		if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+			return fmt.Errorf("remote ref does not exist")
+		}
+		if err != nil {
+			return fmt.Errorf("reading remote ref: %v", err)
+		}
+		// Like git receive-pack, don't leave HEAD dangling
+		if head, err := remote.ReadSymbolicRef("HEAD"); err == nil && head == cmd.dst {
+			return fmt.Errorf("refusing to delete the current branch, " +
+				"use git-remote-drive --admin set-head to change it first")
+		}
+		cmd.remoteRef = remoteRef
+		return nil
+	}
+
+	localRef, err := local.ReadRef(cmd.src)
+	if err != nil {
+		return err
+	}
+	remoteRef, err := remote.ReadRef(cmd.dst)
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		// A new ref
+		remoteRef, err = "", nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading remote ref: %v", err)
+	}
+	log.Println("localRef", localRef)
+	log.Println("remoteRef", remoteRef)
+
+	typeName, err := local.GetType(localRef)
+	if err != nil {
+		return err
+	}
+	localType, err := parseObjectType(typeName)
+	if err != nil {
+		return err
+	}
+	if localType == TAG {
+		// Record what the tag points at so that list can advertise it
+		if cmd.peeled, err = local.Peel(localRef); err != nil {
+			return err
+		}
+	}
+
+	if !cmd.force && remoteRef != "" && remoteRef != localRef {
+		if err := checkFastForward(cmd.dst, remoteRef, localRef, local); err != nil {
+			return err
+		}
+	}
+
+	cmd.localRef, cmd.localType, cmd.remoteRef = localRef, localType, remoteRef
+	return nil
+}
+
+// checkFastForward checks that updating the remote ref dst from remoteRef to
+// localRef does not lose any commits. The errors use the wording git
+// understands so that it can give the user the usual advice.
+func checkFastForward(dst, remoteRef, localRef string, local localGit) error {
+	if strings.HasPrefix(dst, "refs/tags/") {
+		// tags aren't expected to move at all
+		return fmt.Errorf("already exists")
+	}
+	has, err := local.HasObject(remoteRef)
+	if err != nil {
+		return err
+	}
+	if !has {
+		// someone else has pushed something we haven't seen
+		return fmt.Errorf("fetch first")
+	}
+	isAncestor, err := local.IsAncestor(remoteRef, localRef)
+	if err != nil {
+		return err
+	}
+	if !isAncestor {
+		return fmt.Errorf("non-fast-forward")
+	}
+	return nil
+}
+
+// sendObjects copies all the objects needed by the refs in commands, which
+// the remote does not already have, to the remote.
+func sendObjects(commands []pushCommand, remote storeManager, local localGit) error {
+	var wants []walkStart
+	for _, cmd := range commands {
+		if !cmd.isDelete() {
+			wants = append(wants, walkStart{cmd.localRef, cmd.localType})
+		}
+	}
+	if len(wants) == 0 {
+		return nil
+	}
+	haves, err := remoteHaves(remote, local)
+	if err != nil {
+		return err
+	}
+	objects, err := local.startCatFile()
+	if err != nil {
+		return fmt.Errorf("error reading local objects: %v", err)
+	}
+	toSync, err := objectsBetween(objects, wants, haves)
+	objects.Close()
+	if err != nil {
+		return fmt.Errorf("error reading local objects: %v", err)
+	}
+	if options.verbosity >= 1 {
+		log.Println("toSync:", toSync)
+	}
+
+	if len(toSync) == 0 {
+		return nil
+	}
+	var shas []string
+	for sha := range toSync {
+		shas = append(shas, sha)
+	}
+
+	workers, err := local.ConfigInt("drive.uploads", defaultUploads)
+	if err != nil {
+		return err
+	}
+	maxPackSize, err := local.ConfigInt("drive.maxPackSize", defaultMaxPackSize)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "git-remote-drive")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	names, err := local.PackObjects(shas, tmpDir, maxPackSize)
+	if err != nil {
+		return fmt.Errorf("error packing local objects: %v", err)
+	}
+	log.Printf("sending %d objects in %d packs", len(shas), len(names))
+	packErrors := forEach(int(workers), names, func(name string) error {
+		log.Println("sending", name)
+		return uploadPack(remote, tmpDir, name)
+	})
+	// the packs that did arrive are complete, so keep the list up to date
+	// either way
+	if err := remote.UpdatePackList(); err != nil {
+		log.Println("warning: unable to update pack list:", err)
+	}
+	if len(packErrors) > 0 {
+		quotaExhausted := false
+		for name, err := range packErrors {
+			log.Printf("error writing %s: %v", name, err)
+			quotaExhausted = quotaExhausted || errors.Is(err, errors.ErrQuotaExhausted)
+		}
+		if quotaExhausted {
+			return errors.ErrQuotaExhausted
+		}
+		return fmt.Errorf("error writing remote objects")
+	}
+	return nil
+}
+
+// remoteHaves lists the values of the remote refs, which, since objects in
+// remote are also in local, tell us what the remote already has. Refs we
+// don't have locally can't tell us anything.
+func remoteHaves(remote storeManager, local localGit) ([]walkStart, error) {
+	refs, err := remote.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]bool{}
+	var shas []string
+	for _, ref := range refs {
+		if !values[ref.Value] {
+			values[ref.Value] = true
+			shas = append(shas, ref.Value)
+		}
+	}
+	if len(shas) == 0 {
+		return nil, nil
+	}
+	missing, err := local.MissingObjects(shas)
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range missing {
+		values[sha] = false
+	}
+	var haves []walkStart
+	for _, sha := range shas {
+		if !values[sha] {
+			continue
+		}
+		typeName, err := local.GetType(sha)
+		if err != nil {
+			return nil, fmt.Errorf("error reading local objects: %v", err)
+		}
+		objType, err := parseObjectType(typeName)
+		if err != nil {
+			return nil, fmt.Errorf("error reading local objects: %v", err)
+		}
+		haves = append(haves, walkStart{sha, objType})
+	}
+	return haves, nil
+}
+
+// uploadPack copies the pack called name, and its index, from the local
+// directory dir to the remote
+func uploadPack(remote storeManager, dir, name string) error {
+	pack, err := os.Open(path.Join(dir, name+".pack"))
+	if err != nil {
+		return err
+	}
+	defer pack.Close()
+	idx, err := os.Open(path.Join(dir, name+".idx"))
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	return remote.WritePack(name, pack, idx)
+}
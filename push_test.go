@@ -0,0 +1,512 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	errors "github.com/cakemanny/git-remote-drive/errors"
+	store "github.com/cakemanny/git-remote-drive/store"
+)
+
+func TestParsePushCommand(t *testing.T) {
+	cmd, err := parsePushCommand("push refs/heads/master:refs/heads/other")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cmd.src != "refs/heads/master" || cmd.dst != "refs/heads/other" {
+		t.Error("expected: refs/heads/master refs/heads/other, actual:",
+			cmd.src, cmd.dst)
+	}
+
+	cmd, err = parsePushCommand("push +refs/heads/master:refs/heads/master")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !cmd.force || cmd.src != "refs/heads/master" {
+		t.Error("expected forced push of refs/heads/master, actual:", cmd)
+	}
+
+	for _, line := range []string{
+		"push refs/heads/master",
+		"push a:b:c",
+		"fetch refs/heads/master:refs/heads/master",
+	} {
+		if _, err := parsePushCommand(line); err == nil {
+			t.Errorf("%s: expected error", line)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && "+
+		"git checkout -q -b other && echo bye >> test.txt && "+
+		"git commit -q -a -m 'second commit' && git checkout -q master")
+	local := localGit{gitDir: srcDir}
+
+	remoteStore := store.NewMemStore()
+	remote := storeManager{"", remoteStore}
+
+	var out strings.Builder
+	push([]string{
+		"push refs/heads/master:refs/heads/master",
+		"push refs/heads/other:refs/heads/other",
+		"push refs/heads/missing:refs/heads/missing",
+	}, &out, remote, local)
+
+	expected := "ok refs/heads/master\n" +
+		"ok refs/heads/other\n" +
+		"error refs/heads/missing \"ReadRef: reading ref refs/heads/missing: exit status 1\"\n" +
+		"\n"
+	// errors are reported before the refs that succeed
+	if !strings.HasPrefix(out.String(), "error refs/heads/missing ") ||
+		!strings.HasSuffix(out.String(), "ok refs/heads/master\nok refs/heads/other\n\n") {
+		t.Errorf("expected:\n%s\nactual:\n%s", expected, out.String())
+	}
+
+	for _, branch := range []string{"master", "other"} {
+		expectedSha := gitOutput(t, srcDir, "rev-parse", branch)
+		actualSha, err := remote.ReadRef("refs/heads/" + branch)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		}
+		if expectedSha != actualSha {
+			t.Error("expected:", expectedSha, "actual:", actualSha)
+		}
+	}
+
+	// Pushing a commit on top of other should only send the new commit,
+	// since the remote already has the rest through refs/heads/other
+	third := gitOutput(t, srcDir, "commit-tree", "-p", "other", "-m", "third commit", "other^{tree}")
+	gitOutput(t, srcDir, "update-ref", "refs/heads/master", third)
+	before, err := remote.ListPacks()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	out.Reset()
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Errorf("expected: \"ok refs/heads/master\\n\\n\", actual: %q", out.String())
+	}
+	after, err := remote.ListPacks()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatal("expected one new pack, actual:", after)
+	}
+	for _, name := range after {
+		if name == before[0] {
+			continue
+		}
+		var idx strings.Builder
+		if err := remote.ReadPackFile(name, ".idx", &idx); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		shas, err := readPackIndex(strings.NewReader(idx.String()))
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if len(shas) != 1 || shas[0] != third {
+			t.Error("expected just", third, "in new pack, actual:", shas)
+		}
+	}
+
+	// Everything we pushed can be fetched back
+	head := gitOutput(t, srcDir, "rev-parse", "other")
+	dstDir := gitRepo(t, "true")
+	err = fetch([]string{"fetch " + head + " refs/heads/other"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+}
+
+func TestPushSplitsPacks(t *testing.T) {
+	// git won't make packs smaller than 1MiB
+	srcDir := gitRepo(t, "git config drive.maxPackSize 1m && "+
+		"git config drive.uploads 2 && "+
+		"for i in 1 2 3 4; do head -c 600000 /dev/urandom > $i.bin; done && "+
+		"git add . && git commit -q -m 'random data'")
+	local := localGit{gitDir: srcDir}
+	remote := storeManager{"", store.NewMemStore()}
+
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+	packs, err := remote.ListPacks()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(packs) < 2 {
+		t.Error("expected several packs, actual:", packs)
+	}
+	var packList strings.Builder
+	if err := remote.store.Read("objects/info/packs", &packList); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if lines := strings.Count(packList.String(), "\n"); lines != len(packs)+1 {
+		t.Errorf("expected %d packs in list, actual:\n%s", len(packs), packList.String())
+	}
+
+	head := gitOutput(t, srcDir, "rev-parse", "master")
+	dstDir := gitRepo(t, "true")
+	err = fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+}
+
+func TestPushQuotaExhausted(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	// it has run out of requests for creating files, which the Drive client
+	// reports wrapped in what it was doing
+	remoteStore := store.NewMemStore()
+	remoteStore.Inject(store.Fault{
+		Op:  "Create",
+		Err: fmt.Errorf("error creating \"objects/pack\": %w", errors.ErrQuotaExhausted),
+	})
+	remote := storeManager{"", remoteStore}
+
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote,
+		localGit{gitDir: srcDir})
+	expected := "error refs/heads/master \"quota budget exhausted\"\n\n"
+	if out.String() != expected {
+		t.Errorf("expected: %q, actual: %q", expected, out.String())
+	}
+}
+
+func TestPushStaleLock(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	root := t.TempDir()
+	remote := newRemote("drive+file://" + root)
+	// a push that was killed while updating master
+	lockPath := filepath.Join(root, "refs", "heads", "master.lock")
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(lockPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote,
+		localGit{gitDir: srcDir})
+	expected := fmt.Sprintf("error refs/heads/master \"Unable to create '%s': File exists\"\n\n", lockPath)
+	if out.String() != expected {
+		t.Errorf("expected: %q, actual: %q", expected, out.String())
+	}
+}
+
+func TestPushNonFastForward(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && "+
+		"echo bye >> test.txt && git commit -q -a -m 'second commit' && "+
+		"git tag v1")
+	local := localGit{gitDir: srcDir}
+	remote := storeManager{"", store.NewMemStore()}
+
+	var out strings.Builder
+	push([]string{
+		"push refs/heads/master:refs/heads/master",
+		"push refs/tags/v1:refs/tags/v1",
+	}, &out, remote, local)
+	if out.String() != "ok refs/heads/master\nok refs/tags/v1\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+	pushed := gitOutput(t, srcDir, "rev-parse", "master")
+
+	// rewind and make a different commit
+	gitOutput(t, srcDir, "reset", "-q", "--hard", "HEAD^")
+	gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", "divergent commit")
+	gitOutput(t, srcDir, "tag", "-f", "v1")
+	rewritten := gitOutput(t, srcDir, "rev-parse", "master")
+
+	matrix := []struct {
+		refspec, expected, remoteValue string
+	}{
+		{"refs/heads/master:refs/heads/master",
+			"error refs/heads/master \"non-fast-forward\"\n\n", pushed},
+		{"refs/tags/v1:refs/tags/v1",
+			"error refs/tags/v1 \"already exists\"\n\n", pushed},
+		{"+refs/heads/master:refs/heads/master",
+			"ok refs/heads/master\n\n", rewritten},
+		// now the remote has an ancestor of master again
+		{"refs/heads/master:refs/heads/master",
+			"ok refs/heads/master\n\n", rewritten},
+	}
+	for _, v := range matrix {
+		out.Reset()
+		push([]string{"push " + v.refspec}, &out, remote, local)
+		if out.String() != v.expected {
+			t.Errorf("push %s: expected: %q actual: %q", v.refspec, v.expected, out.String())
+		}
+		dst := v.refspec[strings.Index(v.refspec, ":")+1:]
+		if actual, _ := remote.ReadRef(dst); actual != v.remoteValue {
+			t.Errorf("push %s: expected remote: %s actual: %s", v.refspec, v.remoteValue, actual)
+		}
+	}
+
+	// Someone else pushed a commit we don't have
+	remote.WriteRef(Ref{Value: "c5d2d737af4b6203aa37ca2ca13476624d11f4ee", Name: "refs/heads/master"})
+	out.Reset()
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if expected := "error refs/heads/master \"fetch first\"\n\n"; out.String() != expected {
+		t.Errorf("expected: %q actual: %q", expected, out.String())
+	}
+}
+
+// racingStore lets someone else push to master while our objects are being
+// uploaded
+type racingStore struct {
+	*store.MemStore
+	theirs string
+}
+
+func (s racingStore) Create(p string, contents io.Reader) error {
+	if strings.HasPrefix(p, "objects/pack/") {
+		s.MemStore.Update("refs/heads/master", strings.NewReader(s.theirs+"\n"))
+	}
+	return s.MemStore.Create(p, contents)
+}
+
+func TestPushLostRace(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	local := localGit{gitDir: srcDir}
+	remoteStore := store.NewMemStore()
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out,
+		storeManager{"", remoteStore}, local)
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+
+	gitOutput(t, srcDir, "commit", "-q", "--allow-empty", "-m", "second commit")
+	theirs := "c5d2d737af4b6203aa37ca2ca13476624d11f4ee"
+	remote := storeManager{"", racingStore{remoteStore, theirs}}
+	out.Reset()
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	expected := "error refs/heads/master \"fetch first\"\n\n"
+	if out.String() != expected {
+		t.Errorf("expected: %q actual: %q", expected, out.String())
+	}
+	if actual, _ := remote.ReadRef("refs/heads/master"); actual != theirs {
+		t.Errorf("expected their push to be kept, actual: %s", actual)
+	}
+}
+
+func TestConcurrentPushes(t *testing.T) {
+	var srcDirs []string
+	for _, name := range []string{"ours", "theirs"} {
+		srcDirs = append(srcDirs, gitRepo(t, "echo "+name+" > test.txt && "+
+			"git add . && git commit -q -m '"+name+"'"))
+	}
+	remoteStore := store.NewMemStore()
+	// slow enough that both pushes are likely to be updating at once
+	remoteStore.Inject(store.Fault{Op: "Replace", Latency: 50 * time.Millisecond})
+	remote := storeManager{"", remoteStore}
+
+	results := make([]strings.Builder, len(srcDirs))
+	var wg sync.WaitGroup
+	for i, srcDir := range srcDirs {
+		wg.Add(1)
+		go func(i int, srcDir string) {
+			defer wg.Done()
+			push([]string{"push refs/heads/master:refs/heads/master"}, &results[i],
+				remote, localGit{gitDir: srcDir})
+		}(i, srcDir)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i := range results {
+		switch results[i].String() {
+		case "ok refs/heads/master\n\n":
+			winner = i
+		case "error refs/heads/master \"fetch first\"\n\n":
+		default:
+			t.Errorf("unexpected push result: %q", results[i].String())
+		}
+	}
+	if winner == -1 || results[0].String() == results[1].String() {
+		t.Fatalf("expected one push to win, actual: %q %q",
+			results[0].String(), results[1].String())
+	}
+	expected := gitOutput(t, srcDirs[winner], "rev-parse", "master")
+	if actual, _ := remote.ReadRef("refs/heads/master"); actual != expected {
+		t.Errorf("expected the winner's push to be kept, actual: %s", actual)
+	}
+}
+
+func TestPushAfterFailedUpload(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit'")
+	local := localGit{gitDir: srcDir}
+	remoteStore := store.NewMemStore()
+	remoteStore.Inject(store.Fault{
+		Op: "Create", Path: "objects/pack/*.pack", Times: 1,
+		Err: errors.ErrNotImplemented,
+	})
+	remote := storeManager{"", remoteStore}
+
+	var out strings.Builder
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if !strings.HasPrefix(out.String(), "error refs/heads/master ") {
+		t.Fatalf("expected the push to fail, actual: %q", out.String())
+	}
+	if value, _ := remote.ReadRef("refs/heads/master"); value != "" {
+		t.Error("expected the ref not to be written, actual:", value)
+	}
+
+	out.Reset()
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if out.String() != "ok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+	head := gitOutput(t, srcDir, "rev-parse", "master")
+	dstDir := gitRepo(t, "true")
+	err := fetch([]string{"fetch " + head + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", head)
+}
+
+func TestPushDelete(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && git branch feature/x")
+	local := localGit{gitDir: srcDir}
+	remoteStore := store.NewMemStore()
+	remote := storeManager{"", remoteStore}
+
+	var out strings.Builder
+	push([]string{
+		"push refs/heads/master:refs/heads/master",
+		"push refs/heads/feature/x:refs/heads/feature/x",
+	}, &out, remote, local)
+
+	out.Reset()
+	push([]string{
+		"push :refs/heads/feature/x",
+		"push :refs/heads/never-existed",
+	}, &out, remote, local)
+	expected := "error refs/heads/never-existed \"remote ref does not exist\"\n" +
+		"ok refs/heads/feature/x\n\n"
+	if out.String() != expected {
+		t.Errorf("expected: %q actual: %q", expected, out.String())
+	}
+
+	refs, err := remote.ListRefs()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(refs) != 1 || refs[0].Name != "refs/heads/master" {
+		t.Error("expected only refs/heads/master to remain, actual:", refs)
+	}
+	if exists, _ := remoteStore.TestPath("refs/heads/feature"); exists {
+		t.Error("expected empty folder refs/heads/feature to be removed")
+	}
+	if exists, _ := remoteStore.TestPath("refs/heads"); !exists {
+		t.Error("expected refs/heads to be kept")
+	}
+}
+
+func TestPushAnnotatedTags(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && "+
+		"git tag -a -m 'version 1' v1 && "+
+		"git tag -a -m 'tag of a tag' v1-nested v1 && "+
+		"echo bye >> test.txt && git commit -q -a -m 'second commit'")
+	local := localGit{gitDir: srcDir}
+	remote := storeManager{"", store.NewMemStore()}
+
+	var out strings.Builder
+	push([]string{
+		"push refs/tags/v1-nested:refs/tags/v1-nested",
+		"push refs/heads/master:refs/heads/master",
+	}, &out, remote, local)
+	if out.String() != "ok refs/tags/v1-nested\nok refs/heads/master\n\n" {
+		t.Fatalf("unexpected push result: %q", out.String())
+	}
+
+	tag := gitOutput(t, srcDir, "rev-parse", "v1-nested")
+	tagged := gitOutput(t, srcDir, "rev-parse", "v1-nested^{}")
+	master := gitOutput(t, srcDir, "rev-parse", "master")
+
+	out.Reset()
+	listRefs(&out, remote)
+	expected := tag + " refs/tags/v1-nested\n" +
+		tagged + " refs/tags/v1-nested^{}\n" +
+		master + " refs/heads/master\n\n"
+	// order depends on the store listing
+	for _, line := range strings.SplitAfter(expected, "\n") {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected %q in list output: %q", line, out.String())
+		}
+	}
+
+	// fetching master should bring the tags with it
+	options.followtags = true
+	defer func() { options.followtags = false }()
+	dstDir := gitRepo(t, "true")
+	err := fetch([]string{"fetch " + master + " refs/heads/master"}, remote, localGit{gitDir: dstDir})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	gitOutput(t, dstDir, "fsck", "--no-dangling", master, tag)
+}
+
+func TestPushInitialisesHead(t *testing.T) {
+	srcDir := gitRepo(t, "echo hi > test.txt && git add . && "+
+		"git commit -q -m 'initial commit' && git checkout -q -b other")
+	local := localGit{gitDir: srcDir}
+	remote := storeManager{"", store.NewMemStore()}
+
+	var out strings.Builder
+	push([]string{
+		"push refs/heads/master:refs/heads/master",
+		"push refs/heads/other:refs/heads/other",
+	}, &out, remote, local)
+
+	head, err := remote.ReadSymbolicRef("HEAD")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if head != "refs/heads/other" {
+		t.Error("expected: refs/heads/other actual:", head)
+	}
+
+	out.Reset()
+	listRefs(&out, remote)
+	if !strings.HasPrefix(out.String(), "@refs/heads/other HEAD\n") {
+		t.Errorf("expected list to start with HEAD, actual: %q", out.String())
+	}
+
+	out.Reset()
+	push([]string{"push :refs/heads/other"}, &out, remote, local)
+	if !strings.HasPrefix(out.String(), "error refs/heads/other ") {
+		t.Errorf("expected deleting HEAD to fail, actual: %q", out.String())
+	}
+
+	// Later pushes leave HEAD alone
+	gitOutput(t, srcDir, "checkout", "-q", "master")
+	out.Reset()
+	push([]string{"push refs/heads/master:refs/heads/master"}, &out, remote, local)
+	if head, _ := remote.ReadSymbolicRef("HEAD"); head != "refs/heads/other" {
+		t.Error("expected: refs/heads/other actual:", head)
+	}
+}
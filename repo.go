@@ -7,8 +7,10 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"path"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -38,6 +40,16 @@ type Manager interface {
 	// ref.Name relative to the repository root.
 	WriteRef(ref Ref) error
 
+	// DeleteRef removes the reference with the given name
+	DeleteRef(name string) error
+
+	// ReadSymbolicRef reads the name of the ref that a symbolic ref, such as
+	// HEAD, points at, e.g. "refs/heads/master"
+	ReadSymbolicRef(name string) (string, error)
+
+	// WriteSymbolicRef is the complement of ReadSymbolicRef
+	WriteSymbolicRef(name string, target string) error
+
 	// ReadObject reads an object, including decompressing and pretty printing
 	// the output. Think git cat-file
 	ReadObject(sha string, contents io.Writer) error
@@ -50,12 +62,17 @@ type Manager interface {
 	// object directly to the git repository assuming the stream is already
 	// compressed
 	WriteRaw(sha string, contents io.Reader) error
+
+	// HasObject reports whether the object with the given sha1 is present
+	// in the repository
+	HasObject(sha string) (bool, error)
 }
 
-// RefLister is a subinterface of Manager only requiring the ListRefs method to
-// be implemented.
+// RefLister is a subinterface of Manager only requiring the ListRefs and
+// ReadSymbolicRef methods to be implemented.
 type RefLister interface {
 	ListRefs() ([]Ref, error)
+	ReadSymbolicRef(name string) (string, error)
 }
 type RefReader interface {
 	ReadRef(name string) (string, error)
@@ -71,6 +88,9 @@ type Ref struct {
 	Value string
 	// refs/heads/master
 	Name string
+	// For annotated tags, the object the tag ultimately points at. Empty
+	// for everything else or when unknown.
+	Peeled string
 }
 
 // Commit represents a git commit object
@@ -81,6 +101,19 @@ type Commit struct {
 
 	// Parents is a slice of references to the parent commits
 	Parents []string
+
+	// Time is when the commit was committed, in seconds since the epoch
+	Time int64
+}
+
+// Tag represents an annotated tag object
+type Tag struct {
+
+	// Object is the reference to the tagged object
+	Object string
+
+	// Type is the type of the tagged object
+	Type ObjectType
 }
 
 type ObjectType uint
@@ -115,14 +148,16 @@ func (m storeManager) ListRefs() ([]Ref, error) {
 		if options.verbosity >= 1 {
 			log.Printf("reading file \"%s\"", p)
 		}
-		var sha1val strings.Builder
-		if err := m.store.Read(p, &sha1val); err != nil {
+		var contents strings.Builder
+		if err := m.store.Read(p, &contents); err != nil {
 			return fmt.Errorf("error reading \"%s\" in remote store: %v", p, err)
 		}
 		name := strings.TrimPrefix(strings.TrimPrefix(p, m.basePath), "/")
+		value, peeled := parseRefFile(contents.String())
 		results = append(results, Ref{
-			strings.TrimRightFunc(sha1val.String(), unicode.IsSpace),
-			name,
+			Value:  value,
+			Name:   name,
+			Peeled: peeled,
 		})
 		return nil
 	}
@@ -171,6 +206,171 @@ func (m storeManager) objectPath(sha string) (string, error) {
 	return path.Join(m.basePath, "objects", subDir, fileName), nil
 }
 
+func (m storeManager) packDir() string {
+	return path.Join(m.basePath, "objects", "pack")
+}
+
+// ListPacks lists the names of the complete packs in the store, e.g.
+// "pack-579aa09dc6014769ca718bb648dff8cbdbd844e7"
+func (m storeManager) ListPacks() ([]string, error) {
+	list, err := m.store.List(m.packDir())
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing packs: %v", err)
+	}
+	files := map[string]bool{}
+	for _, entry := range list {
+		files[entry.Name] = true
+	}
+	var results []string
+	for _, entry := range list {
+		if name := strings.TrimSuffix(entry.Name, ".idx"); name != entry.Name &&
+			files[name+".pack"] {
+			results = append(results, name)
+		}
+	}
+	return results, nil
+}
+
+// ReadPackFile reads one of the files that make up a pack, e.g.
+//
+//	err := m.ReadPackFile("pack-579aa09dc6014769ca718bb648dff8cbdbd844e7", ".idx", w)
+func (m storeManager) ReadPackFile(name, ext string, contents io.Writer) error {
+	return m.store.Read(path.Join(m.packDir(), name+ext), contents)
+}
+
+// WritePack stores a pack. The index is written last as it's what marks the
+// pack as complete.
+func (m storeManager) WritePack(name string, pack, idx io.Reader) error {
+	if err := m.store.Create(path.Join(m.packDir(), name+".pack"), pack); err != nil {
+		return fmt.Errorf("writing %s.pack: %w", name, err)
+	}
+	if err := m.store.Create(path.Join(m.packDir(), name+".idx"), idx); err != nil {
+		return fmt.Errorf("writing %s.idx: %w", name, err)
+	}
+	return nil
+}
+
+// UpdatePackList brings objects/info/packs up to date with the packs in the
+// store. Packs can be written concurrently, but this should only be done
+// once they have all finished.
+func (m storeManager) UpdatePackList() error {
+	packs, err := m.ListPacks()
+	if err != nil {
+		return err
+	}
+	return m.WritePackList(packs)
+}
+
+// HasLooseObjects reports whether any objects are stored in the store one
+// file per object, as they were before we used packs
+func (m storeManager) HasLooseObjects() (bool, error) {
+	list, err := m.store.List(path.Join(m.basePath, "objects"))
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range list {
+		// objects/c5/...
+		if entry.IsFolder && len(entry.Name) == 2 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListLooseObjects lists the objects stored one file per object
+func (m storeManager) ListLooseObjects() ([]string, error) {
+	objectsDir := path.Join(m.basePath, "objects")
+	list, err := m.store.List(objectsDir)
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %v", err)
+	}
+	var results []string
+	for _, entry := range list {
+		if !entry.IsFolder || len(entry.Name) != 2 {
+			continue
+		}
+		files, err := m.store.List(path.Join(objectsDir, entry.Name))
+		if err != nil {
+			return nil, fmt.Errorf("listing objects/%s: %v", entry.Name, err)
+		}
+		for _, f := range files {
+			if sha := entry.Name + f.Name; !f.IsFolder && len(sha) == 40 {
+				results = append(results, sha)
+			}
+		}
+	}
+	return results, nil
+}
+
+// DeleteLooseObjects removes loose objects from the store, along with any
+// objects/xx folders left empty
+func (m storeManager) DeleteLooseObjects(shas []string) error {
+	dirs := map[string]bool{}
+	for _, sha := range shas {
+		fullPath, err := m.objectPath(sha)
+		if err != nil {
+			return err
+		}
+		if err := m.store.Delete(fullPath); err != nil {
+			return fmt.Errorf("deleting object %s: %v", sha, err)
+		}
+		dirs[path.Dir(fullPath)] = true
+	}
+	for dir := range dirs {
+		list, err := m.store.List(dir)
+		if err != nil {
+			return fmt.Errorf("pruning empty object folder %s: %v", dir, err)
+		}
+		if len(list) > 0 {
+			continue
+		}
+		if err := m.store.Delete(dir); err != nil {
+			return fmt.Errorf("pruning empty object folder %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// DeletePack removes a pack from the store. The index goes first so that
+// the pack stops counting as complete before its contents disappear.
+func (m storeManager) DeletePack(name string) error {
+	if err := m.store.Delete(path.Join(m.packDir(), name+".idx")); err != nil {
+		return fmt.Errorf("deleting %s.idx: %v", name, err)
+	}
+	if err := m.store.Delete(path.Join(m.packDir(), name+".pack")); err != nil {
+		return fmt.Errorf("deleting %s.pack: %v", name, err)
+	}
+	return nil
+}
+
+// WritePackList records the packs in the store in objects/info/packs, in the
+// same format git update-server-info uses:
+//
+//	P pack-579aa09dc6014769ca718bb648dff8cbdbd844e7.pack
+//
+// The listing of objects/pack remains the authority on which packs exist.
+func (m storeManager) WritePackList(packs []string) error {
+	var sb strings.Builder
+	for _, name := range packs {
+		fmt.Fprintf(&sb, "P %s.pack\n", name)
+	}
+	sb.WriteString("\n")
+	listPath := path.Join(m.basePath, "objects", "info", "packs")
+	if err := m.writeFile(listPath, sb.String()); err != nil {
+		return fmt.Errorf("writing pack list: %v", err)
+	}
+	return nil
+}
+
 func (m storeManager) ReadRaw(sha string, contents io.Writer) error {
 	fullPath, err := m.objectPath(sha)
 	if err != nil {
@@ -188,12 +388,14 @@ func sha1Bytes(b []byte) (string, error) {
 	defer zlibReader.Close()
 	// decompress
 	hasher := sha1.New()
-	io.Copy(hasher, zlibReader)
+	if _, err := io.Copy(hasher, zlibReader); err != nil {
+		return "", fmt.Errorf("inflating stream: %v", err)
+	}
 	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 }
 
 // verifyObject checks that an object is present in the store and the sha1
-// of the data matches.
+// of the data matches. If not, the error is an errors.ErrInvalidObject.
 func (m storeManager) verifyObject(sha string) error {
 	log.Println("verifying object", sha)
 	var buf bytes.Buffer
@@ -202,11 +404,13 @@ func (m storeManager) verifyObject(sha string) error {
 	}
 	actualSha, err := sha1Bytes(buf.Bytes())
 	if err != nil {
-		return err
+		log.Printf("invalid object %s: %v", sha, err)
+		return errors.ErrInvalidObject{Sha: sha}
 	}
 	if sha != actualSha {
-		return fmt.Errorf("invalid object %s: sha1 of content is %s, "+
+		log.Printf("invalid object %s: sha1 of content is %s, "+
 			"compressed size is %d bytes", sha, actualSha, len(buf.Bytes()))
+		return errors.ErrInvalidObject{Sha: sha}
 	}
 	return nil
 }
@@ -227,20 +431,30 @@ func (m storeManager) WriteRaw(sha string, contents io.Reader) error {
 		err := m.verifyObject(sha)
 		_, invalid := err.(errors.ErrInvalidObject)
 		if invalid {
-			if deleteErr := m.store.Delete(fullPath); deleteErr != nil {
+			// Replace the bad copy in place, so that there is never a
+			// moment when the object is missing
+			if updateErr := m.store.Update(fullPath, contents); updateErr != nil {
 				return fmt.Errorf(
-					"object %s contains invalid data, but cannot be deleted: %v",
+					"object %s contains invalid data, but cannot be replaced: %v",
 					sha,
-					deleteErr,
+					updateErr,
 				)
 			}
-			return m.store.Create(fullPath, contents)
+			return nil
 		}
 		return err
 	}
 	return m.store.Create(fullPath, contents)
 }
 
+func (m storeManager) HasObject(sha string) (bool, error) {
+	fullPath, err := m.objectPath(sha)
+	if err != nil {
+		return false, err
+	}
+	return m.store.TestPath(fullPath)
+}
+
 func (storeManager) ReadObject(sha string, contents io.Writer) error {
 	return errors.NotImplemented()
 }
@@ -251,29 +465,160 @@ func (m storeManager) ReadRef(name string) (string, error) {
 	if err := m.store.Read(fullPath, &sb); err != nil {
 		return "", err
 	}
-	// the ref file usually ends in a \n so trim that
-	return strings.TrimRight(sb.String(), "\n"), nil
+	value, _ := parseRefFile(sb.String())
+	return value, nil
+}
+
+// parseRefFile reads the contents of a ref file in the remote. Like a line in
+// packed-refs, the sha1 of an annotated tag is followed by its peeled value:
+//
+//	c5d2d737af4b6203aa37ca2ca13476624d11f4ee
+//	^7879dfcfd2db5c052284d7077441e9500672a702
+func parseRefFile(contents string) (value, peeled string) {
+	lines := strings.Split(strings.TrimRightFunc(contents, unicode.IsSpace), "\n")
+	value = strings.TrimRightFunc(lines[0], unicode.IsSpace)
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "^") {
+			peeled = strings.TrimSpace(line[1:])
+		}
+	}
+	return value, peeled
 }
 
 func (m storeManager) WriteRef(ref Ref) error {
+	contents := ref.Value + "\n"
+	if ref.Peeled != "" {
+		contents += "^" + ref.Peeled + "\n"
+	}
+	if err := m.writeFile(path.Join(m.basePath, ref.Name), contents); err != nil {
+		return fmt.Errorf("updating ref %s: %w", ref.Name, err)
+	}
+	return nil
+}
+
+// CompareAndSwapRef writes ref only if its value in the remote is still
+// old, where "" means it must not exist yet. If someone else has changed
+// it, it fails with errors.ErrConflict.
+//
+// The check and the write are one step only when the store is a
+// store.ConditionalStore. Otherwise this narrows the window for a lost
+// update but can't close it.
+func (m storeManager) CompareAndSwapRef(ref Ref, old string) error {
 	fullPath := path.Join(m.basePath, ref.Name)
+	current, version, err := m.readRefVersion(fullPath)
+	if err != nil {
+		return fmt.Errorf("updating ref %s: %w", ref.Name, err)
+	}
+	if current != old {
+		return fmt.Errorf("updating ref %s: %w", ref.Name, errors.ErrConflict)
+	}
+	contents := ref.Value + "\n"
+	if ref.Peeled != "" {
+		contents += "^" + ref.Peeled + "\n"
+	}
+	if conditional, ok := m.store.(store.ConditionalStore); ok {
+		err = conditional.Replace(fullPath, version, strings.NewReader(contents))
+	} else if old == "" {
+		err = m.store.Create(fullPath, strings.NewReader(contents))
+	} else {
+		err = m.store.Update(fullPath, strings.NewReader(contents))
+	}
+	if err != nil {
+		return fmt.Errorf("updating ref %s: %w", ref.Name, err)
+	}
+	return nil
+}
+
+// CompareAndDeleteRef deletes a ref only if its value in the remote is
+// still old. Deleting can't be made conditional in any store, so someone
+// else's update could still be lost, but only if it lands in the moment
+// between our check and the delete.
+func (m storeManager) CompareAndDeleteRef(name string, old string) error {
+	current, _, err := m.readRefVersion(path.Join(m.basePath, name))
+	if err != nil {
+		return fmt.Errorf("deleting ref %s: %w", name, err)
+	}
+	if current != old {
+		return fmt.Errorf("deleting ref %s: %w", name, errors.ErrConflict)
+	}
+	return m.DeleteRef(name)
+}
+
+// readRefVersion reads the value of the ref file at fullPath, along with
+// its version if the store has versions. A missing ref has the value "".
+func (m storeManager) readRefVersion(fullPath string) (string, string, error) {
+	var sb strings.Builder
+	var version string
+	var err error
+	if conditional, ok := m.store.(store.ConditionalStore); ok {
+		version, err = conditional.ReadVersion(fullPath, &sb)
+	} else {
+		err = m.store.Read(fullPath, &sb)
+	}
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	value, _ := parseRefFile(sb.String())
+	return value, version, nil
+}
+
+// writeFile creates or updates a small file in the store
+func (m storeManager) writeFile(fullPath string, contents string) error {
 	exists, err := m.store.TestPath(fullPath)
 	if err != nil {
 		return err
 	}
-	var buf bytes.Buffer
-	buf.WriteString(ref.Value)
-	buf.WriteByte('\n')
 	writeMethod := m.store.Create
 	if exists {
 		writeMethod = m.store.Update
 	}
-	if err = writeMethod(fullPath, &buf); err != nil {
-		return fmt.Errorf("updating ref %s: %v", ref.Name, err)
+	return writeMethod(fullPath, strings.NewReader(contents))
+}
+
+func (m storeManager) DeleteRef(name string) error {
+	fullPath := path.Join(m.basePath, name)
+	if err := m.store.Delete(fullPath); err != nil {
+		return fmt.Errorf("deleting ref %s: %w", name, err)
+	}
+	// Remove any folders left empty, e.g. refs/heads/feature after
+	// deleting refs/heads/feature/x, but leave refs/heads itself
+	refsDir := path.Join(m.basePath, "refs")
+	for dir := path.Dir(fullPath); strings.HasPrefix(path.Dir(dir), refsDir+"/"); dir = path.Dir(dir) {
+		list, err := m.store.List(dir)
+		if err != nil {
+			return fmt.Errorf("pruning empty ref folder %s: %v", dir, err)
+		}
+		if len(list) > 0 {
+			break
+		}
+		if err := m.store.Delete(dir); err != nil {
+			return fmt.Errorf("pruning empty ref folder %s: %v", dir, err)
+		}
 	}
 	return nil
 }
 
+func (m storeManager) ReadSymbolicRef(name string) (string, error) {
+	fullPath := path.Join(m.basePath, name)
+	var sb strings.Builder
+	if err := m.store.Read(fullPath, &sb); err != nil {
+		return "", err
+	}
+	// ref: refs/heads/master
+	contents := strings.TrimRightFunc(sb.String(), unicode.IsSpace)
+	if !strings.HasPrefix(contents, "ref: ") {
+		return "", fmt.Errorf("%s is not a symbolic ref", name)
+	}
+	return strings.TrimPrefix(contents, "ref: "), nil
+}
+
+func (m storeManager) WriteSymbolicRef(name string, target string) error {
+	return m.writeFile(path.Join(m.basePath, name), "ref: "+target+"\n")
+}
+
 func GetCommit(m Manager, ref string) (Commit, error) {
 	if len(ref) != 40 {
 		panic(ref)
@@ -286,6 +631,17 @@ func GetCommit(m Manager, ref string) (Commit, error) {
 	return ReadCommit(rdr)
 }
 
+func GetTag(m Manager, ref string) (Tag, error) {
+	if len(ref) != 40 {
+		panic(ref)
+	}
+	var sb strings.Builder
+	if err := m.ReadObject(ref, &sb); err != nil {
+		return Tag{}, fmt.Errorf("reading object %s: %v", ref, err)
+	}
+	return ReadTag(strings.NewReader(sb.String()))
+}
+
 func GetTree(m Manager, ref string) (Tree, error) {
 	if len(ref) != 40 {
 		panic(ref)
@@ -308,6 +664,10 @@ func ReadCommit(rdr io.Reader) (Commit, error) {
 		line := scanner.Text()
 		fields := strings.Fields(line)
 
+		if strings.HasPrefix(line, " ") {
+			// continuation of a multi-line header, e.g. gpgsig
+			continue
+		}
 		if len(fields) == 0 {
 			// Remainder will just be commit message
 			// consume stream
@@ -316,17 +676,27 @@ func ReadCommit(rdr io.Reader) (Commit, error) {
 			break
 		}
 		if len(fields) == 1 {
-			log.Fatalln("ReadCommit: unexpected number of fields in commit line:", line)
+			return result, fmt.Errorf(
+				"ReadCommit: unexpected number of fields in commit line: %s", line)
 		}
 		switch fields[0] {
 		case "tree":
 			result.Tree = fields[1]
 		case "parent":
 			result.Parents = append(result.Parents, fields[1])
-		case "author":
 		case "committer":
+			// committer C O Mitter <committer@example.com> 1524238149 +0100
+			if len(fields) < 3 {
+				return result, fmt.Errorf("ReadCommit: invalid committer line: %s", line)
+			}
+			t, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+			if err != nil {
+				return result, fmt.Errorf("ReadCommit: invalid committer line: %s", line)
+			}
+			result.Time = t
 		default:
-			log.Fatalln("ReadCommit: unexpected commit field:", fields[0], fields[1])
+			// author, encoding, gpgsig, mergetag...
+			// none of which we need
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -335,6 +705,42 @@ func ReadCommit(rdr io.Reader) (Commit, error) {
 	return result, nil
 }
 
+// ReadTag reads an annotated tag, which like a commit has the same content
+// whether raw or pretty printed
+func ReadTag(rdr io.Reader) (Tag, error) {
+	result := Tag{}
+	scanner := bufio.NewScanner(rdr)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			// Remainder is the tag message and maybe a signature
+			for scanner.Scan() {
+			}
+			break
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "object":
+			result.Object = fields[1]
+		case "type":
+			objType, err := parseObjectType(fields[1])
+			if err != nil {
+				return result, fmt.Errorf("ReadTag: %v", err)
+			}
+			result.Type = objType
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return result, fmt.Errorf("reading tag object: %v", err)
+	}
+	if len(result.Object) != 40 {
+		return result, fmt.Errorf("ReadTag: tag has no object")
+	}
+	return result, nil
+}
+
 func ReadTree(rdr io.Reader) (Tree, error) {
 	result := Tree{}
 	scanner := bufio.NewScanner(rdr)
@@ -343,7 +749,8 @@ func ReadTree(rdr io.Reader) (Tree, error) {
 		line := scanner.Text()
 		fields := strings.Fields(line)
 		if len(fields) < 3 {
-			log.Fatalln("ReadTree: unexpected number of fields in tree line:", line)
+			return nil, fmt.Errorf(
+				"ReadTree: unexpected number of fields in tree line: %s", line)
 		}
 		type Item struct {
 			Type ObjectType
@@ -354,8 +761,11 @@ func ReadTree(rdr io.Reader) (Tree, error) {
 			result = append(result, Item{Type: BLOB, Ref: fields[2]})
 		case "tree":
 			result = append(result, Item{Type: TREE, Ref: fields[2]})
+		case "commit":
+			// a submodule, the commit lives in another repository
+			result = append(result, Item{Type: COMMIT, Ref: fields[2]})
 		default:
-			log.Fatalln("ReadTree: unexpected object type:", fields[1])
+			return nil, fmt.Errorf("ReadTree: unexpected object type: %s", fields[1])
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -363,3 +773,88 @@ func ReadTree(rdr io.Reader) (Tree, error) {
 	}
 	return result, nil
 }
+
+// ReadRawTree reads a tree from its uncompressed raw form, which is a
+// sequence of entries of the form
+//
+//	<mode> <filename>\x00<20 byte sha1>
+func ReadRawTree(content []byte) (Tree, error) {
+	result := Tree{}
+	type Item struct {
+		Type ObjectType
+		Ref  string
+	}
+	for len(content) > 0 {
+		sp := bytes.IndexByte(content, ' ')
+		nul := bytes.IndexByte(content, 0)
+		if sp < 0 || nul < sp || len(content) < nul+21 {
+			return nil, fmt.Errorf("malformed tree entry: %q", content)
+		}
+		mode := string(content[:sp])
+		ref := fmt.Sprintf("%x", content[nul+1:nul+21])
+		content = content[nul+21:]
+		switch mode {
+		case "40000":
+			result = append(result, Item{Type: TREE, Ref: ref})
+		case "160000":
+			result = append(result, Item{Type: COMMIT, Ref: ref})
+		default:
+			result = append(result, Item{Type: BLOB, Ref: ref})
+		}
+	}
+	return result, nil
+}
+
+// parseObjectType converts the type names used in object headers and by
+// git cat-file -t into an ObjectType
+func parseObjectType(name string) (ObjectType, error) {
+	switch name {
+	case "blob":
+		return BLOB, nil
+	case "tree":
+		return TREE, nil
+	case "commit":
+		return COMMIT, nil
+	case "tag":
+		return TAG, nil
+	}
+	return 0, fmt.Errorf("unknown object type: \"%s\"", name)
+}
+
+// decodeObject inflates a raw object, as returned by ReadRaw, checks that
+// its sha1 matches and splits it into its type and content.
+func decodeObject(sha string, raw []byte) (ObjectType, []byte, error) {
+	zlibReader, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return 0, nil, fmt.Errorf("inflating object %s: %v", sha, err)
+	}
+	defer zlibReader.Close()
+	data, err := ioutil.ReadAll(zlibReader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("inflating object %s: %v", sha, err)
+	}
+	if fmt.Sprintf("%x", sha1.Sum(data)) != sha {
+		return 0, nil, errors.ErrInvalidObject{Sha: sha}
+	}
+
+	// <type> <size>\x00<content>
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return 0, nil, fmt.Errorf("object %s has no header", sha)
+	}
+	var typeName string
+	var size int
+	if _, err := fmt.Sscanf(string(data[:nul]), "%s %d", &typeName, &size); err != nil {
+		return 0, nil, fmt.Errorf("reading header of object %s: %v", sha, err)
+	}
+	objType, err := parseObjectType(typeName)
+	if err != nil {
+		return 0, nil, fmt.Errorf("object %s: %v", sha, err)
+	}
+	content := data[nul+1:]
+	if len(content) != size {
+		return 0, nil, fmt.Errorf("object %s: expected %d bytes, found %d",
+			sha, size, len(content))
+	}
+	return objType, content, nil
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"io"
+	"bytes"
 	"strings"
 	"testing"
 
@@ -9,74 +9,23 @@ import (
 	store "github.com/cakemanny/git-remote-drive/store"
 )
 
-// mapStore is rooted at .git
-type mapStore struct {
-	contents map[string]string
-	listings map[string][]store.File
-}
-
-var fakeStore store.SimpleFileStore = mapStore{
-	contents: map[string]string{
-		"refs/heads/master": "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
-	},
-	listings: map[string][]store.File{
-		"":           []store.File{{true, "objects"}, {true, "refs"}},
-		"refs":       []store.File{{true, "heads"}},
-		"refs/heads": []store.File{{false, "master"}},
-		"objects":    []store.File{{true, "c5"}},
-		"objects/c5": []store.File{
-			{false, "d2d737af4b6203aa37ca2ca13476624d11f4ee"},
-		},
-	},
+// memStoreWith creates a MemStore holding files
+func memStoreWith(files map[string]string) *store.MemStore {
+	s := store.NewMemStore()
+	for p, contents := range files {
+		s.Create(p, strings.NewReader(contents))
+	}
+	return s
 }
 
-var basedStore store.SimpleFileStore = mapStore{
-	contents: map[string]string{
-		".git/refs/heads/master": "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
-	},
-	listings: map[string][]store.File{
-		"":                []store.File{{true, ".git"}},
-		".git":            []store.File{{true, "objects"}, {true, "refs"}},
-		".git/refs":       []store.File{{true, "heads"}},
-		".git/refs/heads": []store.File{{false, "master"}},
-		".git/objects":    []store.File{{true, "c5"}},
-		".git/objects/c5": []store.File{
-			{false, "d2d737af4b6203aa37ca2ca13476624d11f4ee"},
-		},
-	},
-}
+// fakeStore is rooted at .git
+var fakeStore store.SimpleFileStore = memStoreWith(map[string]string{
+	"refs/heads/master": "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
+})
 
-func (s mapStore) Read(name string, contents io.Writer) error {
-	m := s.contents
-	v, ok := m[name]
-	if !ok {
-		return errors.ErrNotFound{name}
-	}
-	contents.Write([]byte(v))
-	return nil
-}
-func (s mapStore) List(path string) ([]store.File, error) {
-	m := s.listings
-	v, ok := m[path]
-	if !ok {
-		return nil, errors.ErrNotFound{path}
-	}
-	return v, nil
-}
-func (mapStore) Create(path string, contents io.Reader) error {
-	return errors.NotImplemented()
-}
-func (mapStore) Update(path string, contents io.Reader) error {
-	return errors.NotImplemented()
-}
-func (mapStore) Delete(path string) error {
-	return errors.NotImplemented()
-}
-func (s mapStore) TestPath(path string) (bool, error) {
-	m := s.listings
-	_, ok := m[path]
-	return ok, nil
-}
+var basedStore store.SimpleFileStore = memStoreWith(map[string]string{
+	".git/refs/heads/master": "c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
+})
 
 func TestReadRef(t *testing.T) {
 
@@ -105,6 +54,54 @@ func TestReadRef(t *testing.T) {
 	}
 }
 
+// unversionedStore hides that a store's updates can be made conditional
+type unversionedStore struct {
+	store.SimpleFileStore
+}
+
+func TestCompareAndSwapRef(t *testing.T) {
+	versioned := store.NewMemStore()
+	plain := unversionedStore{store.NewMemStore()}
+	first := "c5d2d737af4b6203aa37ca2ca13476624d11f4ee"
+	second := "7879dfcfd2db5c052284d7077441e9500672a702"
+
+	for _, s := range []store.SimpleFileStore{versioned, plain} {
+		m := storeManager{"", s}
+		master := Ref{Value: first, Name: "refs/heads/master"}
+		if err := m.CompareAndSwapRef(master, ""); err != nil {
+			t.Fatalf("%T: unexpected error: %v", s, err)
+		}
+		// someone else has already created it
+		err := m.CompareAndSwapRef(Ref{Value: second, Name: master.Name}, "")
+		if !errors.Is(err, errors.ErrConflict) {
+			t.Errorf("%T: expected ErrConflict, actual: %v", s, err)
+		}
+		err = m.CompareAndSwapRef(Ref{Value: second, Name: master.Name}, first)
+		if err != nil {
+			t.Errorf("%T: unexpected error: %v", s, err)
+		}
+		// someone else has moved it on
+		if err := m.CompareAndDeleteRef(master.Name, first); !errors.Is(err, errors.ErrConflict) {
+			t.Errorf("%T: expected ErrConflict, actual: %v", s, err)
+		}
+		if value, _ := m.ReadRef(master.Name); value != second {
+			t.Errorf("%T: expected: %s, actual: %s", s, second, value)
+		}
+		if err := m.CompareAndDeleteRef(master.Name, second); err != nil {
+			t.Errorf("%T: unexpected error: %v", s, err)
+		}
+	}
+	replaced := 0
+	for _, call := range versioned.Calls() {
+		if call == "Replace refs/heads/master" {
+			replaced++
+		}
+	}
+	if replaced != 2 {
+		t.Error("expected the versioned store to be updated conditionally")
+	}
+}
+
 func TestReadCommit(t *testing.T) {
 	rdr := strings.NewReader(
 		"tree 07b2986536979a8e6b6028c6a670012b4b4ac262\n" +
@@ -122,6 +119,7 @@ func TestReadCommit(t *testing.T) {
 			"7879dfcfd2db5c052284d7077441e9500672a702",
 			"35a3be730435891d106bd4a7eefba3183ab14d54",
 		},
+		Time: 1524238149,
 	}
 
 	actual, err := ReadCommit(rdr)
@@ -130,7 +128,7 @@ func TestReadCommit(t *testing.T) {
 	}
 
 	// can't directly compare
-	if expected.Tree != actual.Tree ||
+	if expected.Tree != actual.Tree || expected.Time != actual.Time ||
 		len(expected.Parents) != len(actual.Parents) ||
 		expected.Parents[0] != actual.Parents[0] ||
 		expected.Parents[1] != actual.Parents[1] {
@@ -160,4 +158,112 @@ func TestReadTree(t *testing.T) {
 	}
 }
 
+func TestReadRawTree(t *testing.T) {
+	content := append(
+		rawTreeEntry("100644", "README", "7311bd3ca3f61d3731a390d88422977b8d23a016"),
+		rawTreeEntry("40000", "somedir", "562d81834eec9f1701b7ee35ea50767edb2c4e8a")...,
+	)
+	content = append(content,
+		rawTreeEntry("160000", "submodule", "35a3be730435891d106bd4a7eefba3183ab14d54")...,
+	)
+
+	expected := Tree{
+		{Type: BLOB, Ref: "7311bd3ca3f61d3731a390d88422977b8d23a016"},
+		{Type: TREE, Ref: "562d81834eec9f1701b7ee35ea50767edb2c4e8a"},
+		{Type: COMMIT, Ref: "35a3be730435891d106bd4a7eefba3183ab14d54"},
+	}
+
+	actual, err := ReadRawTree(content)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if len(actual) != 3 || expected[0] != actual[0] ||
+		expected[1] != actual[1] || expected[2] != actual[2] {
+		t.Error("expected:", expected, "actual:", actual)
+	}
+}
+
+func TestDecodeObject(t *testing.T) {
+	sha, raw := encodeObject("blob", []byte("hi\n"))
+	if sha != "45b983be36b73c0788dc9cbcb76cbb80fc7bb057" {
+		t.Fatal("unexpected sha1 of blob:", sha)
+	}
+
+	objType, content, err := decodeObject(sha, raw)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if objType != BLOB || string(content) != "hi\n" {
+		t.Error("expected: blob \"hi\\n\"", "actual:", objType, content)
+	}
+
+	_, _, err = decodeObject("c5d2d737af4b6203aa37ca2ca13476624d11f4ee", raw)
+	if _, ok := err.(errors.ErrInvalidObject); !ok {
+		t.Error("expected ErrInvalidObject, actual:", err)
+	}
+}
+
+func TestWriteRawReplacesInvalidObject(t *testing.T) {
+	sha, raw := encodeObject("blob", []byte("hi\n"))
+	objectPath := "objects/" + sha[:2] + "/" + sha[2:]
+	s := store.NewMemStore()
+	s.Create(objectPath, strings.NewReader("not an object"))
+	m := storeManager{"", s}
+
+	if err := m.WriteRaw(sha, bytes.NewReader(raw)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var replaced strings.Builder
+	if s.Read(objectPath, &replaced); replaced.String() != string(raw) {
+		t.Error("expected the invalid object to be replaced")
+	}
+}
+
+func TestReadTag(t *testing.T) {
+	rdr := strings.NewReader(
+		"object 7879dfcfd2db5c052284d7077441e9500672a702\n" +
+			"type commit\n" +
+			"tag v1.0\n" +
+			"tagger cakemanny <goldingd89@gmail.com> 1524238149 +0100\n" +
+			"\n" +
+			"Release 1.0\n",
+	)
+
+	expected := Tag{
+		Object: "7879dfcfd2db5c052284d7077441e9500672a702",
+		Type:   COMMIT,
+	}
+
+	actual, err := ReadTag(rdr)
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if expected != actual {
+		t.Error("expected:", expected, "actual:", actual)
+	}
+}
+
+func TestParseRefFile(t *testing.T) {
+	matrix := []struct {
+		contents, value, peeled string
+	}{
+		{"c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n",
+			"c5d2d737af4b6203aa37ca2ca13476624d11f4ee", ""},
+		{"c5d2d737af4b6203aa37ca2ca13476624d11f4ee",
+			"c5d2d737af4b6203aa37ca2ca13476624d11f4ee", ""},
+		{"c5d2d737af4b6203aa37ca2ca13476624d11f4ee\n" +
+			"^7879dfcfd2db5c052284d7077441e9500672a702\n",
+			"c5d2d737af4b6203aa37ca2ca13476624d11f4ee",
+			"7879dfcfd2db5c052284d7077441e9500672a702"},
+	}
+	for _, v := range matrix {
+		value, peeled := parseRefFile(v.contents)
+		if value != v.value || peeled != v.peeled {
+			t.Errorf("%q: expected: %s %s actual: %s %s",
+				v.contents, v.value, v.peeled, value, peeled)
+		}
+	}
+}
+
 //
@@ -26,6 +26,43 @@ type SimpleFileStore interface {
 	TestPath(path string) (bool, error)
 }
 
+// ConditionalStore is a SimpleFileStore that can update a file on condition
+// that nobody else has changed it since it was read, so that concurrent
+// writers don't silently undo each other's work
+type ConditionalStore interface {
+	SimpleFileStore
+
+	// ReadVersion is Read, also returning the version of what was read
+	ReadVersion(path string, contents io.Writer) (string, error)
+
+	// Replace writes contents to path if the file is still at version, or
+	// if version is "", if it does not exist. Otherwise it fails with
+	// errors.ErrConflict.
+	Replace(path string, version string, contents io.Reader) error
+}
+
+// Duplicate is a path which more than one file or folder has. Some stores,
+// such as Google Drive, allow this.
+type Duplicate struct {
+	Path     string
+	Count    int
+	IsFolder bool
+}
+
+// DuplicateRepairer is a store which can have duplicates, and can get rid
+// of them
+type DuplicateRepairer interface {
+	// FindDuplicates lists the duplicates at or below path
+	FindDuplicates(path string) ([]Duplicate, error)
+
+	// RepairDuplicate merges the folders, or deletes all but one of the
+	// files, at path, keeping the one that reads already use. Copies of a
+	// file are only deleted if they have the same contents as that one.
+	// Otherwise it fails with errors.ErrDivergentDuplicate, unless
+	// keepNewest is set, when the most recently written copy is kept.
+	RepairDuplicate(path string, keepNewest bool) error
+}
+
 // define this to allow us to unit test the recursive ID getter
 type idGetter interface {
 	GetID(name string, parentID string) (string, error)
@@ -1,7 +1,11 @@
 package store
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	builtinerrors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,14 +13,18 @@ import (
 	"net/http"
 	"os"
 	paths "path"
+	"sort"
 	"strings"
+	"sync"
 
 	"context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	drive "google.golang.org/api/drive/v3"
+	googleapi "google.golang.org/api/googleapi"
 
 	"github.com/cakemanny/git-remote-drive/errors"
+	query "github.com/cakemanny/git-remote-drive/store/query"
 )
 
 var (
@@ -31,35 +39,80 @@ var (
 // driveAPIClient is an implementation of a SimpleFileStore using Google Drive.
 type driveAPIClient struct {
 	srv     *Service
-	idCache map[[2]string]string
+	idCache *idCache
+	// uploader, if set, is used for large files
+	uploader *resumableUploader
+	// trash, rather than permanently delete, files
+	trash bool
 }
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
+// prove at compile-time that updates to Drive can be made conditional, and
+// that duplicates can be repaired
+var _ ConditionalStore = driveAPIClient{}
+var _ DuplicateRepairer = driveAPIClient{}
+
+// idCache remembers the file IDs found by GetID, keyed by name and parent
+// ID. It's shared by everything using the client, which may be several
+// goroutines at once.
+type idCache struct {
+	mu  sync.Mutex
+	ids map[[2]string]string
+}
+
+func newIDCache() *idCache {
+	return &idCache{ids: map[[2]string]string{}}
+}
+
+func (c *idCache) get(key [2]string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.ids[key]
+	return id, ok
+}
+
+func (c *idCache) put(key [2]string, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[key] = id
+}
+
+func (c *idCache) remove(key [2]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.ids, key)
+}
+
+// Retrieve a token, saves the token, then returns a token source that
+// refreshes it as need be.
+func getTokenSource(config *oauth2.Config) (oauth2.TokenSource, error) {
 	tok, err := tokenFromFile(tokenPath)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(tokenPath, tok)
+		if tok, err = getTokenFromWeb(config); err != nil {
+			return nil, err
+		}
+		if err := saveToken(tokenPath, tok); err != nil {
+			return nil, err
+		}
 	}
-	return config.Client(context.Background(), tok)
+	return config.TokenSource(context.Background(), tok), nil
 }
 
 // Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
 
 	var authCode string
 	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		return nil, fmt.Errorf("unable to read authorization code: %v", err)
 	}
 
 	tok, err := config.Exchange(oauth2.NoContext, authCode)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
 // Retrieve a token from a local file.
@@ -75,47 +128,170 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 }
 
 // Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
+func saveToken(path string, token *oauth2.Token) error {
 	fmt.Printf("Saving credential file to: %s\n", path)
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	defer f.Close()
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return fmt.Errorf("unable to cache oauth token: %v", err)
 	}
-	json.NewEncoder(f).Encode(token)
+	defer f.Close()
+	return json.NewEncoder(f).Encode(token)
 }
 
-// NewClient runs the outh flow if necessary and builds an authenticated
-// Google Drive client
-func NewClient() SimpleFileStore {
-	b, err := ioutil.ReadFile(secretPath)
-	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+// ClientOption configures the client built by NewClient
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	requestsPerSecond float64
+	burst             int
+	requestBudget     int64
+	trash             bool
+	baseURL           string
+	httpClient        *http.Client
+	tokenSource       oauth2.TokenSource
+	secretPath        string
+}
+
+// WithRateLimit limits the client to perSecond requests a second on
+// average, with bursts of up to burst requests. Zero means no limit.
+func WithRateLimit(perSecond float64, burst int) ClientOption {
+	return func(c *clientConfig) {
+		c.requestsPerSecond, c.burst = perSecond, burst
 	}
+}
 
-	// If modifying these scopes, delete your previously saved token.
-	config, err := google.ConfigFromJSON(b, drive.DriveAppdataScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+// WithRequestBudget limits the total number of requests the client makes.
+// Once they are used up, requests fail with errors.ErrQuotaExhausted.
+// Zero means no limit.
+func WithRequestBudget(requests int64) ClientOption {
+	return func(c *clientConfig) {
+		c.requestBudget = requests
+	}
+}
+
+// WithTrash makes Delete, and the repair of duplicates, move files to the
+// trash, from where they can be restored, instead of deleting them
+// permanently. Files Drive won't trash are deleted permanently anyway.
+func WithTrash(trash bool) ClientOption {
+	return func(c *clientConfig) {
+		c.trash = trash
+	}
+}
+
+// WithBaseURL sends requests to a Drive API other than Google's, such as
+// a stand-in for testing. It is the equivalent of
+// https://www.googleapis.com/drive/v3/
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *clientConfig) {
+		c.baseURL = baseURL
+	}
+}
+
+// WithHTTPClient makes requests using httpClient, for instance one that
+// goes through a proxy. Unless there is also a token source, httpClient
+// must authorise the requests itself.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *clientConfig) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTokenSource authorises requests with tokens from tokenSource instead
+// of running the oauth flow
+func WithTokenSource(tokenSource oauth2.TokenSource) ClientOption {
+	return func(c *clientConfig) {
+		c.tokenSource = tokenSource
+	}
+}
+
+// WithSecretFile reads the client secret for the oauth flow from path,
+// instead of ~/.git-remote-drive.secret
+func WithSecretFile(path string) ClientOption {
+	return func(c *clientConfig) {
+		c.secretPath = path
 	}
+}
 
-	driveService, err := drive.New(getClient(config))
-	srv := &Service{Files: filesServiceWrapper{driveService.Files}}
+// authorisedClient works out which HTTP client to use from the options,
+// running the oauth flow if none of them say how to authorise requests
+func (cfg clientConfig) authorisedClient() (*http.Client, error) {
+	if cfg.httpClient != nil && cfg.tokenSource == nil {
+		return cfg.httpClient, nil
+	}
+	tokenSource := cfg.tokenSource
+	if tokenSource == nil {
+		b, err := ioutil.ReadFile(cfg.secretPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client secret file: %v", err)
+		}
+
+		// If modifying these scopes, delete your previously saved token.
+		config, err := google.ConfigFromJSON(b, drive.DriveAppdataScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+		}
+		if tokenSource, err = getTokenSource(config); err != nil {
+			return nil, err
+		}
+	}
+	var base http.RoundTripper
+	if cfg.httpClient != nil {
+		base = cfg.httpClient.Transport
+	}
+	return &http.Client{Transport: &oauth2.Transport{Source: tokenSource, Base: base}}, nil
+}
+
+// NewClient builds an authenticated Google Drive client, running the oauth
+// flow if necessary
+func NewClient(options ...ClientOption) (SimpleFileStore, error) {
+	cfg := clientConfig{secretPath: secretPath}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	authorised, err := cfg.authorisedClient()
+	if err != nil {
+		return nil, err
+	}
+	// a copy, so as not to change the one we were given
+	httpClient := *authorised
+	if cfg.requestsPerSecond > 0 || cfg.requestBudget > 0 {
+		limiter := newRateLimiter(cfg.requestsPerSecond, cfg.burst, cfg.requestBudget)
+		httpClient.Transport = limitedTransport{httpClient.Transport, limiter}
+	}
+	driveService, err := drive.New(&httpClient)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Drive client: %v", err)
+		return nil, fmt.Errorf("unable to retrieve Drive client: %v", err)
+	}
+	if cfg.baseURL != "" {
+		driveService.BasePath = strings.TrimSuffix(cfg.baseURL, "/") + "/"
+	}
+	srv := &Service{
+		Files: newRetryingFilesService(
+			filesServiceWrapper{driveService.Files}, defaultRetryPolicy),
+		Revisions: retryingRevisionsService{
+			revisionsServiceWrapper{driveService.Revisions}, defaultRetryPolicy},
 	}
-	return driveAPIClient{srv, map[[2]string]string{}}
+	uploader := &resumableUploader{
+		client:    &httpClient,
+		uploadURL: uploadURL(driveService.BasePath),
+		chunkSize: defaultChunkSize,
+		sessions:  defaultSessionStore(),
+		policy:    defaultRetryPolicy,
+	}
+	return driveAPIClient{
+		srv:      srv,
+		idCache:  newIDCache(),
+		uploader: uploader,
+		trash:    cfg.trash,
+	}, nil
 }
 
 // MkDir creates a folder recursively (think mkdir -p) and returns the
 // file id of the created directory.
 func (client driveAPIClient) MkDir(path string) (string, error) {
 	log.Println("MkDir", path)
-	parentPath := paths.Dir(path)
-	parentID, err := GetIDRecursive(client, parentPath)
-	if _, ok := err.(errors.ErrNotFound); ok {
-		parentID, err = client.MkDir(parentPath)
-	}
+	parentID, err := client.makeParent(path)
 	if err != nil {
 		return "", err
 	}
@@ -128,6 +304,20 @@ func (client driveAPIClient) MkDir(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// Someone else may have made the same folder at the same time. Whoever
+	// was second throws theirs away, before putting anything in it.
+	folders, err := client.listNamed(info.Name, parentID, 100, "files(id,createdTime)")
+	if err != nil {
+		return "", err
+	}
+	sortCanonical(folders)
+	if len(folders) > 1 && folders[0].Id != result.Id {
+		log.Printf("%s was created at the same time by someone else", path)
+		if err := client.srv.Files.Delete(result.Id).Do(); err != nil {
+			log.Printf("warning: unable to delete duplicate %s: %v", path, err)
+		}
+		return folders[0].Id, nil
+	}
 	return result.Id, nil
 }
 
@@ -136,7 +326,7 @@ func (client driveAPIClient) MkDir(path string) (string, error) {
 func (client driveAPIClient) GetID(name string, parentID string) (string, error) {
 	log.Println("GetID", name, parentID)
 	key := [2]string{name, parentID}
-	fileID, ok := client.idCache[key]
+	fileID, ok := client.idCache.get(key)
 	if ok {
 		return fileID, nil
 	}
@@ -144,47 +334,105 @@ func (client driveAPIClient) GetID(name string, parentID string) (string, error)
 	if err != nil {
 		return fileID, err
 	}
-	client.idCache[key] = fileID
+	client.idCache.put(key, fileID)
 	return fileID, nil
 }
 
 // getID is the underlying implementation of GetID without the caching
 func (client driveAPIClient) getID(name string, parentID string) (string, error) {
 	log.Println("getID", name, parentID)
-	if parentID == "" {
-		parentID = appDataFolder
+	files, err := client.listNamed(name, parentID, 100, "files(id,mimeType,createdTime)")
+	if err != nil {
+		return "", err
 	}
-	// prove we won't break the query string
-	replacer := strings.NewReplacer("'", "\\'", "\\", "\\\\")
-	if strings.ContainsAny(name, "'\\") {
-		name = replacer.Replace(name)
+	if len(files) == 0 {
+		return "", errors.ErrNotFound{name} // Shouldn't we have whole path?
 	}
-	if strings.ContainsAny(parentID, "'\\") {
-		parentID = replacer.Replace(parentID)
+	if len(files) > 1 {
+		sortCanonical(files)
+		// Merging folders here would race with pushes writing into them,
+		// so it's left to git-remote-drive --admin dedupe
+		log.Printf("warning: more than one \"%s\", using %s; "+
+			"git-remote-drive --admin dedupe can repair this\n", name, files[0].Id)
 	}
+	return files[0].Id, nil
+}
+
+// sortCanonical sorts files with the same name in the same folder so that
+// the one to use comes first. It's the one created first, or, for those
+// created at the same moment, the one with the lowest ID, so that everyone
+// picks the same one.
+func sortCanonical(files []*drive.File) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedTime != files[j].CreatedTime {
+			return files[i].CreatedTime < files[j].CreatedTime
+		}
+		return files[i].Id < files[j].Id
+	})
+}
+
+func isFolder(file *drive.File) bool {
+	return file.MimeType == "application/vnd.google-apps.folder"
+}
+
+var notTrashed = query.Eq(query.Field("trashed"), query.Bool(false))
+
+// listNamed lists up to pageSize of the files called name in the folder
+// with ID parentID
+func (client driveAPIClient) listNamed(name, parentID string, pageSize int64, fields googleapi.Field) ([]*drive.File, error) {
+	if parentID == "" {
+		parentID = appDataFolder
+	}
+	q := query.All(
+		query.Eq(query.Field("name"), query.String(name)),
+		query.In(query.String(parentID), query.Field("parents")),
+		notTrashed,
+	)
 	r, err := client.srv.Files.List().Spaces(appDataFolder).
-		PageSize(2).
-		Q(fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false",
-			name, parentID)).
-		Fields("files(id)").
+		PageSize(pageSize).
+		Q(q.String()).
+		Fields(fields).
 		Do()
 	if err != nil {
-		return "", err
-	}
-	if len(r.Files) == 0 {
-		return "", errors.ErrNotFound{name} // Shouldn't we have whole path?
-	}
-	// Should we error if there are more than one result?
-	if len(r.Files) > 1 {
-		log.Printf("warning: more than one \"%s\"\n", name)
+		return nil, err
 	}
-	return r.Files[0].Id, nil
+	return r.Files, nil
 }
 
 // Create creates a file in the user's Google Drive
 func (client driveAPIClient) Create(path string, contents io.Reader) error {
 	log.Println("Create", path)
-	// 1. Resolve the parent path - create if not exists
+	_, _, err := client.create(path, contents)
+	return err
+}
+
+// create is Create, returning the ID of the new file and of its parent
+func (client driveAPIClient) create(path string, contents io.Reader) (string, string, error) {
+	parentID, err := client.makeParent(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	filename := paths.Base(path)
+	file := drive.File{Name: filename, Parents: []string{parentID}}
+
+	var result *drive.File
+	if content, ok := client.uploader.wants(contents); ok {
+		result, err = client.uploader.upload(&file, content)
+	} else {
+		result, err = client.srv.Files.Create(&file).Fields("id").
+			Media(contents).Do()
+	}
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("Created file %s, ID: %s\n", path, result.Id)
+	return result.Id, parentID, nil
+}
+
+// makeParent finds the ID of the folder that path is in, creating the
+// folder if it doesn't exist
+func (client driveAPIClient) makeParent(path string) (string, error) {
 	parentPath := paths.Dir(path)
 	parentID, err := func() (string, error) {
 		if parentPath == "." || parentPath == "/" {
@@ -195,22 +443,29 @@ func (client driveAPIClient) Create(path string, contents io.Reader) error {
 	if _, ok := err.(errors.ErrNotFound); ok {
 		parentID, err = client.MkDir(parentPath)
 		if err != nil {
-			err = fmt.Errorf("error creating directory %s: %s", parentPath, err)
+			err = fmt.Errorf("error creating directory %s: %w", parentPath, err)
 		}
 	}
+	return parentID, err
+}
+
+// Copy copies the file at src to dst, without the contents leaving Drive
+func (client driveAPIClient) Copy(src string, dst string) error {
+	log.Println("Copy", src, dst)
+	fileID, err := GetIDRecursive(client, src)
 	if err != nil {
 		return err
 	}
-
-	filename := paths.Base(path)
-	file := drive.File{Name: filename, Parents: []string{parentID}}
-
-	result, err := client.srv.Files.Create(&file).Fields("id").
-		Media(contents).Do()
+	parentID, err := client.makeParent(dst)
 	if err != nil {
 		return err
 	}
-	log.Printf("Created file %s, ID: %s\n", path, result.Id)
+	file := drive.File{Name: paths.Base(dst), Parents: []string{parentID}}
+	result, err := client.srv.Files.Copy(fileID, &file).Fields("id").Do()
+	if err != nil {
+		return fmt.Errorf("error copying \"%s\" to \"%s\": %w", src, dst, err)
+	}
+	log.Printf("Copied file %s to %s, ID: %s\n", src, dst, result.Id)
 	return nil
 }
 
@@ -227,11 +482,11 @@ func (client driveAPIClient) Read(path string, contents io.Writer) error {
 	}
 	r, err := client.srv.Files.Get(fileID).Download()
 	if err != nil {
-		return fmt.Errorf("error requesting \"%s\": %v", path, err)
+		return fmt.Errorf("error requesting \"%s\": %w", path, err)
 	}
 	_, err = io.Copy(contents, r.Body)
 	if err != nil {
-		return fmt.Errorf("while reading \"%s\": %v", path, err)
+		return fmt.Errorf("while reading \"%s\": %w", path, err)
 	}
 	// Not sure we care about the close error if we managed to read all
 	// successfully
@@ -247,38 +502,484 @@ func (client driveAPIClient) List(path string) ([]File, error) {
 		}
 		return GetIDRecursive(client, path)
 	}()
-
-	// Would we need to escape folderID ever?
-	r, err := client.srv.Files.List().Spaces(appDataFolder).
-		Q(fmt.Sprintf("'%s' in parents and trashed = false", folderID)).
-		Fields("files(id,name,mimeType)").
-		Do()
 	if err != nil {
 		return nil, err
 	}
 
-	results := make([]File, len(r.Files))
-	for i, f := range r.Files {
-		results[i] = File{
-			IsFolder: (f.MimeType == "application/vnd.google-apps.folder"),
-			Name:     f.Name,
+	files, err := client.listChildren(folderID, "files(id,name,mimeType)")
+	if err != nil {
+		return nil, err
+	}
+	// Duplicates have the same path, so are only listed once
+	seen := map[string]bool{}
+	var results []File
+	for _, f := range files {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			results = append(results, File{IsFolder: isFolder(f), Name: f.Name})
 		}
 	}
 	return results, nil
 }
 
+// listChildren lists everything in a folder, a page at a time
+func (client driveAPIClient) listChildren(folderID string, fields googleapi.Field) ([]*drive.File, error) {
+	var files []*drive.File
+	pageToken := ""
+	for {
+		q := query.All(query.In(query.String(folderID), query.Field("parents")), notTrashed)
+		call := client.srv.Files.List().Spaces(appDataFolder).
+			PageSize(1000).
+			Q(q.String()).
+			Fields("nextPageToken", fields)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, r.Files...)
+		if r.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+// FindDuplicates lists the paths at or below path that more than one file
+// or folder has
+func (client driveAPIClient) FindDuplicates(path string) ([]Duplicate, error) {
+	log.Println("FindDuplicates", path)
+	rootID := appDataFolder
+	if path != "/" && path != "" {
+		var err error
+		if rootID, err = GetIDRecursive(client, path); err != nil {
+			return nil, err
+		}
+	}
+	type folder struct{ path, id string }
+	pending := []folder{{path, rootID}}
+	var duplicates []Duplicate
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		children, err := client.listChildren(dir.id, "files(id,name,mimeType)")
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", dir.path, err)
+		}
+		byName := map[string][]*drive.File{}
+		for _, child := range children {
+			byName[child.Name] = append(byName[child.Name], child)
+			if isFolder(child) {
+				pending = append(pending, folder{paths.Join(dir.path, child.Name), child.Id})
+			}
+		}
+		for name, files := range byName {
+			if len(files) > 1 {
+				duplicates = append(duplicates, Duplicate{
+					Path:     paths.Join(dir.path, name),
+					Count:    len(files),
+					IsFolder: isFolder(files[0]),
+				})
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Path < duplicates[j].Path
+	})
+	return duplicates, nil
+}
+
+// RepairDuplicate leaves only one file or folder at path. Duplicate
+// folders are merged into the one that GetID picks. Of duplicate files,
+// only that one is kept, if the others have the same contents.
+func (client driveAPIClient) RepairDuplicate(path string, keepNewest bool) error {
+	log.Println("RepairDuplicate", path)
+	parentID, err := func() (string, error) {
+		parentPath := paths.Dir(path)
+		if parentPath == "." || parentPath == "/" {
+			return "", nil
+		}
+		return GetIDRecursive(client, parentPath)
+	}()
+	if err != nil {
+		return err
+	}
+	files, err := client.listNamed(paths.Base(path), parentID, 1000, duplicateFields)
+	if err != nil {
+		return err
+	}
+	if len(files) < 2 {
+		return nil
+	}
+	sortCanonical(files)
+	// The one kept may not be the one we found before
+	client.idCache.remove([2]string{paths.Base(path), parentID})
+	if err := client.repairDuplicates(files, keepNewest); err != nil {
+		return fmt.Errorf("repairing %s: %w", path, err)
+	}
+	return nil
+}
+
+// duplicateFields are the fields repairDuplicates needs
+const duplicateFields = "files(id,name,mimeType,createdTime,modifiedTime,md5Checksum,size)"
+
+// repairDuplicates merges, or deletes, all but the first of files, which
+// are sorted by sortCanonical
+func (client driveAPIClient) repairDuplicates(files []*drive.File, keepNewest bool) error {
+	keep := files[0]
+	for _, file := range files[1:] {
+		if isFolder(file) != isFolder(keep) {
+			return fmt.Errorf("both a file and a folder called \"%s\"", keep.Name)
+		}
+	}
+	if !isFolder(keep) {
+		return client.repairDuplicateFiles(files, keepNewest)
+	}
+
+	for _, folder := range files[1:] {
+		children, err := client.listChildren(folder.Id, "files(id,name)")
+		if err != nil {
+			return err
+		}
+		log.Printf("moving %d files from %s to %s", len(children), folder.Id, keep.Id)
+		for _, child := range children {
+			_, err := client.srv.Files.Update(child.Id, &drive.File{}).
+				AddParents(keep.Id).RemoveParents(folder.Id).Fields("id").Do()
+			if err != nil {
+				return err
+			}
+		}
+		// A push may have put something in the folder since it was listed
+		arrived, err := client.listChildren(folder.Id, "files(id)")
+		if err != nil {
+			return err
+		}
+		if len(arrived) > 0 {
+			return fmt.Errorf("files were added to a copy of \"%s\" while merging, "+
+				"so it was left in place; try again", keep.Name)
+		}
+		if err := client.remove(folder.Id); err != nil {
+			return err
+		}
+	}
+	// Now the merged folder may have duplicates of its own
+	children, err := client.listChildren(keep.Id, duplicateFields)
+	if err != nil {
+		return err
+	}
+	byName := map[string][]*drive.File{}
+	for _, child := range children {
+		byName[child.Name] = append(byName[child.Name], child)
+	}
+	for _, same := range byName {
+		if len(same) > 1 {
+			sortCanonical(same)
+			if err := client.repairDuplicates(same, keepNewest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// repairDuplicateFiles deletes all but the first of files, if they have the
+// same contents. Copies of a ref written by racing pushes can differ, and
+// the newer one may hold what someone pushed, so then nothing is deleted
+// unless keepNewest, when it's the most recently modified that's kept.
+func (client driveAPIClient) repairDuplicateFiles(files []*drive.File, keepNewest bool) error {
+	keep := files[0]
+	var differing []string
+	for _, file := range files[1:] {
+		if file.Md5Checksum != keep.Md5Checksum {
+			differing = append(differing, file.Id)
+		}
+	}
+	if len(differing) > 0 {
+		if !keepNewest {
+			var copies []string
+			for _, file := range files {
+				copies = append(copies, client.describeCopy(file))
+			}
+			return fmt.Errorf("\"%s\" has copies %s: %w", keep.Name,
+				strings.Join(copies, ", "), errors.ErrDivergentDuplicate)
+		}
+		for _, file := range files {
+			if file.ModifiedTime > keep.ModifiedTime {
+				keep = file
+			}
+		}
+	}
+	for _, file := range files {
+		if file.Id == keep.Id {
+			continue
+		}
+		if file.Md5Checksum != keep.Md5Checksum {
+			log.Printf("deleting duplicate %s, keeping %s, dropping %s",
+				file.Id, keep.Id, client.describeCopy(file))
+		} else {
+			log.Printf("deleting duplicate %s, keeping %s", file.Id, keep.Id)
+		}
+		if err := client.remove(file.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeCopy says what a copy of a file holds, in full if it's small
+// enough, as refs are
+func (client driveAPIClient) describeCopy(file *drive.File) string {
+	desc := fmt.Sprintf("%s (modified %s)", file.Id, file.ModifiedTime)
+	if file.Size <= 256 {
+		if r, err := client.srv.Files.Get(file.Id).Download(); err == nil {
+			var sb strings.Builder
+			_, err = io.Copy(&sb, r.Body)
+			r.Body.Close()
+			if err == nil {
+				return fmt.Sprintf("%s holding %q", desc, sb.String())
+			}
+		}
+	}
+	return fmt.Sprintf("%s with md5 %s", desc, file.Md5Checksum)
+}
+
+// Delete deletes a file, or a folder and all its contents. Unless the
+// client was made WithTrash, they are deleted permanently.
 func (client driveAPIClient) Delete(path string) error {
 	log.Println("Delete", path)
-	// not sure this is needed -- maybe for refs?
-	// Delete and recreate invalid objects
-	return errors.NotImplemented()
+	if path == "/" || path == "" {
+		return fmt.Errorf("refusing to delete root folder")
+	}
+	parentID, err := func() (string, error) {
+		parentPath := paths.Dir(path)
+		if parentPath == "." || parentPath == "/" {
+			return "", nil
+		}
+		return GetIDRecursive(client, parentPath)
+	}()
+	if err != nil {
+		return err
+	}
+	name := paths.Base(path)
+	fileID, err := client.GetID(name, parentID)
+	if err != nil {
+		return err
+	}
+	if err := client.remove(fileID); err != nil {
+		return fmt.Errorf("error deleting \"%s\": %w", path, err)
+	}
+	client.idCache.remove([2]string{name, parentID})
+	return nil
 }
 
+// remove deletes the file with ID fileID permanently or, if the client was
+// made WithTrash, moves it to the trash. Drive's documentation says that
+// files in the appDataFolder can't be trashed, so if Drive refuses, the
+// file is deleted permanently after all.
+func (client driveAPIClient) remove(fileID string) error {
+	if !client.trash {
+		return client.srv.Files.Delete(fileID).Do()
+	}
+	_, err := client.srv.Files.Update(fileID, &drive.File{Trashed: true}).
+		Fields("id").Do()
+	if trashRefused(err) {
+		log.Printf("warning: unable to trash %s, deleting it permanently: %v", fileID, err)
+		return client.srv.Files.Delete(fileID).Do()
+	}
+	return err
+}
+
+// trashRefused says whether err is Drive refusing to trash a file, rather
+// than a failed or rate limited request
+func trashRefused(err error) bool {
+	var apiErr *googleapi.Error
+	if !builtinerrors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code != http.StatusBadRequest && apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "dailyLimitExceeded":
+			return false
+		}
+	}
+	return true
+}
+
+// Update replaces the contents of an existing file
 func (client driveAPIClient) Update(path string, contents io.Reader) error {
 	log.Println("Update", path)
 	// Only expect this to be used for refs
+	fileID, err := GetIDRecursive(client, path)
+	if err != nil {
+		return err
+	}
+	result, err := client.srv.Files.Update(fileID, &drive.File{}).Fields("id").
+		Media(contents).Do()
+	if err != nil {
+		return fmt.Errorf("error updating \"%s\": %w", path, err)
+	}
+	log.Printf("Updated file %s, ID: %s\n", path, result.Id)
+	return nil
+}
 
-	return errors.NotImplemented()
+// ReadVersion is Read, also returning the ID of the head revision of the
+// file as its version
+func (client driveAPIClient) ReadVersion(path string, contents io.Writer) (string, error) {
+	log.Println("ReadVersion", path)
+	fileID, err := GetIDRecursive(client, path)
+	if err != nil {
+		return "", err
+	}
+	// The version must be read before the contents. Should they change in
+	// between, Replace fails when it needn't, rather than the other way
+	// round.
+	file, err := client.srv.Files.Get(fileID).Fields("headRevisionId").Do()
+	if err != nil {
+		return "", fmt.Errorf("error requesting \"%s\": %w", path, err)
+	}
+	if err := client.Read(path, contents); err != nil {
+		return "", err
+	}
+	return file.HeadRevisionId, nil
+}
+
+// Replace updates a file only if its head revision is still version, or,
+// if version is empty, creates it only if it does not exist yet.
+//
+// Drive can't do this in one step, so we check beforehand, and then
+// afterwards in case someone else got in between. When two updates race,
+// the revision history puts them in order. The revision before the loser's
+// is the winner's rather than the one the loser expected, so the loser
+// deletes its revision and reports a conflict.
+func (client driveAPIClient) Replace(path string, version string, contents io.Reader) error {
+	log.Println("Replace", path, version)
+	if version == "" {
+		return client.createExclusive(path, contents)
+	}
+	fileID, err := GetIDRecursive(client, path)
+	if err != nil {
+		return err
+	}
+	current, err := client.srv.Files.Get(fileID).Fields("headRevisionId").Do()
+	if err != nil {
+		return fmt.Errorf("error requesting \"%s\": %w", path, err)
+	}
+	if current.HeadRevisionId != version {
+		return fmt.Errorf("%s: %w", path, errors.ErrConflict)
+	}
+	result, err := client.updateFrom(fileID, version, contents)
+	if err != nil {
+		return fmt.Errorf("error updating \"%s\": %w", path, err)
+	}
+	if result == nil {
+		log.Printf("%s was updated at the same time by someone else", path)
+		return fmt.Errorf("%s: %w", path, errors.ErrConflict)
+	}
+
+	list, err := client.srv.Revisions.List(fileID).PageSize(1000).
+		Fields("revisions(id)").Do()
+	if err != nil {
+		return fmt.Errorf("error checking update of \"%s\": %w", path, err)
+	}
+	ours := -1
+	for i, revision := range list.Revisions {
+		if revision.Id == result.HeadRevisionId {
+			ours = i
+		}
+	}
+	if ours == -1 {
+		return fmt.Errorf("error checking update of \"%s\": revision %s not found",
+			path, result.HeadRevisionId)
+	}
+	if ours > 0 && list.Revisions[ours-1].Id == version {
+		return nil
+	}
+	log.Printf("%s was updated at the same time by someone else", path)
+	err = client.srv.Revisions.Delete(fileID, result.HeadRevisionId).Do()
+	if err != nil {
+		log.Printf("warning: unable to undo update of %s: %v", path, err)
+	}
+	return fmt.Errorf("%s: %w", path, errors.ErrConflict)
+}
+
+// updateFrom uploads contents as a new revision of the file, which was at
+// version, returning the file's ID and head revision afterwards, or nil if
+// someone else's revision got there instead.
+//
+// The update isn't left to the retry layer. Were the response lost after
+// the update got through, trying it again blindly would put a second
+// revision of ours after the first, rather than after version, and Replace
+// would then take it for a conflict. So it's only tried again while the
+// head is still version. If the head has moved on to our contents, an
+// earlier attempt got through.
+func (client driveAPIClient) updateFrom(fileID, version string, contents io.Reader) (*drive.File, error) {
+	files, policy := client.srv.Files, retryPolicy{maxAttempts: 1}
+	if retrying, ok := files.(retryingFilesService); ok {
+		files, policy = retrying.files, retrying.policy
+	}
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	var result *drive.File
+	err = policy.do(func(n int) error {
+		if n > 0 {
+			current, err := files.Get(fileID).
+				Fields("id,headRevisionId,md5Checksum").Do()
+			if err != nil {
+				return err
+			}
+			if current.HeadRevisionId != version {
+				if current.Md5Checksum == hex.EncodeToString(sum[:]) {
+					result = current
+				}
+				return nil
+			}
+		}
+		var err error
+		result, err = files.Update(fileID, &drive.File{}).
+			Fields("id,headRevisionId").Media(bytes.NewReader(data)).Do()
+		return err
+	})
+	return result, err
+}
+
+// createExclusive creates a file that must not exist yet. If someone else
+// creates it at the same time, the one created first wins, and the other
+// is deleted again.
+func (client driveAPIClient) createExclusive(path string, contents io.Reader) error {
+	exists, err := client.TestPath(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%s: %w", path, errors.ErrConflict)
+	}
+	fileID, parentID, err := client.create(path, contents)
+	if err != nil {
+		return err
+	}
+	name := paths.Base(path)
+	files, err := client.listNamed(name, parentID, 100, "files(id,createdTime)")
+	if err != nil {
+		return fmt.Errorf("error checking creation of \"%s\": %w", path, err)
+	}
+	sortCanonical(files)
+	if len(files) == 0 || files[0].Id == fileID {
+		return nil
+	}
+	log.Printf("%s was created at the same time by someone else", path)
+	if err := client.srv.Files.Delete(fileID).Do(); err != nil {
+		log.Printf("warning: unable to delete duplicate %s: %v", path, err)
+	}
+	client.idCache.put([2]string{name, parentID}, files[0].Id)
+	return fmt.Errorf("%s: %w", path, errors.ErrConflict)
 }
 
 func (client driveAPIClient) TestPath(path string) (bool, error) {
@@ -291,7 +992,7 @@ func (client driveAPIClient) TestPath(path string) (bool, error) {
 		if _, ok := err.(errors.ErrNotFound); ok {
 			return false, nil
 		}
-		return false, fmt.Errorf("error testing path: %v", err)
+		return false, fmt.Errorf("error testing path: %w", err)
 	}
 	return true, nil
 }
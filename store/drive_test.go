@@ -3,10 +3,13 @@ package store
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cakemanny/git-remote-drive/errors"
 	query "github.com/cakemanny/git-remote-drive/store/query"
 	drive "google.golang.org/api/drive/v3"
 	googleapi "google.golang.org/api/googleapi"
@@ -19,112 +22,79 @@ type FakeFile struct {
 	ID        string
 	IsFolder  bool
 	IsTrashed bool
+	Created   string
 }
 
 var fsRoot string = "appDataFolder"
 
 // implement ID as unix path for simplicity
 var fakeFiles = []FakeFile{
-	{"bin", []string{fsRoot}, "/bin", true, false},
-	{"bash", []string{"/bin"}, "/bin/bash", false, false},
-	{"etc", []string{fsRoot}, "/etc", true, false},
-	{"hosts", []string{"/etc"}, "/etc/hosts", false, false},
-	{"home", []string{fsRoot}, "/home", true, false},
-	{"deleteduser", []string{"/home"}, "/home/deleteduser", true, true},
+	{"bin", []string{fsRoot}, "/bin", true, false, ""},
+	{"bash", []string{"/bin"}, "/bin/bash", false, false, ""},
+	{"etc", []string{fsRoot}, "/etc", true, false, ""},
+	{"hosts", []string{"/etc"}, "/etc/hosts", false, false, ""},
+	{"motd", []string{"/etc"}, "/etc/motd-2", false, false, "2019-01-02T00:00:00.000Z"},
+	{"motd", []string{"/etc"}, "/etc/motd", false, false, "2019-01-01T00:00:00.000Z"},
+	{"home", []string{fsRoot}, "/home", true, false, ""},
+	{"deleteduser", []string{"/home"}, "/home/deleteduser", true, true, ""},
+	// made twice at once, the second a moment later
+	{"var", []string{fsRoot}, "/var-2", true, false, "2019-01-01T00:00:00.001Z"},
+	{"var", []string{fsRoot}, "/var", true, false, "2019-01-01T00:00:00.000Z"},
+	{"log", []string{"/var"}, "/var/log", true, false, ""},
+	{"tmp", []string{"/var-2"}, "/var-2/tmp", true, false, ""},
 }
 
-func evalQ(q string, file FakeFile) bool {
-	r := strings.NewReader(q)
-	expr, err := query.NewParser(r).Parse()
-	if err != nil {
-		panic(err)
+// queryFile is what the query evaluator needs to know about f
+func (f FakeFile) queryFile() query.File {
+	mimeType := "application/octet-stream"
+	if f.IsFolder {
+		mimeType = "application/vnd.google-apps.folder"
 	}
-
-	for _, and := range expr.Ands {
-		if evalAnd(and, file) {
-			return true
-		}
+	created, _ := time.Parse(time.RFC3339, f.Created)
+	return query.File{
+		Name:        f.Name,
+		MimeType:    mimeType,
+		Parents:     f.Parents,
+		Trashed:     f.IsTrashed,
+		CreatedTime: created,
 	}
-	return false
 }
-func evalAnd(and query.And, file FakeFile) bool {
-	for _, test := range and.Tests {
-		if !evalTest(test, file) {
-			return false
-		}
-	}
-	return true
-}
-func evalTest(test query.Test, file FakeFile) bool {
-	switch test.Op {
-	case query.EQUALS:
-		d1 := evalDatum(test.Lhs, file)
-		d2 := evalDatum(test.Rhs, file)
-		return d1 == d2
-	case query.IN:
-		d1 := evalDatum(test.Lhs, file)
-		if d1.Type != query.STRING {
-			return false
-		}
-		d2 := evalCollection(test.Rhs, file)
-		for _, value := range d2 {
-			if d1.Lit == value {
-				return true
-			}
-		}
-		return false
-	case query.CONTAINS:
-		// TODO
-	}
-	return false
-}
-func evalDatum(d query.Datum, f FakeFile) query.Datum {
-	switch d.Type {
-	case query.IDENT:
-		if d.Lit == "name" {
-			return query.Datum{query.STRING, f.Name}
-		}
-		if d.Lit == "trashed" {
-			if f.IsTrashed {
-				return query.Datum{query.TRUE, "true"}
-			} else {
-				return query.Datum{query.FALSE, "false"}
-			}
-		}
-		return d
-	case query.STRING:
-		return d
-	case query.TRUE:
-		return d
-	case query.FALSE:
-		return d
-	}
-	panic(fmt.Sprintf("unexpected datum type: %v", d.Type))
-}
-func evalCollection(d query.Datum, f FakeFile) []string {
-	if d.Type == query.IDENT && d.Lit == "parents" {
-		return f.Parents
+
+func evalQ(q string, file FakeFile) bool {
+	matched, err := query.Match(q, file.queryFile())
+	if err != nil {
+		panic(err)
 	}
-	return nil
+	return matched
 }
 
 // want to mock out the drive.FileService in our driveAPIClient.srv
 
-type fakeFilesService struct{}
+// fakeFilesService records the changes it's asked to make in calls, if set
+type fakeFilesService struct {
+	calls *[]string
+}
+
+func (svc fakeFilesService) record(call string) {
+	if svc.calls != nil {
+		*svc.calls = append(*svc.calls, call)
+	}
+}
 
 func (fakeFilesService) List() FilesListCall {
 	return fakeFilesListCall{}
 }
 func (fakeFilesService) Get(fileId string) FilesGetCall {
-	return fakeFilesGetCall{}
+	return fakeFilesGetCall{fileId: fileId}
 }
 
 type fakeFilesListCall struct {
-	spaces   string
-	pageSize int64
-	q        string
-	fields   []string
-	opts     []googleapi.CallOption
+	spaces    string
+	pageSize  int64
+	pageToken string
+	q         string
+	fields    []string
+	opts      []googleapi.CallOption
 }
 
 func (lc fakeFilesListCall) Spaces(spaces string) FilesListCall {
@@ -135,6 +105,10 @@ func (lc fakeFilesListCall) PageSize(pageSize int64) FilesListCall {
 	lc.pageSize = pageSize
 	return &lc
 }
+func (lc fakeFilesListCall) PageToken(pageToken string) FilesListCall {
+	lc.pageToken = pageToken
+	return &lc
+}
 func (lc fakeFilesListCall) Q(q string) FilesListCall {
 	lc.q = q
 	return &lc
@@ -160,11 +134,12 @@ func (lc fakeFilesListCall) Do(opts ...googleapi.CallOption) (*drive.FileList, e
 			}
 
 			results = append(results, &drive.File{
-				Name:     fakeFile.Name,
-				Trashed:  fakeFile.IsTrashed,
-				Parents:  fakeFile.Parents,
-				Id:       fakeFile.ID,
-				MimeType: mimeType,
+				Name:        fakeFile.Name,
+				Trashed:     fakeFile.IsTrashed,
+				Parents:     fakeFile.Parents,
+				Id:          fakeFile.ID,
+				MimeType:    mimeType,
+				CreatedTime: fakeFile.Created,
 			})
 		}
 	}
@@ -176,6 +151,30 @@ func (lc fakeFilesListCall) Do(opts ...googleapi.CallOption) (*drive.FileList, e
 	}, nil
 }
 
+func (svc fakeFilesService) Copy(fileId string, file *drive.File) FilesCopyCall {
+	return fakeFilesCopyCall{svc: svc, fileId: fileId, file: file}
+}
+
+type fakeFilesCopyCall struct {
+	svc    fakeFilesService
+	fileId string
+	file   *drive.File
+}
+
+func (cc fakeFilesCopyCall) Fields(s ...googleapi.Field) FilesCopyCall {
+	return cc
+}
+func (cc fakeFilesCopyCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	for _, fakeFile := range fakeFiles {
+		if fakeFile.ID == cc.fileId {
+			cc.svc.record(fmt.Sprintf("copy %s to %s in %v",
+				cc.fileId, cc.file.Name, cc.file.Parents))
+			return &drive.File{Id: "copy-of-" + cc.fileId, Name: cc.file.Name}, nil
+		}
+	}
+	return nil, &googleapi.Error{Code: 404, Message: "File not found: " + cc.fileId}
+}
+
 func (fakeFilesService) Create(*drive.File) FilesCreateCall {
 	return fakeFilesCreateCall{}
 }
@@ -209,10 +208,131 @@ func (cc fakeFilesCreateCall) Do(opts ...googleapi.CallOption) (*drive.File, err
 	return nil, nil
 }
 
+func (svc fakeFilesService) Update(fileId string, file *drive.File) FilesUpdateCall {
+	return fakeFilesUpdateCall{svc: svc, fileId: fileId, file: file}
+}
+
+type fakeFilesUpdateCall struct {
+	svc           fakeFilesService
+	fileId        string
+	file          *drive.File
+	reader        io.Reader
+	fields        []string
+	addParents    string
+	removeParents string
+}
+
+func (uc fakeFilesUpdateCall) AddParents(addParents string) FilesUpdateCall {
+	uc.addParents = addParents
+	return uc
+}
+func (uc fakeFilesUpdateCall) RemoveParents(removeParents string) FilesUpdateCall {
+	uc.removeParents = removeParents
+	return uc
+}
+
+func (uc fakeFilesUpdateCall) Fields(s ...googleapi.Field) FilesUpdateCall {
+	for _, field := range s {
+		uc.fields = append(uc.fields, string(field))
+	}
+	return uc
+}
+func (uc fakeFilesUpdateCall) Media(r io.Reader, options ...googleapi.MediaOption) FilesUpdateCall {
+	uc.reader = r
+	return uc
+}
+func (uc fakeFilesUpdateCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	for _, fakeFile := range fakeFiles {
+		if fakeFile.ID == uc.fileId {
+			if uc.addParents != "" || uc.removeParents != "" {
+				uc.svc.record(fmt.Sprintf("move %s from %s to %s",
+					uc.fileId, uc.removeParents, uc.addParents))
+			}
+			if uc.file != nil && uc.file.Trashed {
+				uc.svc.record("trash " + uc.fileId)
+			}
+			if uc.reader != nil {
+				content, err := ioutil.ReadAll(uc.reader)
+				if err != nil {
+					return nil, err
+				}
+				uc.svc.record(fmt.Sprintf("update %s: %q", uc.fileId, content))
+			}
+			return &drive.File{Id: fakeFile.ID, Name: fakeFile.Name,
+				HeadRevisionId: "rev-3"}, nil
+		}
+	}
+	return nil, &googleapi.Error{Code: 404, Message: "File not found: " + uc.fileId}
+}
+
+func (svc fakeFilesService) Delete(fileId string) FilesDeleteCall {
+	return fakeFilesDeleteCall{svc: svc, fileId: fileId}
+}
+
+type fakeFilesDeleteCall struct {
+	svc    fakeFilesService
+	fileId string
+}
+
+func (dc fakeFilesDeleteCall) Do(opts ...googleapi.CallOption) error {
+	for _, fakeFile := range fakeFiles {
+		if fakeFile.ID == dc.fileId {
+			dc.svc.record("delete " + dc.fileId)
+			return nil
+		}
+	}
+	return &googleapi.Error{Code: 404, Message: "File not found: " + dc.fileId}
+}
+
+func (fakeFilesService) GenerateIds() FilesGenerateIdsCall {
+	return fakeFilesGenerateIdsCall{count: 10}
+}
+
+type fakeFilesGenerateIdsCall struct {
+	count int64
+	space string
+}
+
+func (gc fakeFilesGenerateIdsCall) Count(count int64) FilesGenerateIdsCall {
+	gc.count = count
+	return gc
+}
+func (gc fakeFilesGenerateIdsCall) Space(space string) FilesGenerateIdsCall {
+	gc.space = space
+	return gc
+}
+func (gc fakeFilesGenerateIdsCall) Do(opts ...googleapi.CallOption) (*drive.GeneratedIds, error) {
+	result := &drive.GeneratedIds{Space: gc.space}
+	for i := int64(0); i < gc.count; i++ {
+		result.Ids = append(result.Ids, fmt.Sprintf("generated-%d", i))
+	}
+	return result, nil
+}
+
 type fakeFilesGetCall struct {
+	fileId      string
+	fields      []string
 	callOptions []googleapi.CallOption
 }
 
+func (gc fakeFilesGetCall) Fields(s ...googleapi.Field) FilesGetCall {
+	for _, field := range s {
+		gc.fields = append(gc.fields, string(field))
+	}
+	return gc
+}
+
+// Do finds every file at its second revision
+func (gc fakeFilesGetCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	for _, fakeFile := range fakeFiles {
+		if fakeFile.ID == gc.fileId {
+			return &drive.File{Id: fakeFile.ID, Name: fakeFile.Name,
+				HeadRevisionId: "rev-2"}, nil
+		}
+	}
+	return nil, &googleapi.Error{Code: 404, Message: "File not found: " + gc.fileId}
+}
+
 func (gc fakeFilesGetCall) Download(opts ...googleapi.CallOption) (*http.Response, error) {
 	for _, opt := range opts {
 		gc.callOptions = append(gc.callOptions, opt)
@@ -220,9 +340,50 @@ func (gc fakeFilesGetCall) Download(opts ...googleapi.CallOption) (*http.Respons
 	return nil, nil
 }
 
+// fakeRevisionsService has the same revision history for every file
+type fakeRevisionsService struct {
+	history []string
+	deleted *[]string
+}
+
+func (rs fakeRevisionsService) List(fileId string) RevisionsListCall {
+	return fakeRevisionsListCall{rs}
+}
+func (rs fakeRevisionsService) Delete(fileId string, revisionId string) RevisionsDeleteCall {
+	return fakeRevisionsDeleteCall{rs, revisionId}
+}
+
+type fakeRevisionsListCall struct {
+	rs fakeRevisionsService
+}
+
+func (lc fakeRevisionsListCall) PageSize(pageSize int64) RevisionsListCall {
+	return lc
+}
+func (lc fakeRevisionsListCall) Fields(s ...googleapi.Field) RevisionsListCall {
+	return lc
+}
+func (lc fakeRevisionsListCall) Do(opts ...googleapi.CallOption) (*drive.RevisionList, error) {
+	result := &drive.RevisionList{}
+	for _, id := range lc.rs.history {
+		result.Revisions = append(result.Revisions, &drive.Revision{Id: id})
+	}
+	return result, nil
+}
+
+type fakeRevisionsDeleteCall struct {
+	rs         fakeRevisionsService
+	revisionId string
+}
+
+func (dc fakeRevisionsDeleteCall) Do(opts ...googleapi.CallOption) error {
+	*dc.rs.deleted = append(*dc.rs.deleted, dc.revisionId)
+	return nil
+}
+
 func TestGetID(t *testing.T) {
-	srv := &Service{fakeFilesService{}}
-	client := driveAPIClient{srv, map[[2]string]string{}}
+	srv := &Service{Files: fakeFilesService{}}
+	client := driveAPIClient{srv: srv, idCache: newIDCache()}
 
 	id, err := client.GetID("bash", "/bin")
 
@@ -233,3 +394,156 @@ func TestGetID(t *testing.T) {
 		t.Error("expected:", "/bin/bash", "actual:", id)
 	}
 }
+
+func TestUpdate(t *testing.T) {
+	var calls []string
+	srv := &Service{Files: fakeFilesService{calls: &calls}}
+	client := driveAPIClient{srv: srv, idCache: newIDCache()}
+
+	err := client.Update("etc/hosts", strings.NewReader("127.0.0.1 localhost\n"))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if expected := `[update /etc/hosts: "127.0.0.1 localhost\n"]`; fmt.Sprint(calls) != expected {
+		t.Errorf("expected: %s, actual: %v", expected, calls)
+	}
+
+	err = client.Update("etc/passwd", strings.NewReader("root:x:0:0::/root:/bin/sh\n"))
+	if _, ok := err.(errors.ErrNotFound); !ok {
+		t.Error("expected ErrNotFound, actual:", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	var calls []string
+	srv := &Service{Files: fakeFilesService{calls: &calls}}
+	client := driveAPIClient{srv: srv, idCache: newIDCache()}
+
+	if _, err := client.GetID("hosts", "/etc"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := client.Delete("etc/hosts"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, ok := client.idCache.get([2]string{"hosts", "/etc"}); ok {
+		t.Error("expected deleted file to be removed from the cache")
+	}
+	if fmt.Sprint(calls) != "[delete /etc/hosts]" {
+		t.Error("expected a permanent delete, actual:", calls)
+	}
+
+	calls = nil
+	client.trash = true
+	if err := client.Delete("bin/bash"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if fmt.Sprint(calls) != "[trash /bin/bash]" {
+		t.Error("expected a move to the trash, actual:", calls)
+	}
+
+	err := client.Delete("etc/passwd")
+	if _, ok := err.(errors.ErrNotFound); !ok {
+		t.Error("expected ErrNotFound, actual:", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	var calls []string
+	srv := &Service{Files: fakeFilesService{calls: &calls}}
+	client := driveAPIClient{srv: srv, idCache: newIDCache()}
+
+	if err := client.Copy("etc/hosts", "bin/hosts"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if expected := "[copy /etc/hosts to hosts in [/bin]]"; fmt.Sprint(calls) != expected {
+		t.Errorf("expected: %s, actual: %v", expected, calls)
+	}
+
+	err := client.Copy("etc/passwd", "bin/passwd")
+	if _, ok := err.(errors.ErrNotFound); !ok {
+		t.Error("expected ErrNotFound, actual:", err)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	var deleted []string
+	revisions := fakeRevisionsService{deleted: &deleted}
+	srv := &Service{Files: fakeFilesService{}, Revisions: &revisions}
+	client := driveAPIClient{srv: srv, idCache: newIDCache()}
+	contents := "127.0.0.1 localhost\n"
+
+	// Someone else has updated it since we read rev-1
+	err := client.Replace("etc/hosts", "rev-1", strings.NewReader(contents))
+	if !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict, actual:", err)
+	}
+
+	// Our update, rev-3, follows straight on from rev-2
+	revisions.history = []string{"rev-1", "rev-2", "rev-3"}
+	err = client.Replace("etc/hosts", "rev-2", strings.NewReader(contents))
+	if err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	// Someone else's update got in between our check and our update
+	revisions.history = []string{"rev-1", "rev-2", "rev-theirs", "rev-3"}
+	err = client.Replace("etc/hosts", "rev-2", strings.NewReader(contents))
+	if !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict, actual:", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "rev-3" {
+		t.Error("expected our revision to be undone, deleted:", deleted)
+	}
+
+	// It already exists
+	err = client.Replace("etc/hosts", "", strings.NewReader(contents))
+	if !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict, actual:", err)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	var calls []string
+	srv := &Service{Files: fakeFilesService{calls: &calls}}
+	client := driveAPIClient{srv: srv, idCache: newIDCache()}
+
+	duplicates, err := client.FindDuplicates("")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expected := []Duplicate{{"etc/motd", 2, false}, {"var", 2, true}}
+	if fmt.Sprint(duplicates) != fmt.Sprint(expected) {
+		t.Errorf("expected: %v, actual: %v", expected, duplicates)
+	}
+	if len(calls) != 0 {
+		t.Error("expected finding duplicates to change nothing, actual:", calls)
+	}
+
+	// Reads use the first created, and change nothing
+	id, err := client.GetID("var", "")
+	if err != nil || id != "/var" {
+		t.Errorf("expected: /var, actual: %s %v", id, err)
+	}
+	if len(calls) != 0 {
+		t.Error("expected reading not to merge folders, actual:", calls)
+	}
+	if id, _ := client.GetID("motd", "/etc"); id != "/etc/motd" {
+		t.Errorf("expected: /etc/motd, actual: %s", id)
+	}
+
+	calls = nil
+	if err := client.RepairDuplicate("etc/motd", false); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if fmt.Sprint(calls) != "[delete /etc/motd-2]" {
+		t.Error("expected the later motd to be deleted, actual:", calls)
+	}
+
+	files, err := client.List("etc")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(files) != 2 {
+		t.Error("expected duplicates to be listed once, actual:", files)
+	}
+}
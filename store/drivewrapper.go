@@ -9,22 +9,28 @@ import (
 )
 
 type Service struct {
-	Files FilesService
+	Files     FilesService
+	Revisions RevisionsService
 }
 
 type FilesService interface {
-	//Copy(string, *drive.File) *drive.FilesCopyCall
+	Copy(string, *drive.File) FilesCopyCall
 	Create(*drive.File) FilesCreateCall
-	//Delete(string) *drive.FilesDeleteCall
+	Delete(string) FilesDeleteCall
 	//EmptyTrash() *drive.FilesEmptyTrashCall
 	//Export(string, string) *drive.FilesExportCall
-	//GenerateIds() *drive.FilesGenerateIdsCall
+	GenerateIds() FilesGenerateIdsCall
 	Get(string) FilesGetCall
 	List() FilesListCall
-	//Update(string, *drive.File) *drive.FilesUpdateCall
+	Update(string, *drive.File) FilesUpdateCall
 	//Watch(string, *drive.Channel) *drive.FilesWatchCall
 }
 
+type FilesCopyCall interface {
+	Do(opts ...googleapi.CallOption) (*drive.File, error)
+	Fields(s ...googleapi.Field) FilesCopyCall
+}
+
 type FilesCreateCall interface {
 	Do(opts ...googleapi.CallOption) (*drive.File, error)
 	Fields(s ...googleapi.Field) FilesCreateCall
@@ -40,26 +46,76 @@ type FilesCreateCall interface {
 	//Header
 }
 
+type FilesUpdateCall interface {
+	AddParents(addParents string) FilesUpdateCall
+	Do(opts ...googleapi.CallOption) (*drive.File, error)
+	Fields(s ...googleapi.Field) FilesUpdateCall
+	Media(r io.Reader, options ...googleapi.MediaOption) FilesUpdateCall
+	RemoveParents(removeParents string) FilesUpdateCall
+}
+
+type FilesDeleteCall interface {
+	Do(opts ...googleapi.CallOption) error
+}
+
+type FilesGenerateIdsCall interface {
+	Count(count int64) FilesGenerateIdsCall
+	Space(space string) FilesGenerateIdsCall
+	Do(opts ...googleapi.CallOption) (*drive.GeneratedIds, error)
+}
+
 type FilesGetCall interface {
+	Fields(s ...googleapi.Field) FilesGetCall
+	Do(opts ...googleapi.CallOption) (*drive.File, error)
 	Download(opts ...googleapi.CallOption) (*http.Response, error)
 }
 
 type FilesListCall interface {
 	Spaces(spaces string) FilesListCall
 	PageSize(pageSize int64) FilesListCall
+	PageToken(pageToken string) FilesListCall
 	Q(q string) FilesListCall
 	Fields(s ...googleapi.Field) FilesListCall
 	Do(opts ...googleapi.CallOption) (*drive.FileList, error)
 }
 
+type RevisionsService interface {
+	Delete(fileId string, revisionId string) RevisionsDeleteCall
+	//Get(string, string) *drive.RevisionsGetCall
+	List(fileId string) RevisionsListCall
+	//Update(string, string, *drive.Revision) *drive.RevisionsUpdateCall
+}
+
+type RevisionsDeleteCall interface {
+	Do(opts ...googleapi.CallOption) error
+}
+
+type RevisionsListCall interface {
+	PageSize(pageSize int64) RevisionsListCall
+	Fields(s ...googleapi.Field) RevisionsListCall
+	Do(opts ...googleapi.CallOption) (*drive.RevisionList, error)
+}
+
 // A wrapper around the google drive api drive.FilesService that implements
 // our interfaces
 type filesServiceWrapper struct {
 	filesServices *drive.FilesService
 }
+type filesCopyWrapper struct {
+	filesCopy *drive.FilesCopyCall
+}
 type filesCreateWrapper struct {
 	filesCreate *drive.FilesCreateCall
 }
+type filesUpdateWrapper struct {
+	filesUpdate *drive.FilesUpdateCall
+}
+type filesDeleteWrapper struct {
+	filesDelete *drive.FilesDeleteCall
+}
+type filesGenerateIdsWrapper struct {
+	filesGenerateIds *drive.FilesGenerateIdsCall
+}
 type filesGetWrapper struct {
 	filesGet *drive.FilesGetCall
 }
@@ -67,9 +123,21 @@ type filesListWrapper struct {
 	filesList *drive.FilesListCall
 }
 
+func (wrapper filesServiceWrapper) Copy(fileId string, file *drive.File) FilesCopyCall {
+	return filesCopyWrapper{wrapper.filesServices.Copy(fileId, file)}
+}
 func (wrapper filesServiceWrapper) Create(file *drive.File) FilesCreateCall {
 	return filesCreateWrapper{wrapper.filesServices.Create(file)}
 }
+func (wrapper filesServiceWrapper) Update(fileId string, file *drive.File) FilesUpdateCall {
+	return filesUpdateWrapper{wrapper.filesServices.Update(fileId, file)}
+}
+func (wrapper filesServiceWrapper) Delete(fileId string) FilesDeleteCall {
+	return filesDeleteWrapper{wrapper.filesServices.Delete(fileId)}
+}
+func (wrapper filesServiceWrapper) GenerateIds() FilesGenerateIdsCall {
+	return filesGenerateIdsWrapper{wrapper.filesServices.GenerateIds()}
+}
 func (wrapper filesServiceWrapper) Get(fileId string) FilesGetCall {
 	return filesGetWrapper{wrapper.filesServices.Get(fileId)}
 }
@@ -77,6 +145,13 @@ func (wrapper filesServiceWrapper) List() FilesListCall {
 	return filesListWrapper{wrapper.filesServices.List()}
 }
 
+func (wrapper filesCopyWrapper) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	return wrapper.filesCopy.Do(opts...)
+}
+func (wrapper filesCopyWrapper) Fields(s ...googleapi.Field) FilesCopyCall {
+	return filesCopyWrapper{wrapper.filesCopy.Fields(s...)}
+}
+
 func (wrapper filesCreateWrapper) Do(opts ...googleapi.CallOption) (*drive.File, error) {
 	return wrapper.filesCreate.Do(opts...)
 }
@@ -87,6 +162,42 @@ func (wrapper filesCreateWrapper) Media(r io.Reader, options ...googleapi.MediaO
 	return filesCreateWrapper{wrapper.filesCreate.Media(r, options...)}
 }
 
+func (wrapper filesUpdateWrapper) AddParents(addParents string) FilesUpdateCall {
+	return filesUpdateWrapper{wrapper.filesUpdate.AddParents(addParents)}
+}
+func (wrapper filesUpdateWrapper) RemoveParents(removeParents string) FilesUpdateCall {
+	return filesUpdateWrapper{wrapper.filesUpdate.RemoveParents(removeParents)}
+}
+func (wrapper filesUpdateWrapper) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	return wrapper.filesUpdate.Do(opts...)
+}
+func (wrapper filesUpdateWrapper) Fields(s ...googleapi.Field) FilesUpdateCall {
+	return filesUpdateWrapper{wrapper.filesUpdate.Fields(s...)}
+}
+func (wrapper filesUpdateWrapper) Media(r io.Reader, options ...googleapi.MediaOption) FilesUpdateCall {
+	return filesUpdateWrapper{wrapper.filesUpdate.Media(r, options...)}
+}
+
+func (wrapper filesDeleteWrapper) Do(opts ...googleapi.CallOption) error {
+	return wrapper.filesDelete.Do(opts...)
+}
+
+func (wrapper filesGenerateIdsWrapper) Count(count int64) FilesGenerateIdsCall {
+	return filesGenerateIdsWrapper{wrapper.filesGenerateIds.Count(count)}
+}
+func (wrapper filesGenerateIdsWrapper) Space(space string) FilesGenerateIdsCall {
+	return filesGenerateIdsWrapper{wrapper.filesGenerateIds.Space(space)}
+}
+func (wrapper filesGenerateIdsWrapper) Do(opts ...googleapi.CallOption) (*drive.GeneratedIds, error) {
+	return wrapper.filesGenerateIds.Do(opts...)
+}
+
+func (wrapper filesGetWrapper) Fields(s ...googleapi.Field) FilesGetCall {
+	return filesGetWrapper{wrapper.filesGet.Fields(s...)}
+}
+func (wrapper filesGetWrapper) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	return wrapper.filesGet.Do(opts...)
+}
 func (wrapper filesGetWrapper) Download(opts ...googleapi.CallOption) (*http.Response, error) {
 	return wrapper.filesGet.Download(opts...)
 }
@@ -96,6 +207,9 @@ func (wrapper filesListWrapper) Spaces(spaces string) FilesListCall {
 func (wrapper filesListWrapper) PageSize(pageSize int64) FilesListCall {
 	return filesListWrapper{wrapper.filesList.PageSize(pageSize)}
 }
+func (wrapper filesListWrapper) PageToken(pageToken string) FilesListCall {
+	return filesListWrapper{wrapper.filesList.PageToken(pageToken)}
+}
 func (wrapper filesListWrapper) Q(q string) FilesListCall {
 	return filesListWrapper{wrapper.filesList.Q(q)}
 }
@@ -105,3 +219,35 @@ func (wrapper filesListWrapper) Fields(s ...googleapi.Field) FilesListCall {
 func (wrapper filesListWrapper) Do(opts ...googleapi.CallOption) (*drive.FileList, error) {
 	return wrapper.filesList.Do(opts...)
 }
+
+// The same for drive.RevisionsService
+type revisionsServiceWrapper struct {
+	revisionsService *drive.RevisionsService
+}
+type revisionsDeleteWrapper struct {
+	revisionsDelete *drive.RevisionsDeleteCall
+}
+type revisionsListWrapper struct {
+	revisionsList *drive.RevisionsListCall
+}
+
+func (wrapper revisionsServiceWrapper) Delete(fileId string, revisionId string) RevisionsDeleteCall {
+	return revisionsDeleteWrapper{wrapper.revisionsService.Delete(fileId, revisionId)}
+}
+func (wrapper revisionsServiceWrapper) List(fileId string) RevisionsListCall {
+	return revisionsListWrapper{wrapper.revisionsService.List(fileId)}
+}
+
+func (wrapper revisionsDeleteWrapper) Do(opts ...googleapi.CallOption) error {
+	return wrapper.revisionsDelete.Do(opts...)
+}
+
+func (wrapper revisionsListWrapper) PageSize(pageSize int64) RevisionsListCall {
+	return revisionsListWrapper{wrapper.revisionsList.PageSize(pageSize)}
+}
+func (wrapper revisionsListWrapper) Fields(s ...googleapi.Field) RevisionsListCall {
+	return revisionsListWrapper{wrapper.revisionsList.Fields(s...)}
+}
+func (wrapper revisionsListWrapper) Do(opts ...googleapi.CallOption) (*drive.RevisionList, error) {
+	return wrapper.revisionsList.Do(opts...)
+}
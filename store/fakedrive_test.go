@@ -0,0 +1,1084 @@
+package store
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+	query "github.com/cakemanny/git-remote-drive/store/query"
+	"golang.org/x/oauth2"
+	drive "google.golang.org/api/drive/v3"
+)
+
+// fakeDrive is a stand-in for the Drive v3 files endpoints, that the real
+// client can talk to over HTTP. It keeps just enough about each file for
+// our queries, along with each revision of its contents.
+//
+// Like Drive, responses only have the fields asked for. requests records
+// what was asked, such as "POST /upload/drive/v3/files multipart".
+type fakeDrive struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	files    map[string]*fakeDriveFile
+	order    []string // file IDs in the order they were created
+	sessions map[string]*fakeUpload
+	nextID   int
+	requests []string
+	// token, if set, must be sent with every request
+	token string
+	// refuseTrash makes moving files to the trash fail, as Drive is said
+	// to for files in the appDataFolder
+	refuseTrash bool
+	// beforeRequest, if set, is called before each request is handled, as
+	// if someone else's request got there first
+	beforeRequest func(r *http.Request)
+	// dropResponse, if set, is asked about each request. Those it picks
+	// are carried out, but the connection is closed instead of replying.
+	dropResponse func(r *http.Request) bool
+}
+
+type fakeDriveFile struct {
+	drive.File
+	revisions []fakeRevision
+}
+
+type fakeRevision struct {
+	id       string
+	contents []byte
+}
+
+// fakeUpload is a resumable upload that's under way
+type fakeUpload struct {
+	file     drive.File
+	fields   string
+	received []byte
+}
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// the default fields of a file, when none are asked for
+const defaultFileFields = "kind,id,name,mimeType"
+
+func newFakeDrive(t *testing.T) *fakeDrive {
+	d := &fakeDrive{
+		files:    map[string]*fakeDriveFile{},
+		sessions: map[string]*fakeUpload{},
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.Close)
+	return d
+}
+
+// newFakeDriveClient builds a driveAPIClient that uses the real Drive
+// client, pointed at d
+func newFakeDriveClient(t *testing.T, d *fakeDrive) driveAPIClient {
+	driveService, err := drive.New(d.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	driveService.BasePath = d.URL + "/drive/v3/"
+	var delays []time.Duration
+	policy := testRetryPolicy(&delays)
+	return driveAPIClient{
+		srv: &Service{
+			Files: newRetryingFilesService(
+				filesServiceWrapper{driveService.Files}, policy),
+			Revisions: retryingRevisionsService{
+				revisionsServiceWrapper{driveService.Revisions}, policy},
+		},
+		idCache: newIDCache(),
+		uploader: &resumableUploader{
+			client:    d.Client(),
+			uploadURL: uploadURL(driveService.BasePath),
+			chunkSize: 1 << 20,
+			sessions:  sessionStore{t.TempDir()},
+			policy:    policy,
+		},
+	}
+}
+
+// add puts a file straight into the fake, as though someone else had
+// made it. contents is ignored for folders.
+func (d *fakeDrive) add(name, parentID string, isFolder bool, contents string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	file := drive.File{Name: name, Parents: []string{parentID}}
+	if isFolder {
+		file.MimeType = folderMimeType
+	}
+	return d.create(file, []byte(contents)).Id
+}
+
+// create adds a file, which must have a new ID if it has one at all
+func (d *fakeDrive) create(file drive.File, contents []byte) *fakeDriveFile {
+	d.nextID++
+	if file.Id == "" {
+		file.Id = fmt.Sprintf("file-%d", d.nextID)
+	}
+	if file.MimeType == "" {
+		file.MimeType = "application/octet-stream"
+	}
+	if len(file.Parents) == 0 {
+		file.Parents = []string{"root"}
+	}
+	file.CreatedTime = d.timestamp()
+	file.ModifiedTime = file.CreatedTime
+	f := &fakeDriveFile{File: file}
+	if file.MimeType != folderMimeType {
+		d.addRevision(f, contents)
+	}
+	d.files[file.Id] = f
+	d.order = append(d.order, file.Id)
+	return f
+}
+
+// timestamp is the time now, in Drive's format. Times are a millisecond
+// apart, so that files sort in the order they were made.
+func (d *fakeDrive) timestamp() string {
+	return time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC).
+		Add(time.Duration(d.nextID) * time.Millisecond).
+		Format("2006-01-02T15:04:05.000Z")
+}
+
+func (d *fakeDrive) addRevision(f *fakeDriveFile, contents []byte) {
+	d.nextID++
+	revision := fakeRevision{id: fmt.Sprintf("rev-%d", d.nextID), contents: contents}
+	f.revisions = append(f.revisions, revision)
+	f.setHead()
+	f.ModifiedTime = d.timestamp()
+}
+
+// setHead makes the file's metadata match its latest revision
+func (f *fakeDriveFile) setHead() {
+	head := f.revisions[len(f.revisions)-1]
+	f.HeadRevisionId = head.id
+	sum := md5.Sum(head.contents)
+	f.Md5Checksum = hex.EncodeToString(sum[:])
+	f.Size = int64(len(head.contents))
+}
+
+func (d *fakeDrive) serve(w http.ResponseWriter, r *http.Request) {
+	if d.beforeRequest != nil {
+		d.beforeRequest(r)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dropResponse != nil && d.dropResponse(r) {
+		defer hangUp(w)
+		w = httptest.NewRecorder()
+	}
+	kind := r.URL.Query().Get("uploadType")
+	if r.URL.Query().Get("alt") == "media" {
+		kind = "media"
+	}
+	d.requests = append(d.requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+kind))
+	if d.token != "" && r.Header.Get("Authorization") != "Bearer "+d.token {
+		driveError(w, http.StatusUnauthorized, "authError", "Invalid Credentials")
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/upload/drive/v3/files"):
+		d.serveUpload(w, r, strings.TrimPrefix(path, "/upload/drive/v3/files"))
+	case strings.HasPrefix(path, "/drive/v3/files"):
+		d.serveFiles(w, r, strings.TrimPrefix(path, "/drive/v3/files"))
+	default:
+		driveError(w, http.StatusNotFound, "notFound", "no such endpoint "+path)
+	}
+}
+
+// hangUp closes the connection a request came in on, without replying
+func hangUp(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+// serveFiles handles the metadata endpoints, and downloads. rest is what
+// follows /drive/v3/files in the path.
+func (d *fakeDrive) serveFiles(w http.ResponseWriter, r *http.Request, rest string) {
+	fields := r.URL.Query().Get("fields")
+	parts := strings.Split(strings.TrimPrefix(rest, "/"), "/")
+	switch {
+	case rest == "" && r.Method == "GET":
+		d.list(w, r)
+	case rest == "" && r.Method == "POST":
+		var file drive.File
+		if !decodeJSON(w, r.Body, &file) {
+			return
+		}
+		if _, exists := d.files[file.Id]; exists {
+			driveError(w, http.StatusConflict, "duplicate", "file ID in use")
+			return
+		}
+		reply(w, d.create(file, nil).File, fields, defaultFileFields)
+	case rest == "/generateIds" && r.Method == "GET":
+		count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+		ids := drive.GeneratedIds{Kind: "drive#generatedIds"}
+		for i := 0; i < count; i++ {
+			d.nextID++
+			ids.Ids = append(ids.Ids, fmt.Sprintf("generated-%d", d.nextID))
+		}
+		reply(w, ids, fields, "")
+	default:
+		f, ok := d.files[parts[0]]
+		if !ok {
+			driveError(w, http.StatusNotFound, "notFound", "File not found: "+parts[0]+".")
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == "GET":
+			if r.URL.Query().Get("alt") == "media" {
+				if len(f.revisions) == 0 {
+					driveError(w, http.StatusForbidden, "fileNotDownloadable",
+						"Only files with binary content can be downloaded.")
+					return
+				}
+				w.Write(f.revisions[len(f.revisions)-1].contents)
+				return
+			}
+			reply(w, f.File, fields, defaultFileFields)
+		case len(parts) == 1 && r.Method == "PATCH":
+			var changes drive.File
+			if !decodeJSON(w, r.Body, &changes) {
+				return
+			}
+			if changes.Trashed && d.refuseTrash {
+				driveError(w, http.StatusForbidden, "forbidden",
+					"The file can not be moved to the trash.")
+				return
+			}
+			d.update(f, changes, r, nil)
+			reply(w, f.File, fields, defaultFileFields)
+		case len(parts) == 1 && r.Method == "DELETE":
+			d.remove(f.Id)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "copy" && r.Method == "POST":
+			var file drive.File
+			if !decodeJSON(w, r.Body, &file) {
+				return
+			}
+			if _, exists := d.files[file.Id]; exists {
+				driveError(w, http.StatusConflict, "duplicate", "file ID in use")
+				return
+			}
+			file.MimeType = f.MimeType
+			contents := f.revisions[len(f.revisions)-1].contents
+			reply(w, d.create(file, contents).File, fields, defaultFileFields)
+		case len(parts) == 2 && parts[1] == "revisions" && r.Method == "GET":
+			list := drive.RevisionList{Kind: "drive#revisionList"}
+			for _, revision := range f.revisions {
+				list.Revisions = append(list.Revisions, &drive.Revision{Id: revision.id})
+			}
+			reply(w, list, fields, "kind,revisions(id)")
+		case len(parts) == 3 && parts[1] == "revisions" && r.Method == "DELETE":
+			d.deleteRevision(w, f, parts[2])
+		default:
+			driveError(w, http.StatusNotFound, "notFound", "no such endpoint "+r.URL.Path)
+		}
+	}
+}
+
+// serveUpload handles creating and updating files with contents
+func (d *fakeDrive) serveUpload(w http.ResponseWriter, r *http.Request, rest string) {
+	params := r.URL.Query()
+	if sessionID := params.Get("upload_id"); sessionID != "" && r.Method == "PUT" {
+		d.resume(w, r, sessionID)
+		return
+	}
+	fileID := strings.TrimPrefix(rest, "/")
+	existing, exists := d.files[fileID]
+	if fileID != "" && !exists {
+		driveError(w, http.StatusNotFound, "notFound", "File not found: "+fileID+".")
+		return
+	}
+
+	switch params.Get("uploadType") {
+	case "multipart":
+		var file drive.File
+		contents, ok := readMultipart(w, r, &file)
+		if !ok {
+			return
+		}
+		if exists {
+			d.update(existing, file, r, contents)
+			reply(w, existing.File, params.Get("fields"), defaultFileFields)
+			return
+		}
+		if _, taken := d.files[file.Id]; taken {
+			driveError(w, http.StatusConflict, "duplicate", "file ID in use")
+			return
+		}
+		reply(w, d.create(file, contents).File, params.Get("fields"), defaultFileFields)
+	case "resumable":
+		if exists {
+			driveError(w, http.StatusBadRequest, "badRequest",
+				"resumable updates aren't faked")
+			return
+		}
+		upload := &fakeUpload{fields: params.Get("fields")}
+		if !decodeJSON(w, r.Body, &upload.file) {
+			return
+		}
+		d.nextID++
+		sessionID := fmt.Sprintf("session-%d", d.nextID)
+		d.sessions[sessionID] = upload
+		w.Header().Set("Location",
+			d.URL+"/upload/drive/v3/files?uploadType=resumable&upload_id="+sessionID)
+	default:
+		driveError(w, http.StatusBadRequest, "badRequest",
+			"unexpected uploadType "+params.Get("uploadType"))
+	}
+}
+
+// resume takes the next chunk of a resumable upload, or says how much has
+// arrived
+func (d *fakeDrive) resume(w http.ResponseWriter, r *http.Request, sessionID string) {
+	upload, ok := d.sessions[sessionID]
+	if !ok {
+		driveError(w, http.StatusNotFound, "notFound", "no such upload session")
+		return
+	}
+	var start, end, size int64
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes */%d", &size); err == nil {
+		// a status query
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		if start != int64(len(upload.received)) {
+			driveError(w, http.StatusBadRequest, "badRequest", "chunk out of order")
+			return
+		}
+		chunk, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(chunk)) != end-start+1 {
+			driveError(w, http.StatusBadRequest, "badRequest", "bad chunk")
+			return
+		}
+		upload.received = append(upload.received, chunk...)
+	} else {
+		driveError(w, http.StatusBadRequest, "badRequest", "bad Content-Range")
+		return
+	}
+
+	if int64(len(upload.received)) == size {
+		delete(d.sessions, sessionID)
+		reply(w, d.create(upload.file, upload.received).File, upload.fields, defaultFileFields)
+		return
+	}
+	if len(upload.received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.received)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// update applies changes to the metadata, and any new contents
+func (d *fakeDrive) update(f *fakeDriveFile, changes drive.File, r *http.Request, contents []byte) {
+	if changes.Name != "" {
+		f.Name = changes.Name
+	}
+	if changes.Trashed {
+		f.Trashed = true
+	}
+	params := r.URL.Query()
+	if remove := params.Get("removeParents"); remove != "" {
+		var parents []string
+		for _, parent := range f.Parents {
+			if !strings.Contains(","+remove+",", ","+parent+",") {
+				parents = append(parents, parent)
+			}
+		}
+		f.Parents = parents
+	}
+	if add := params.Get("addParents"); add != "" {
+		f.Parents = append(f.Parents, strings.Split(add, ",")...)
+	}
+	if contents != nil {
+		d.addRevision(f, contents)
+	}
+}
+
+// remove deletes a file, and if it's a folder, everything in it
+func (d *fakeDrive) remove(id string) {
+	delete(d.files, id)
+	for _, f := range d.files {
+		for _, parent := range f.Parents {
+			if parent == id {
+				d.remove(f.Id)
+				break
+			}
+		}
+	}
+}
+
+func (d *fakeDrive) deleteRevision(w http.ResponseWriter, f *fakeDriveFile, revisionID string) {
+	for i, revision := range f.revisions {
+		if revision.id != revisionID {
+			continue
+		}
+		if len(f.revisions) == 1 {
+			driveError(w, http.StatusBadRequest, "cannotDeleteOnlyRevision",
+				"A file must have at least one revision.")
+			return
+		}
+		f.revisions = append(f.revisions[:i], f.revisions[i+1:]...)
+		f.setHead()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	driveError(w, http.StatusNotFound, "notFound", "Revision not found: "+revisionID+".")
+}
+
+// list evaluates the q parameter against every file, and returns a page
+// of the ones that match
+func (d *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var expr *query.Expr
+	if q := params.Get("q"); q != "" {
+		var err error
+		if expr, err = query.NewParser(strings.NewReader(q)).Parse(); err != nil {
+			driveError(w, http.StatusBadRequest, "invalid", "Invalid Value: "+err.Error())
+			return
+		}
+	}
+	var matches []*drive.File
+	for _, id := range d.order {
+		f, ok := d.files[id]
+		if !ok {
+			continue
+		}
+		matched := true
+		if expr != nil {
+			var err error
+			if matched, err = query.Eval(*expr, asQueryFile(f)); err != nil {
+				driveError(w, http.StatusBadRequest, "invalid", err.Error())
+				return
+			}
+		}
+		if matched {
+			file := f.File
+			matches = append(matches, &file)
+		}
+	}
+
+	pageSize, _ := strconv.Atoi(params.Get("pageSize"))
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+	start, _ := strconv.Atoi(params.Get("pageToken"))
+	if start > len(matches) {
+		start = len(matches)
+	}
+	list := drive.FileList{Kind: "drive#fileList"}
+	if end := start + pageSize; end < len(matches) {
+		list.Files = matches[start:end]
+		list.NextPageToken = strconv.Itoa(end)
+	} else {
+		list.Files = matches[start:]
+	}
+	reply(w, list, params.Get("fields"), "kind,nextPageToken,files("+defaultFileFields+")")
+}
+
+// asQueryFile is what the query evaluator needs to know about f
+func asQueryFile(f *fakeDriveFile) query.File {
+	created, _ := time.Parse(time.RFC3339, f.CreatedTime)
+	modified, _ := time.Parse(time.RFC3339, f.ModifiedTime)
+	return query.File{
+		Name:          f.Name,
+		MimeType:      f.MimeType,
+		Parents:       f.Parents,
+		Trashed:       f.Trashed,
+		Starred:       f.Starred,
+		CreatedTime:   created,
+		ModifiedTime:  modified,
+		Properties:    f.Properties,
+		AppProperties: f.AppProperties,
+	}
+}
+
+// readMultipart reads a multipart/related upload, decoding the metadata
+// into file and returning the media
+func readMultipart(w http.ResponseWriter, r *http.Request, file *drive.File) ([]byte, bool) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		driveError(w, http.StatusBadRequest, "badContent", "expected multipart/related")
+		return nil, false
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	metadata, err := parts.NextPart()
+	if err != nil || !decodeJSON(w, metadata, file) {
+		if err != nil {
+			driveError(w, http.StatusBadRequest, "badContent", err.Error())
+		}
+		return nil, false
+	}
+	media, err := parts.NextPart()
+	if err != nil {
+		driveError(w, http.StatusBadRequest, "badContent", "no media: "+err.Error())
+		return nil, false
+	}
+	contents, err := ioutil.ReadAll(media)
+	if err != nil {
+		driveError(w, http.StatusBadRequest, "badContent", err.Error())
+		return nil, false
+	}
+	return contents, true
+}
+
+func decodeJSON(w http.ResponseWriter, r io.Reader, v interface{}) bool {
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		driveError(w, http.StatusBadRequest, "parseError", err.Error())
+		return false
+	}
+	return true
+}
+
+// driveError replies with an error that googleapi.CheckResponse decodes
+// in the same way as one from Drive
+func driveError(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": message},
+			},
+		},
+	})
+}
+
+// reply sends the fields of v that were asked for, or the defaults if
+// none were
+func reply(w http.ResponseWriter, v interface{}, fields, defaults string) {
+	if fields == "" {
+		fields = defaults
+	}
+	var all map[string]interface{}
+	b, _ := json.Marshal(v)
+	json.Unmarshal(b, &all)
+	if fields != "" && fields != "*" {
+		all = selectFields(all, fields)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(all)
+}
+
+// selectFields picks fields out of a decoded JSON object. fields is in
+// the form "nextPageToken,files(id,name)".
+func selectFields(object map[string]interface{}, fields string) map[string]interface{} {
+	selected := map[string]interface{}{}
+	for _, field := range splitFields(fields) {
+		name, sub := field, ""
+		if i := strings.Index(field, "("); i >= 0 && strings.HasSuffix(field, ")") {
+			name, sub = field[:i], field[i+1:len(field)-1]
+		}
+		value, ok := object[name]
+		if !ok {
+			continue
+		}
+		if sub != "" {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				value = selectFields(v, sub)
+			case []interface{}:
+				var items []interface{}
+				for _, item := range v {
+					if o, ok := item.(map[string]interface{}); ok {
+						items = append(items, selectFields(o, sub))
+					}
+				}
+				value = items
+			}
+		}
+		selected[name] = value
+	}
+	return selected
+}
+
+// splitFields splits fields at the commas that aren't in brackets
+func splitFields(fields string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i, ch := range fields {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				result = append(result, strings.TrimSpace(fields[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(result, strings.TrimSpace(fields[start:]))
+}
+
+func TestSelectFields(t *testing.T) {
+	object := map[string]interface{}{
+		"kind":          "drive#fileList",
+		"nextPageToken": "2",
+		"files": []interface{}{
+			map[string]interface{}{"id": "a", "name": "x", "mimeType": "text/plain"},
+		},
+	}
+	selected := selectFields(object, "nextPageToken, files(id,name)")
+	b, _ := json.Marshal(selected)
+	expected := `{"files":[{"id":"a","name":"x"}],"nextPageToken":"2"}`
+	if string(b) != expected {
+		t.Errorf("expected: %s, actual: %s", expected, b)
+	}
+}
+
+func TestDriveOverHTTP(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+
+	if err := client.Create("repo.git/refs/heads/master", strings.NewReader("abc\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := client.Update("repo.git/refs/heads/master", strings.NewReader("def\n")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	var sb strings.Builder
+	if err := client.Read("repo.git/refs/heads/master", &sb); err != nil || sb.String() != "def\n" {
+		t.Errorf("expected: \"def\\n\", actual: %q %v", sb.String(), err)
+	}
+	if err := client.Copy("repo.git/refs/heads/master", "repo.git/refs/heads/other"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	files, err := client.List("repo.git/refs/heads")
+	if err != nil || fmt.Sprint(files) != "[{false master} {false other}]" {
+		t.Errorf("expected: [{false master} {false other}], actual: %v %v", files, err)
+	}
+	if err := client.Delete("repo.git/refs/heads/other"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if exists, err := client.TestPath("repo.git/refs/heads/other"); exists || err != nil {
+		t.Error("expected other to be deleted, actual:", exists, err)
+	}
+
+	// Everything made one folder at a time, and the contents sent along
+	// with the metadata
+	expected := []string{
+		"GET /drive/v3/files/generateIds",
+		"POST /drive/v3/files",
+		"POST /drive/v3/files",
+		"POST /drive/v3/files",
+		"POST /upload/drive/v3/files multipart",
+		"PATCH /upload/drive/v3/files/generated-4 multipart",
+		"GET /drive/v3/files/generated-4 media",
+		"POST /drive/v3/files/generated-4/copy",
+		"DELETE /drive/v3/files/generated-5",
+	}
+	d.mu.Lock()
+	var actual []string
+	for _, request := range d.requests {
+		// leaving out the listings used to find each file
+		if request != "GET /drive/v3/files" {
+			actual = append(actual, request)
+		}
+	}
+	d.mu.Unlock()
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("expected: %v\nactual: %v", expected, actual)
+	}
+}
+
+func TestDriveOverHTTPResumable(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+
+	content := randomContent(resumableThreshold + 100)
+	if err := client.Create("objects/pack/pack-1.pack", content); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var sb strings.Builder
+	if err := client.Read("objects/pack/pack-1.pack", &sb); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if sb.String() != string(readAllSection(t, content)) {
+		t.Error("downloaded content differs")
+	}
+	puts := 0
+	d.mu.Lock()
+	for _, request := range d.requests {
+		if strings.HasPrefix(request, "PUT /upload/drive/v3/files") {
+			puts++
+		}
+	}
+	d.mu.Unlock()
+	if puts != 9 {
+		t.Errorf("expected the upload to be sent in 9 chunks, actual: %d", puts)
+	}
+}
+
+func TestDriveOverHTTPReplace(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+	path := "refs/heads/master"
+
+	if err := client.Replace(path, "", strings.NewReader("abc\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	version, err := client.ReadVersion(path, ioutil.Discard)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := client.Replace(path, "", strings.NewReader("def\n")); !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict creating it again, actual:", err)
+	}
+	if err := client.Replace(path, version, strings.NewReader("def\n")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	// the version we read is out of date now
+	if err := client.Replace(path, version, strings.NewReader("ghi\n")); !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict, actual:", err)
+	}
+	var sb strings.Builder
+	if err := client.Read(path, &sb); err != nil || sb.String() != "def\n" {
+		t.Errorf("expected: \"def\\n\", actual: %q %v", sb.String(), err)
+	}
+}
+
+func TestDriveOverHTTPReplaceResponseLost(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+	path := "refs/heads/master"
+
+	if err := client.Replace(path, "", strings.NewReader("abc\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	version, err := client.ReadVersion(path, ioutil.Discard)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// the update gets through, but the reply doesn't
+	dropped := false
+	d.dropResponse = func(r *http.Request) bool {
+		if r.Method == "PATCH" && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	}
+	if err := client.Replace(path, version, strings.NewReader("def\n")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if !dropped {
+		t.Fatal("expected the update's response to be lost")
+	}
+	var sb strings.Builder
+	if err := client.Read(path, &sb); err != nil || sb.String() != "def\n" {
+		t.Errorf("expected: \"def\\n\", actual: %q %v", sb.String(), err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, f := range d.files {
+		if f.Name == "master" && len(f.revisions) != 2 {
+			t.Errorf("expected the update to be made once, actual revisions: %d",
+				len(f.revisions))
+		}
+	}
+}
+
+func TestDriveOverHTTPDuplicates(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+
+	// two pushes made the same folder at once
+	refs := d.add("refs", appDataFolder, true, "")
+	refs2 := d.add("refs", appDataFolder, true, "")
+	d.add("master", refs2, false, "abc\n")
+	for i := 0; i < 150; i++ {
+		d.add(fmt.Sprintf("tag-%03d", i), refs, false, "def\n")
+	}
+
+	duplicates, err := client.FindDuplicates("")
+	expected := []Duplicate{{Path: "refs", Count: 2, IsFolder: true}}
+	if err != nil || fmt.Sprint(duplicates) != fmt.Sprint(expected) {
+		t.Errorf("expected: %v, actual: %v %v", expected, duplicates, err)
+	}
+	if err := client.RepairDuplicate("refs", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	d.mu.Lock()
+	if _, ok := d.files[refs2]; ok {
+		t.Error("expected the newer folder to be removed")
+	}
+	d.mu.Unlock()
+	// more than one page of them
+	files, err := client.List("refs")
+	if err != nil || len(files) != 151 {
+		t.Errorf("expected 151 files, actual: %d %v", len(files), err)
+	}
+	moved := false
+	for _, f := range files {
+		moved = moved || f.Name == "master"
+	}
+	if !moved {
+		t.Error("expected master to be moved into the older folder")
+	}
+}
+
+func TestDriveOverHTTPDivergentDuplicates(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+
+	// two pushes each made refs, and then master in theirs, with different
+	// values
+	refs := d.add("refs", appDataFolder, true, "")
+	refs2 := d.add("refs", appDataFolder, true, "")
+	older := d.add("master", refs, false, "abc\n")
+	newer := d.add("master", refs2, false, "def\n")
+
+	// reads use the older folder, and leave the other alone
+	var sb strings.Builder
+	if err := client.Read("refs/master", &sb); err != nil || sb.String() != "abc\n" {
+		t.Errorf("expected the older to be read, actual: %q %v", sb.String(), err)
+	}
+	d.mu.Lock()
+	_, hasRefs2 := d.files[refs2]
+	d.mu.Unlock()
+	if !hasRefs2 {
+		t.Fatal("expected reading not to merge the folders")
+	}
+
+	// repairing refs merges the folders, but neither master can be thrown
+	// away
+	err := client.RepairDuplicate("refs", false)
+	if !errors.Is(err, errors.ErrDivergentDuplicate) {
+		t.Fatal("expected ErrDivergentDuplicate, actual:", err)
+	}
+	d.mu.Lock()
+	_, hasOlder := d.files[older]
+	_, hasNewer := d.files[newer]
+	_, hasRefs2 = d.files[refs2]
+	d.mu.Unlock()
+	if !hasOlder || !hasNewer || hasRefs2 {
+		t.Fatal("expected the folders to be merged and both copies kept")
+	}
+	err = client.RepairDuplicate("refs/master", false)
+	if !errors.Is(err, errors.ErrDivergentDuplicate) {
+		t.Fatal("expected ErrDivergentDuplicate, actual:", err)
+	}
+	for _, contents := range []string{`"abc\n"`, `"def\n"`} {
+		if !strings.Contains(err.Error(), contents) {
+			t.Errorf("expected the error to show %s, actual: %v", contents, err)
+		}
+	}
+
+	if err := client.RepairDuplicate("refs/master", true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sb.Reset()
+	if err := client.Read("refs/master", &sb); err != nil || sb.String() != "def\n" {
+		t.Errorf("expected the newest to be kept, actual: %q %v", sb.String(), err)
+	}
+}
+
+func TestDriveOverHTTPMergeWhilePushing(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+
+	d.add("pack", appDataFolder, true, "")
+	pack2 := d.add("pack", appDataFolder, true, "")
+	d.add("pack-1.pack", pack2, false, "PACK")
+	// a push uploads into the newer folder as its contents are moved out
+	var arrived string
+	d.beforeRequest = func(r *http.Request) {
+		if r.Method == "PATCH" && arrived == "" {
+			arrived = d.add("pack-2.pack", pack2, false, "PACK")
+		}
+	}
+
+	if err := client.RepairDuplicate("pack", false); err == nil {
+		t.Fatal("expected merging to stop when files arrive")
+	}
+	d.mu.Lock()
+	_, hasPack2 := d.files[pack2]
+	file, hasArrived := d.files[arrived]
+	d.mu.Unlock()
+	if !hasPack2 || !hasArrived || file.Trashed {
+		t.Fatal("expected the folder, and what arrived in it, to be kept")
+	}
+
+	// once the push has finished, trying again completes the merge
+	d.beforeRequest = nil
+	if err := client.RepairDuplicate("pack", false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	files, err := client.List("pack")
+	if err != nil || len(files) != 2 {
+		t.Errorf("expected both packs in the merged folder, actual: %v %v", files, err)
+	}
+}
+
+func TestDriveOverHTTPAwkwardNames(t *testing.T) {
+	d := newFakeDrive(t)
+	client := newFakeDriveClient(t, d)
+
+	// each must be escaped, or found by name even though it looks like a date
+	names := []string{`it's`, `back\slash`, `\'both\'`, "2019-01-01", "new\nline"}
+	for _, name := range names {
+		if err := client.Create("refs/tags/"+name, strings.NewReader(name)); err != nil {
+			t.Fatalf("%q: unexpected error: %v", name, err)
+		}
+	}
+	for _, name := range names {
+		var sb strings.Builder
+		if err := client.Read("refs/tags/"+name, &sb); err != nil || sb.String() != name {
+			t.Errorf("expected: %q, actual: %q %v", name, sb.String(), err)
+		}
+	}
+	if files, err := client.List("refs/tags"); err != nil || len(files) != len(names) {
+		t.Errorf("expected %d files, actual: %v %v", len(names), files, err)
+	}
+}
+
+func TestDriveOverHTTPTrash(t *testing.T) {
+	for _, refuseTrash := range []bool{false, true} {
+		d := newFakeDrive(t)
+		d.refuseTrash = refuseTrash
+		client := newFakeDriveClient(t, d)
+		client.trash = true
+
+		master := d.add("master", appDataFolder, false, "abc\n")
+		if err := client.Delete("master"); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		// dedupe throws duplicates away in the same way
+		d.add("HEAD", appDataFolder, false, "ref: refs/heads/master\n")
+		head2 := d.add("HEAD", appDataFolder, false, "ref: refs/heads/master\n")
+		if err := client.RepairDuplicate("HEAD", false); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+
+		d.mu.Lock()
+		for _, id := range []string{master, head2} {
+			f, exists := d.files[id]
+			if refuseTrash && exists {
+				t.Errorf("expected %s to be deleted when it can't be trashed", id)
+			}
+			if !refuseTrash && (!exists || !f.Trashed) {
+				t.Errorf("expected %s to be in the trash", id)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+func TestDriveOverHTTPQuotaExhausted(t *testing.T) {
+	// whichever of its requests runs out, each call fails with
+	// ErrQuotaExhausted, for pushes to report
+	calls := map[string]func(client SimpleFileStore) error{
+		"Create": func(client SimpleFileStore) error {
+			return client.Create("refs/heads/other", strings.NewReader("abc\n"))
+		},
+		"Read": func(client SimpleFileStore) error {
+			return client.Read("refs/heads/master", ioutil.Discard)
+		},
+		"Update": func(client SimpleFileStore) error {
+			return client.Update("refs/heads/master", strings.NewReader("def\n"))
+		},
+		"Delete": func(client SimpleFileStore) error {
+			return client.Delete("refs/heads/master")
+		},
+		"List": func(client SimpleFileStore) error {
+			_, err := client.List("refs/heads")
+			return err
+		},
+		"TestPath": func(client SimpleFileStore) error {
+			_, err := client.TestPath("refs/heads/master")
+			return err
+		},
+		"ReadVersion": func(client SimpleFileStore) error {
+			_, err := client.(ConditionalStore).ReadVersion("refs/heads/master", ioutil.Discard)
+			return err
+		},
+		"Replace": func(client SimpleFileStore) error {
+			conditional := client.(ConditionalStore)
+			version, err := conditional.ReadVersion("refs/heads/master", ioutil.Discard)
+			if err != nil {
+				return err
+			}
+			return conditional.Replace("refs/heads/master", version, strings.NewReader("def\n"))
+		},
+		"Copy": func(client SimpleFileStore) error {
+			return client.(driveAPIClient).Copy("refs/heads/master", "refs/tags/v1")
+		},
+	}
+	for name, call := range calls {
+		for budget := int64(1); ; budget++ {
+			d := newFakeDrive(t)
+			refs := d.add("refs", appDataFolder, true, "")
+			heads := d.add("heads", refs, true, "")
+			d.add("master", heads, false, "abc\n")
+			client, err := NewClient(
+				WithBaseURL(d.URL+"/drive/v3"),
+				WithHTTPClient(d.Client()),
+				WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "x"})),
+				WithRequestBudget(budget),
+			)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			err = call(client)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errors.ErrQuotaExhausted) {
+				t.Errorf("%s with a budget of %d: expected ErrQuotaExhausted, actual: %v",
+					name, budget, err)
+			}
+		}
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	d := newFakeDrive(t)
+	d.token = "secret-token"
+
+	client, err := NewClient(
+		WithBaseURL(d.URL+"/drive/v3"),
+		WithHTTPClient(d.Client()),
+		WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "secret-token"})),
+		WithRequestBudget(10),
+	)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := client.Create("HEAD", strings.NewReader("ref: refs/heads/master\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var sb strings.Builder
+	if err := client.Read("HEAD", &sb); err != nil || sb.String() != "ref: refs/heads/master\n" {
+		t.Errorf("expected: \"ref: refs/heads/master\\n\", actual: %q %v", sb.String(), err)
+	}
+	if _, limited := d.Client().Transport.(limitedTransport); limited {
+		t.Error("expected the given client to be left as it was")
+	}
+
+	_, err = NewClient(WithSecretFile(filepath.Join(t.TempDir(), "missing.secret")))
+	if err == nil || !strings.Contains(err.Error(), "client secret") {
+		t.Error("expected an error reading the secret, actual:", err)
+	}
+}
@@ -1,5 +1,207 @@
 package store
 
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
 // localStore is an implementation of our filesystem abstraction that uses
-// the local filesystem
-type localStore struct{}
+// the local filesystem. Paths are relative to root.
+//
+// Files are written to a temporary file first and then renamed into place,
+// so readers never see half a file. Conditional updates take a lock file
+// next to the file being updated, in the same way git updates refs.
+type localStore struct {
+	root string
+}
+
+// NewLocalStore creates a SimpleFileStore that keeps its files in the
+// directory root, which is created if need be
+func NewLocalStore(root string) SimpleFileStore {
+	return localStore{root}
+}
+
+// prove at compile-time that local updates can be made conditional
+var _ ConditionalStore = localStore{}
+
+const (
+	tempPrefix = ".tmp_"
+	lockSuffix = ".lock"
+)
+
+func (s localStore) fullPath(path string) string {
+	return filepath.Join(s.root, filepath.FromSlash(strings.TrimPrefix(path, "/")))
+}
+
+// notFound turns the error for a missing file into our own
+func notFound(path string, err error) error {
+	if os.IsNotExist(err) {
+		return errors.ErrNotFound{Path: path}
+	}
+	return err
+}
+
+func (s localStore) Create(path string, contents io.Reader) error {
+	return s.write(s.fullPath(path), contents)
+}
+
+// write writes contents to a temporary file in the same folder as
+// fullPath and then renames it into place
+func (s localStore) write(fullPath string, contents io.Reader) error {
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fullPath)
+}
+
+func (s localStore) Read(path string, contents io.Writer) error {
+	f, err := os.Open(s.fullPath(path))
+	if err != nil {
+		return notFound(path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(contents, f); err != nil {
+		return fmt.Errorf("while reading \"%s\": %v", path, err)
+	}
+	return nil
+}
+
+func (s localStore) Update(path string, contents io.Reader) error {
+	fullPath := s.fullPath(path)
+	if _, err := os.Stat(fullPath); err != nil {
+		return notFound(path, err)
+	}
+	return s.write(fullPath, contents)
+}
+
+// Delete deletes a file, or a folder and all its contents
+func (s localStore) Delete(path string) error {
+	fullPath := s.fullPath(path)
+	if fullPath == filepath.Clean(s.root) {
+		return fmt.Errorf("refusing to delete root folder")
+	}
+	if _, err := os.Lstat(fullPath); err != nil {
+		return notFound(path, err)
+	}
+	return os.RemoveAll(fullPath)
+}
+
+// List lists a folder, leaving out any files that are still being written
+func (s localStore) List(path string) ([]File, error) {
+	infos, err := ioutil.ReadDir(s.fullPath(path))
+	if err != nil {
+		return nil, notFound(path, err)
+	}
+	var files []File
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, tempPrefix) || strings.HasSuffix(name, lockSuffix) {
+			continue
+		}
+		files = append(files, File{IsFolder: info.IsDir(), Name: name})
+	}
+	return files, nil
+}
+
+func (s localStore) TestPath(path string) (bool, error) {
+	_, err := os.Stat(s.fullPath(path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReadVersion is Read, also returning the sha1 of the contents as their
+// version
+func (s localStore) ReadVersion(path string, contents io.Writer) (string, error) {
+	h := sha1.New()
+	if err := s.Read(path, io.MultiWriter(contents, h)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// lockTimeout is how long to wait for someone else to release a lock, as
+// git does for refs
+var lockTimeout = time.Second
+
+// takeLock creates the lock file lockPath. If it exists, someone else is
+// updating the file right now, so we wait for them. Or they were killed
+// before they could clean up, which only the user can sort out.
+func takeLock(lockPath string) (*os.File, error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.ErrLocked{Path: lockPath}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Replace holds path's lock file while it checks the version and writes
+// the new contents, so that nobody else using Replace can get in between
+func (s localStore) Replace(path string, version string, contents io.Reader) error {
+	fullPath := s.fullPath(path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	lock, err := takeLock(fullPath + lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(lock.Name())
+
+	current, err := s.ReadVersion(path, ioutil.Discard)
+	if _, isNotFound := err.(errors.ErrNotFound); isNotFound {
+		current, err = "", nil
+	}
+	if err != nil {
+		lock.Close()
+		return err
+	}
+	if current != version {
+		lock.Close()
+		return fmt.Errorf("%s: %w", path, errors.ErrConflict)
+	}
+	if _, err := io.Copy(lock, contents); err != nil {
+		lock.Close()
+		return err
+	}
+	if err := lock.Sync(); err != nil {
+		lock.Close()
+		return err
+	}
+	if err := lock.Close(); err != nil {
+		return err
+	}
+	return os.Rename(lock.Name(), fullPath)
+}
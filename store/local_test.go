@@ -0,0 +1,134 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
+func TestLocalStore(t *testing.T) {
+	s := NewLocalStore(t.TempDir())
+
+	if err := s.Create("repo.git/refs/heads/master", strings.NewReader("abc\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var sb strings.Builder
+	if err := s.Read("repo.git/refs/heads/master", &sb); err != nil || sb.String() != "abc\n" {
+		t.Errorf("expected: \"abc\\n\", actual: %q %v", sb.String(), err)
+	}
+	if err := s.Update("repo.git/refs/heads/master", strings.NewReader("def\n")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	sb.Reset()
+	if s.Read("repo.git/refs/heads/master", &sb); sb.String() != "def\n" {
+		t.Errorf("expected: \"def\\n\", actual: %q", sb.String())
+	}
+
+	files, err := s.List("repo.git/refs")
+	if err != nil || fmt.Sprint(files) != "[{true heads}]" {
+		t.Errorf("expected: [{true heads}], actual: %v %v", files, err)
+	}
+	if exists, err := s.TestPath("repo.git/refs/heads"); !exists || err != nil {
+		t.Error("expected refs/heads to exist, actual:", exists, err)
+	}
+
+	missing := "repo.git/refs/heads/missing"
+	for _, err := range []error{
+		s.Read(missing, &sb),
+		s.Update(missing, strings.NewReader("abc\n")),
+		s.Delete(missing),
+	} {
+		if _, ok := err.(errors.ErrNotFound); !ok {
+			t.Error("expected ErrNotFound, actual:", err)
+		}
+	}
+	if _, err := s.List(missing); err == nil {
+		t.Error("expected listing a missing folder to fail")
+	}
+
+	if err := s.Delete("repo.git/refs"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if exists, _ := s.TestPath("repo.git/refs/heads/master"); exists {
+		t.Error("expected deleting a folder to delete what's in it")
+	}
+	if err := s.Delete("/"); err == nil {
+		t.Error("expected deleting the root to fail")
+	}
+}
+
+func TestLocalStoreHidesPartialFiles(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocalStore(root)
+	s.Create("refs/heads/master", strings.NewReader("abc\n"))
+	for _, name := range []string{".tmp_123", "master.lock"} {
+		err := ioutil.WriteFile(filepath.Join(root, "refs", "heads", name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := s.List("refs/heads")
+	if err != nil || fmt.Sprint(files) != "[{false master}]" {
+		t.Errorf("expected: [{false master}], actual: %v %v", files, err)
+	}
+
+	// a lock left behind by someone else, which fetching won't fix
+	err = s.(ConditionalStore).Replace("refs/heads/master", "", strings.NewReader("def\n"))
+	var locked errors.ErrLocked
+	if !errors.As(err, &locked) || errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrLocked, actual:", err)
+	}
+	if expected := filepath.Join(root, "refs", "heads", "master.lock"); locked.Path != expected {
+		t.Errorf("expected: %s, actual: %s", expected, locked.Path)
+	}
+}
+
+func TestLocalStoreReplace(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocalStore(root).(ConditionalStore)
+	path := "refs/heads/master"
+
+	if err := s.Replace(path, "", strings.NewReader("abc\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := s.Replace(path, "", strings.NewReader("def\n")); !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict creating it again, actual:", err)
+	}
+	var sb strings.Builder
+	version, err := s.ReadVersion(path, &sb)
+	if err != nil || sb.String() != "abc\n" {
+		t.Fatalf("expected: \"abc\\n\", actual: %q %v", sb.String(), err)
+	}
+
+	// Several pushes from the same starting point: only one can win
+	var wg sync.WaitGroup
+	results := make([]error, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = s.Replace(path, version, strings.NewReader(fmt.Sprintf("%d\n", i)))
+		}(i)
+	}
+	wg.Wait()
+	winners := 0
+	for _, err := range results {
+		if err == nil {
+			winners++
+		} else if !errors.Is(err, errors.ErrConflict) {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if winners != 1 {
+		t.Errorf("expected one update to win, actual: %d", winners)
+	}
+	if _, err := os.Stat(filepath.Join(root, path+lockSuffix)); !os.IsNotExist(err) {
+		t.Error("expected the lock to be released")
+	}
+}
@@ -0,0 +1,434 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	paths "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
+// MemStore is a SimpleFileStore kept in memory, for tests. Like Drive it
+// can have duplicates, and its updates are conditional.
+//
+// Faults can be injected to make it behave more like a remote store:
+// slow, failing, creating duplicates, or slow to show changes.
+type MemStore struct {
+	mu     sync.Mutex
+	files  map[string]*memEntry
+	faults []Fault
+	counts []int
+	calls  []string
+	// ticks for every write, to order copies by when they were modified
+	clock int
+}
+
+// prove at compile-time that the memory store has the optional features
+var (
+	_ ConditionalStore  = (*MemStore)(nil)
+	_ DuplicateRepairer = (*MemStore)(nil)
+)
+
+// memEntry is a file or folder. Until visibleAt, reads still see stale,
+// where nil means that it didn't exist.
+type memEntry struct {
+	current   *memFile
+	stale     *memFile
+	visibleAt time.Time
+}
+
+// memFile is a file or folder with all of its copies, in the order they
+// were created. Reads and updates use the first copy.
+type memFile struct {
+	isFolder bool
+	copies   []memCopy
+}
+
+type memCopy struct {
+	contents []byte
+	version  int
+	modified int
+}
+
+func (f *memFile) contents() []byte { return f.copies[0].contents }
+func (f *memFile) version() int     { return f.copies[0].version }
+
+// Fault is something that goes wrong with calls to a MemStore. Of the calls
+// it matches, it lets the first After through, then affects the next Times
+// calls, or all of the rest if Times is 0.
+type Fault struct {
+	// Op is the name of the method, such as "Create", or "" for any
+	Op string
+	// Path is a pattern for path.Match, or "" for any path
+	Path  string
+	After int
+	Times int
+
+	// Latency is how long to wait before doing anything
+	Latency time.Duration
+	// Err is returned instead of doing anything
+	Err error
+	// Duplicate makes writes add another copy of the file, and of any
+	// folders that have to be created for it, as racing writers would.
+	// Create always adds a copy of a file that exists, as Drive does.
+	Duplicate bool
+	// Delay is how long until Read, List and TestPath see the change
+	Delay time.Duration
+}
+
+// NewMemStore creates an empty MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{files: map[string]*memEntry{}}
+}
+
+// Inject adds faults to the calls made from now on. When more than one
+// fault applies to a call, the one injected first is used.
+func (s *MemStore) Inject(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, faults...)
+	s.counts = append(s.counts, make([]int, len(faults))...)
+}
+
+// Calls lists the calls that have been made, such as "Create refs/heads/x"
+func (s *MemStore) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// begin records a call and applies any fault to it. It returns with s.mu
+// held unless there was an error.
+func (s *MemStore) begin(op string, path string) (Fault, error) {
+	s.mu.Lock()
+	s.calls = append(s.calls, op+" "+path)
+	var fault Fault
+	for i, f := range s.faults {
+		if f.Op != "" && f.Op != op {
+			continue
+		}
+		if f.Path != "" {
+			if matched, _ := paths.Match(f.Path, path); !matched {
+				continue
+			}
+		}
+		s.counts[i]++
+		if s.counts[i] > f.After && (f.Times == 0 || s.counts[i] <= f.After+f.Times) {
+			fault = f
+			break
+		}
+	}
+	if fault.Latency > 0 {
+		s.mu.Unlock()
+		time.Sleep(fault.Latency)
+		s.mu.Lock()
+	}
+	if fault.Err != nil {
+		s.mu.Unlock()
+		return fault, fault.Err
+	}
+	return fault, nil
+}
+
+func cleanPath(path string) string {
+	return strings.Trim(paths.Clean("/"+path), "/")
+}
+
+func parentPath(path string) string {
+	if dir := paths.Dir(path); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// visible is what reads see of path
+func (s *MemStore) visible(path string) *memFile {
+	if path == "" {
+		return newMemFolder()
+	}
+	entry, ok := s.files[path]
+	if !ok {
+		return nil
+	}
+	if time.Now().Before(entry.visibleAt) {
+		return entry.stale
+	}
+	return entry.current
+}
+
+// latest is what writes see of path
+func (s *MemStore) latest(path string) *memFile {
+	if path == "" {
+		return newMemFolder()
+	}
+	if entry, ok := s.files[path]; ok {
+		return entry.current
+	}
+	return nil
+}
+
+func newMemFolder() *memFile {
+	return &memFile{isFolder: true, copies: []memCopy{{}}}
+}
+
+// set changes path to file, which readers see after delay
+func (s *MemStore) set(path string, file *memFile, delay time.Duration) {
+	entry, ok := s.files[path]
+	if !ok {
+		entry = &memEntry{}
+		s.files[path] = entry
+	}
+	if delay > 0 {
+		entry.stale = s.visible(path)
+		entry.visibleAt = time.Now().Add(delay)
+	}
+	entry.current = file
+}
+
+// write stores contents at path, creating the folders above it as needed.
+// The first copy of the file is replaced, unless addCopy is set, which adds
+// a new copy alongside any there are already.
+func (s *MemStore) write(path string, contents []byte, fault Fault, addCopy bool) error {
+	existing := s.latest(path)
+	if existing != nil && existing.isFolder {
+		return fmt.Errorf("%s is a folder", path)
+	}
+	for dir := parentPath(path); dir != ""; dir = parentPath(dir) {
+		if folder := s.latest(dir); folder == nil {
+			folder = newMemFolder()
+			if fault.Duplicate {
+				folder.copies = append(folder.copies, memCopy{})
+			}
+			s.set(dir, folder, fault.Delay)
+		} else if !folder.isFolder {
+			return fmt.Errorf("%s is not a folder", dir)
+		}
+	}
+	s.clock++
+	written := memCopy{contents: contents, version: 1, modified: s.clock}
+	// copy rather than change existing, which may still be visible
+	file := &memFile{}
+	if existing != nil {
+		file.copies = append(file.copies, existing.copies...)
+	}
+	if existing == nil || addCopy {
+		file.copies = append(file.copies, written)
+	} else {
+		written.version = existing.version() + 1
+		file.copies[0] = written
+	}
+	if fault.Duplicate {
+		file.copies = append(file.copies, written)
+	}
+	s.set(path, file, fault.Delay)
+	return nil
+}
+
+// Create creates a file. If the file exists already, another copy is
+// created alongside it, as in Drive.
+func (s *MemStore) Create(path string, contents io.Reader) error {
+	path = cleanPath(path)
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, contents); err != nil {
+		return err
+	}
+	fault, err := s.begin("Create", path)
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	return s.write(path, buf.Bytes(), fault, true)
+}
+
+func (s *MemStore) Read(path string, contents io.Writer) error {
+	_, err := s.read("Read", path, contents)
+	return err
+}
+
+func (s *MemStore) Update(path string, contents io.Reader) error {
+	path = cleanPath(path)
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, contents); err != nil {
+		return err
+	}
+	fault, err := s.begin("Update", path)
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if file := s.latest(path); file == nil || file.isFolder {
+		return errors.ErrNotFound{Path: path}
+	}
+	return s.write(path, buf.Bytes(), fault, false)
+}
+
+// Delete deletes a file, or a folder and everything in it
+func (s *MemStore) Delete(path string) error {
+	path = cleanPath(path)
+	if path == "" {
+		return fmt.Errorf("refusing to delete root folder")
+	}
+	fault, err := s.begin("Delete", path)
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if s.latest(path) == nil {
+		return errors.ErrNotFound{Path: path}
+	}
+	for p := range s.files {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			s.set(p, nil, fault.Delay)
+		}
+	}
+	return nil
+}
+
+// List lists a folder, with any duplicates listed as many times as there
+// are copies
+func (s *MemStore) List(path string) ([]File, error) {
+	path = cleanPath(path)
+	if _, err := s.begin("List", path); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	if folder := s.visible(path); folder == nil || !folder.isFolder {
+		return nil, errors.ErrNotFound{Path: path}
+	}
+	var files []File
+	for p := range s.files {
+		if p == "" || parentPath(p) != path {
+			continue
+		}
+		if file := s.visible(p); file != nil {
+			for range file.copies {
+				files = append(files, File{IsFolder: file.isFolder, Name: paths.Base(p)})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (s *MemStore) TestPath(path string) (bool, error) {
+	path = cleanPath(path)
+	if _, err := s.begin("TestPath", path); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	return s.visible(path) != nil, nil
+}
+
+// ReadVersion is Read, also returning the number of times the file has
+// been written as its version
+func (s *MemStore) ReadVersion(path string, contents io.Writer) (string, error) {
+	return s.read("ReadVersion", path, contents)
+}
+
+func (s *MemStore) read(op string, path string, contents io.Writer) (string, error) {
+	path = cleanPath(path)
+	if _, err := s.begin(op, path); err != nil {
+		return "", err
+	}
+	file := s.visible(path)
+	s.mu.Unlock()
+	if file == nil || file.isFolder {
+		return "", errors.ErrNotFound{Path: path}
+	}
+	if _, err := contents.Write(file.contents()); err != nil {
+		return "", fmt.Errorf("while reading \"%s\": %v", path, err)
+	}
+	return strconv.Itoa(file.version()), nil
+}
+
+// Replace compares the version with the latest one, rather than the one
+// that reads can see
+func (s *MemStore) Replace(path string, version string, contents io.Reader) error {
+	path = cleanPath(path)
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, contents); err != nil {
+		return err
+	}
+	fault, err := s.begin("Replace", path)
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	current := ""
+	if file := s.latest(path); file != nil {
+		current = strconv.Itoa(file.version())
+	}
+	if current != version {
+		return fmt.Errorf("%s: %w", path, errors.ErrConflict)
+	}
+	return s.write(path, buf.Bytes(), fault, false)
+}
+
+// FindDuplicates lists the paths at or below path that have more than one
+// copy
+func (s *MemStore) FindDuplicates(path string) ([]Duplicate, error) {
+	path = cleanPath(path)
+	if _, err := s.begin("FindDuplicates", path); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var duplicates []Duplicate
+	for p := range s.files {
+		if path != "" && p != path && !strings.HasPrefix(p, path+"/") {
+			continue
+		}
+		if file := s.latest(p); file != nil && len(file.copies) > 1 {
+			duplicates = append(duplicates, Duplicate{
+				Path: p, Count: len(file.copies), IsFolder: file.isFolder,
+			})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Path < duplicates[j].Path
+	})
+	return duplicates, nil
+}
+
+// RepairDuplicate leaves one copy of path. Copies of a folder all have the
+// same contents, so nothing needs merging. Copies of a file are only
+// deleted if they are the same as the first, unless keepNewest is set, in
+// which case the most recently modified copy is kept.
+func (s *MemStore) RepairDuplicate(path string, keepNewest bool) error {
+	path = cleanPath(path)
+	if _, err := s.begin("RepairDuplicate", path); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	file := s.latest(path)
+	if file == nil {
+		return errors.ErrNotFound{Path: path}
+	}
+	keep := file.copies[0]
+	if !file.isFolder {
+		var descriptions []string
+		divergent := false
+		for _, c := range file.copies {
+			descriptions = append(descriptions, fmt.Sprintf("%q", c.contents))
+			if !bytes.Equal(c.contents, keep.contents) {
+				divergent = true
+			}
+		}
+		if divergent && !keepNewest {
+			return fmt.Errorf("\"%s\" has copies %s: %w", path,
+				strings.Join(descriptions, ", "), errors.ErrDivergentDuplicate)
+		}
+		for _, c := range file.copies {
+			if c.modified > keep.modified {
+				keep = c
+			}
+		}
+	}
+	s.files[path].current = &memFile{isFolder: file.isFolder, copies: []memCopy{keep}}
+	return nil
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+
+	if err := s.Create("repo.git/refs/heads/master", strings.NewReader("abc\n")); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := s.Update("repo.git/refs/heads/master", strings.NewReader("def\n")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	var sb strings.Builder
+	version, err := s.ReadVersion("repo.git/refs/heads/master", &sb)
+	if err != nil || sb.String() != "def\n" || version != "2" {
+		t.Errorf("expected: \"def\\n\" 2, actual: %q %s %v", sb.String(), version, err)
+	}
+	for dir, expected := range map[string]string{
+		"":                     "[{true repo.git}]",
+		"repo.git/refs":        "[{true heads}]",
+		"/repo.git/refs/heads": "[{false master}]",
+	} {
+		files, err := s.List(dir)
+		if err != nil || fmt.Sprint(files) != expected {
+			t.Errorf("%q: expected: %s, actual: %v %v", dir, expected, files, err)
+		}
+	}
+
+	missing := "repo.git/refs/heads/missing"
+	for _, err := range []error{
+		s.Read(missing, &sb),
+		s.Update(missing, strings.NewReader("abc\n")),
+		s.Delete(missing),
+		s.RepairDuplicate(missing, false),
+	} {
+		if _, ok := err.(errors.ErrNotFound); !ok {
+			t.Error("expected ErrNotFound, actual:", err)
+		}
+	}
+	if _, err := s.List(missing); err == nil {
+		t.Error("expected listing a missing folder to fail")
+	}
+
+	if err := s.Replace("repo.git/refs/heads/master", "1", strings.NewReader("ghi\n")); !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict, actual:", err)
+	}
+	if err := s.Replace("repo.git/refs/heads/other", "", strings.NewReader("ghi\n")); err != nil {
+		t.Error("unexpected error:", err)
+	}
+
+	if err := s.Delete("repo.git/refs"); err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if exists, _ := s.TestPath("repo.git/refs/heads/master"); exists {
+		t.Error("expected deleting a folder to delete what's in it")
+	}
+	if files, _ := s.List("repo.git"); len(files) != 0 {
+		t.Error("expected an empty folder, actual:", files)
+	}
+}
+
+func TestMemStoreFaults(t *testing.T) {
+	s := NewMemStore()
+	s.Inject(
+		Fault{Op: "Create", Path: "objects/*/*", After: 1, Times: 2, Err: errors.ErrQuotaExhausted},
+		Fault{Op: "Read", Latency: 20 * time.Millisecond},
+	)
+	var failed []int
+	for i := 0; i < 5; i++ {
+		err := s.Create(fmt.Sprintf("objects/ab/%d", i), strings.NewReader("x"))
+		if err == errors.ErrQuotaExhausted {
+			failed = append(failed, i)
+		} else if err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if fmt.Sprint(failed) != "[1 2]" {
+		t.Error("expected the second and third creates to fail, actual:", failed)
+	}
+	if err := s.Create("refs/heads/master", strings.NewReader("x")); err != nil {
+		t.Error("expected other paths to be left alone, actual:", err)
+	}
+
+	start := time.Now()
+	var sb strings.Builder
+	if err := s.Read("objects/ab/0", &sb); err != nil || sb.String() != "x" {
+		t.Errorf("expected: \"x\", actual: %q %v", sb.String(), err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Error("expected a slow read, took", elapsed)
+	}
+
+	calls := s.Calls()
+	if len(calls) != 7 || calls[1] != "Create objects/ab/1" {
+		t.Error("unexpected calls:", calls)
+	}
+}
+
+func TestMemStoreDuplicates(t *testing.T) {
+	s := NewMemStore()
+	s.Create("objects/info/packs", strings.NewReader(""))
+	s.Inject(Fault{Op: "Create", Path: "objects/*/*", Times: 1, Duplicate: true})
+	s.Create("objects/ab/cdef", strings.NewReader("x"))
+	s.Create("objects/ab/0123", strings.NewReader("x"))
+
+	files, _ := s.List("objects")
+	if fmt.Sprint(files) != "[{true ab} {true ab} {true info}]" {
+		t.Error("expected a duplicate folder, actual:", files)
+	}
+	duplicates, err := s.FindDuplicates("")
+	expected := []Duplicate{
+		{Path: "objects/ab", Count: 2, IsFolder: true},
+		{Path: "objects/ab/cdef", Count: 2},
+	}
+	if err != nil || fmt.Sprint(duplicates) != fmt.Sprint(expected) {
+		t.Errorf("expected: %v, actual: %v %v", expected, duplicates, err)
+	}
+	for _, d := range duplicates {
+		if err := s.RepairDuplicate(d.Path, false); err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if duplicates, _ := s.FindDuplicates("objects"); len(duplicates) != 0 {
+		t.Error("expected no duplicates left, actual:", duplicates)
+	}
+	if files, _ := s.List("objects/ab"); fmt.Sprint(files) != "[{false 0123} {false cdef}]" {
+		t.Error("expected the folder's contents to be kept, actual:", files)
+	}
+}
+
+func TestMemStoreDivergentDuplicates(t *testing.T) {
+	s := NewMemStore()
+	s.Create("refs/master", strings.NewReader("a"))
+	s.Create("refs/master", strings.NewReader("b"))
+	s.Create("refs/master", strings.NewReader("c"))
+	// the first copy is the one that's read, and updated
+	s.Update("refs/master", strings.NewReader("d"))
+
+	var sb strings.Builder
+	if err := s.Read("refs/master", &sb); err != nil || sb.String() != "d" {
+		t.Errorf("expected: \"d\", actual: %q %v", sb.String(), err)
+	}
+	duplicates, _ := s.FindDuplicates("")
+	expected := []Duplicate{{Path: "refs/master", Count: 3}}
+	if fmt.Sprint(duplicates) != fmt.Sprint(expected) {
+		t.Errorf("expected: %v, actual: %v", expected, duplicates)
+	}
+
+	err := s.RepairDuplicate("refs/master", false)
+	if !errors.Is(err, errors.ErrDivergentDuplicate) {
+		t.Fatal("expected ErrDivergentDuplicate, actual:", err)
+	}
+	if duplicates, _ := s.FindDuplicates(""); len(duplicates) != 1 {
+		t.Error("expected the copies to be left alone, actual:", duplicates)
+	}
+	if err := s.RepairDuplicate("refs/master", true); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	sb.Reset()
+	if err := s.Read("refs/master", &sb); err != nil || sb.String() != "d" {
+		t.Errorf("expected the newest, \"d\", actual: %q %v", sb.String(), err)
+	}
+	if duplicates, _ := s.FindDuplicates(""); len(duplicates) != 0 {
+		t.Error("expected no duplicates left, actual:", duplicates)
+	}
+}
+
+func TestMemStoreDelay(t *testing.T) {
+	s := NewMemStore()
+	s.Create("refs/heads/master", strings.NewReader("abc\n"))
+	s.Inject(Fault{Delay: time.Hour})
+
+	s.Create("refs/heads/other", strings.NewReader("def\n"))
+	s.Update("refs/heads/master", strings.NewReader("ghi\n"))
+	if exists, _ := s.TestPath("refs/heads/other"); exists {
+		t.Error("expected a new file to be hidden for a while")
+	}
+	if files, _ := s.List("refs/heads"); fmt.Sprint(files) != "[{false master}]" {
+		t.Error("expected a new file to be hidden for a while, actual:", files)
+	}
+	var sb strings.Builder
+	version, _ := s.ReadVersion("refs/heads/master", &sb)
+	if sb.String() != "abc\n" || version != "1" {
+		t.Errorf("expected the old contents for a while, actual: %q %s", sb.String(), version)
+	}
+
+	// Writes are checked against the latest version all the same
+	err := s.Replace("refs/heads/master", version, strings.NewReader("jkl\n"))
+	if !errors.Is(err, errors.ErrConflict) {
+		t.Error("expected ErrConflict, actual:", err)
+	}
+
+	s.Delete("refs/heads/master")
+	if exists, _ := s.TestPath("refs/heads/master"); !exists {
+		t.Error("expected a deleted file to be seen for a while")
+	}
+}
@@ -0,0 +1,141 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field is a field of a file, such as name or parents. Field names are
+// written out as they are, so they must come from us, not from users.
+func Field(name string) Datum {
+	return Datum{IDENT, name}
+}
+
+// String is a quoted string. Like the parser, a string that is a date is
+// a DATE.
+func String(s string) Datum {
+	if IsDate(s) {
+		return Datum{DATE, s}
+	}
+	return Datum{STRING, s}
+}
+
+func Bool(b bool) Datum {
+	if b {
+		return Datum{TRUE, "true"}
+	}
+	return Datum{FALSE, "false"}
+}
+
+// Number must be finite
+func Number(n float64) Datum {
+	return Datum{NUMBER, strconv.FormatFloat(n, 'f', -1, 64)}
+}
+
+func Date(t time.Time) Datum {
+	return Datum{DATE, t.UTC().Format(time.RFC3339Nano)}
+}
+
+func Eq(lhs, rhs Datum) Test    { return Test{Lhs: lhs, Op: EQUALS, Rhs: rhs} }
+func NotEq(lhs, rhs Datum) Test { return Test{Lhs: lhs, Op: NOT_EQUALS, Rhs: rhs} }
+func Lt(lhs, rhs Datum) Test    { return Test{Lhs: lhs, Op: LT, Rhs: rhs} }
+func Lte(lhs, rhs Datum) Test   { return Test{Lhs: lhs, Op: LTE, Rhs: rhs} }
+func Gt(lhs, rhs Datum) Test    { return Test{Lhs: lhs, Op: GT, Rhs: rhs} }
+func Gte(lhs, rhs Datum) Test   { return Test{Lhs: lhs, Op: GTE, Rhs: rhs} }
+
+// Contains is field contains value
+func Contains(field, value Datum) Test {
+	return Test{Lhs: field, Op: CONTAINS, Rhs: value}
+}
+
+// In is value in field, such as 'id' in parents
+func In(value, field Datum) Test {
+	return Test{Lhs: value, Op: IN, Rhs: field}
+}
+
+// Has is field has { key = 'key' and value = 'value' }
+func Has(field Datum, key, value string) Test {
+	sub := All(Eq(Field("key"), String(key)), Eq(Field("value"), String(value)))
+	return Test{Lhs: field, Op: HAS, Sub: &sub}
+}
+
+func Not(test Test) Test {
+	test.Not = !test.Not
+	return test
+}
+
+// Group brackets expr, so that it can be part of a conjunction
+func Group(expr Expr) Test {
+	return Test{Op: LPAREN, Sub: &expr}
+}
+
+// All is the tests joined by and
+func All(tests ...Test) Expr {
+	return Expr{Ands: []And{{Tests: tests}}}
+}
+
+// Any is the exprs joined by or
+func Any(exprs ...Expr) Expr {
+	var ands []And
+	for _, expr := range exprs {
+		ands = append(ands, expr.Ands...)
+	}
+	return Expr{Ands: ands}
+}
+
+var operators = map[Token]string{
+	EQUALS:     "=",
+	NOT_EQUALS: "!=",
+	LT:         "<",
+	LTE:        "<=",
+	GT:         ">",
+	GTE:        ">=",
+	IN:         "in",
+	CONTAINS:   "contains",
+	HAS:        "has",
+}
+
+// String writes expr out as a query, that parses back into expr
+func (expr Expr) String() string {
+	ands := make([]string, len(expr.Ands))
+	for i, and := range expr.Ands {
+		ands[i] = and.String()
+	}
+	return strings.Join(ands, " or ")
+}
+
+func (and And) String() string {
+	tests := make([]string, len(and.Tests))
+	for i, test := range and.Tests {
+		tests[i] = test.String()
+	}
+	return strings.Join(tests, " and ")
+}
+
+func (test Test) String() string {
+	var s string
+	switch test.Op {
+	case LPAREN:
+		s = "(" + test.Sub.String() + ")"
+	case HAS:
+		s = test.Lhs.String() + " has { " + test.Sub.String() + " }"
+	default:
+		s = test.Lhs.String() + " " + operators[test.Op] + " " + test.Rhs.String()
+	}
+	if test.Not {
+		return "not " + s
+	}
+	return s
+}
+
+// stringEscaper escapes what ends or escapes a string. Everything else,
+// newlines included, can be in a string as it is.
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func (d Datum) String() string {
+	if d.Type == STRING || d.Type == DATE {
+		return "'" + stringEscaper.Replace(d.Lit) + "'"
+	}
+	return d.Lit
+}
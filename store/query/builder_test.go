@@ -0,0 +1,138 @@
+package query
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestBuild(t *testing.T) {
+	for expected, expr := range map[string]Expr{
+		`name = 'it\'s a \\ test' and 'root' in parents and trashed = false`: All(
+			Eq(Field("name"), String(`it's a \ test`)),
+			In(String("root"), Field("parents")),
+			Eq(Field("trashed"), Bool(false)),
+		),
+		"not mimeType != 'text/plain' or (name contains 'a' or starred = true)": Any(
+			All(Not(NotEq(Field("mimeType"), String("text/plain")))),
+			All(Group(Any(
+				All(Contains(Field("name"), String("a"))),
+				All(Eq(Field("starred"), Bool(true))),
+			))),
+		),
+		"modifiedTime > '2019-01-02T03:04:05.5Z' and size <= -1.25": All(
+			Gt(Field("modifiedTime"), Date(time.Date(2019, 1, 2, 4, 4, 5, 5e8, time.FixedZone("", 3600)))),
+			Lte(Field("size"), Number(-1.25)),
+		),
+		"appProperties has { key = 'ref' and value = 'master' }": All(
+			Has(Field("appProperties"), "ref", "master"),
+		),
+	} {
+		if actual := expr.String(); actual != expected {
+			t.Errorf("expected: %s\n  actual: %s", expected, actual)
+		}
+	}
+}
+
+// randomExpr generates expressions for quick.Check
+type randomExpr struct {
+	Expr
+}
+
+var randomFields = []string{"name", "mimeType", "parents", "modifiedTime", "shortcutDetails.targetId"}
+
+func randomString(r *rand.Rand) string {
+	// mostly the characters that need care
+	awkward := []rune(`'\" 	{}()=<>!-.0123456789` + "\n\x00é")
+	var sb strings.Builder
+	for i := r.Intn(8); i > 0; i-- {
+		if r.Intn(4) == 0 {
+			sb.WriteRune(rune(r.Intn(0x10000)))
+		} else {
+			sb.WriteRune(awkward[r.Intn(len(awkward))])
+		}
+	}
+	return sb.String()
+}
+
+func randomDatum(r *rand.Rand) Datum {
+	switch r.Intn(6) {
+	case 0:
+		return Field(randomFields[r.Intn(len(randomFields))])
+	case 1:
+		return Bool(r.Intn(2) == 0)
+	case 2:
+		return Number(float64(r.Int63n(2000000)-1000000) / 1000)
+	case 3:
+		return Date(time.Unix(r.Int63n(1<<32), r.Int63n(1e9)))
+	default:
+		return String(randomString(r))
+	}
+}
+
+func randomTest(r *rand.Rand, depth int) Test {
+	var test Test
+	switch n := r.Intn(10); {
+	case n == 0 && depth > 0:
+		test = Group(randomExprOf(r, depth-1))
+	case n == 1:
+		test = Has(Field("appProperties"), randomString(r), randomString(r))
+	default:
+		ops := []func(lhs, rhs Datum) Test{Eq, NotEq, Lt, Lte, Gt, Gte, Contains, In}
+		test = ops[r.Intn(len(ops))](randomDatum(r), randomDatum(r))
+	}
+	if r.Intn(4) == 0 {
+		test = Not(test)
+	}
+	return test
+}
+
+func randomExprOf(r *rand.Rand, depth int) Expr {
+	var exprs []Expr
+	for i := r.Intn(3); i >= 0; i-- {
+		var tests []Test
+		for j := r.Intn(3); j >= 0; j-- {
+			tests = append(tests, randomTest(r, depth))
+		}
+		exprs = append(exprs, All(tests...))
+	}
+	return Any(exprs...)
+}
+
+func (randomExpr) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(randomExpr{randomExprOf(r, 3)})
+}
+
+func TestBuildRoundTrip(t *testing.T) {
+	roundTrips := func(e randomExpr) bool {
+		parsed, err := NewParser(strings.NewReader(e.String())).Parse()
+		if err != nil {
+			t.Logf("%s: %v", e, err)
+			return false
+		}
+		return ExprEqual(*parsed, e.Expr)
+	}
+	if err := quick.Check(roundTrips, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildMatchesName(t *testing.T) {
+	// whatever the name, the query finds that file and no other
+	matchesOnlyName := func(name, other string) bool {
+		q := All(Eq(Field("name"), String(name)), Eq(Field("trashed"), Bool(false))).String()
+		matched, err := Match(q, File{Name: name})
+		if err != nil || !matched {
+			t.Logf("%s: %v %v", q, matched, err)
+			return false
+		}
+		matched, err = Match(q, File{Name: other})
+		return err == nil && matched == (name == other)
+	}
+	if err := quick.Check(matchesOnlyName, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,218 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// File is what a query can ask about a file
+type File struct {
+	Name          string
+	MimeType      string
+	Parents       []string
+	Trashed       bool
+	Starred       bool
+	CreatedTime   time.Time
+	ModifiedTime  time.Time
+	Properties    map[string]string
+	AppProperties map[string]string
+}
+
+// Match parses q and says whether f matches it
+func Match(q string, f File) (bool, error) {
+	expr, err := NewParser(strings.NewReader(q)).Parse()
+	if err != nil {
+		return false, err
+	}
+	return Eval(*expr, f)
+}
+
+// Eval says whether f matches expr, in the way that Drive would. Like
+// Drive, it fails for queries that don't make sense, such as comparing a
+// name with a date, whether or not f would have matched.
+func Eval(expr Expr, f File) (bool, error) {
+	// The whole of expr is evaluated, so that any error is found
+	result := false
+	for _, and := range expr.Ands {
+		conj := true
+		for _, test := range and.Tests {
+			var matched bool
+			var err error
+			if test.Op == LPAREN {
+				matched, err = Eval(*test.Sub, f)
+			} else {
+				matched, err = evalTest(test, f)
+			}
+			if err != nil {
+				return false, err
+			}
+			conj = conj && matched != test.Not
+		}
+		result = result || conj
+	}
+	return result, nil
+}
+
+func evalTest(test Test, f File) (bool, error) {
+	if test.Op == IN {
+		if test.Rhs.Type != IDENT || test.Rhs.Lit != "parents" {
+			return false, fmt.Errorf("Invalid Value: can't query by %s", test.Rhs.Lit)
+		}
+		if !isText(test.Lhs) {
+			return false, fmt.Errorf("Invalid Value: expected a string in parents, found %s", test.Lhs.Lit)
+		}
+		for _, parent := range f.Parents {
+			if parent == test.Lhs.Lit {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if test.Lhs.Type != IDENT {
+		return false, fmt.Errorf("Invalid Value: expected a field, found %s", test.Lhs.Lit)
+	}
+	switch field := test.Lhs.Lit; field {
+	case "name":
+		return compareText(field, test, f.Name, nameContains)
+	case "mimeType":
+		return compareText(field, test, f.MimeType, strings.Contains)
+	case "trashed":
+		return compareBool(field, test, f.Trashed)
+	case "starred":
+		return compareBool(field, test, f.Starred)
+	case "createdTime":
+		return compareTime(field, test, f.CreatedTime)
+	case "modifiedTime":
+		return compareTime(field, test, f.ModifiedTime)
+	case "properties":
+		return hasProperty(field, test, f.Properties)
+	case "appProperties":
+		return hasProperty(field, test, f.AppProperties)
+	}
+	return false, fmt.Errorf("Invalid Value: can't query by %s", test.Lhs.Lit)
+}
+
+// isText says whether d is a string. Strings that look like dates are
+// still strings.
+func isText(d Datum) bool {
+	return d.Type == STRING || d.Type == DATE
+}
+
+func badOperator(field string) error {
+	return fmt.Errorf("Invalid Value: can't use that operator with %s", field)
+}
+
+func badValue(field string, test Test) error {
+	return fmt.Errorf("Invalid Value: can't compare %s with %s", field, test.Rhs.Lit)
+}
+
+// compareText compares a string field using =, != or contains
+func compareText(
+	field string, test Test, value string, contains func(s, substr string) bool,
+) (bool, error) {
+	if !isText(test.Rhs) {
+		return false, badValue(field, test)
+	}
+	switch test.Op {
+	case EQUALS:
+		return value == test.Rhs.Lit, nil
+	case NOT_EQUALS:
+		return value != test.Rhs.Lit, nil
+	case CONTAINS:
+		return contains(value, test.Rhs.Lit), nil
+	}
+	return false, badOperator(field)
+}
+
+// nameContains says whether a word in name starts with substr, ignoring
+// case, which is what contains means for names in Drive: 'hello' is in
+// both "HelloWorld.txt" and "Hello world.txt", but 'world' is only in the
+// latter.
+func nameContains(name, substr string) bool {
+	name, substr = strings.ToLower(name), strings.ToLower(substr)
+	runes := []rune(name)
+	for i := range runes {
+		startsWord := i == 0 || !isWordRune(runes[i-1])
+		if startsWord && strings.HasPrefix(string(runes[i:]), substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func compareBool(field string, test Test, value bool) (bool, error) {
+	var rhs bool
+	switch test.Rhs.Type {
+	case TRUE:
+		rhs = true
+	case FALSE:
+		rhs = false
+	default:
+		return false, badValue(field, test)
+	}
+	switch test.Op {
+	case EQUALS:
+		return value == rhs, nil
+	case NOT_EQUALS:
+		return value != rhs, nil
+	}
+	return false, badOperator(field)
+}
+
+func compareTime(field string, test Test, value time.Time) (bool, error) {
+	if test.Rhs.Type != DATE {
+		return false, badValue(field, test)
+	}
+	rhs, err := ParseDate(test.Rhs.Lit)
+	if err != nil {
+		return false, badValue(field, test)
+	}
+	switch test.Op {
+	case EQUALS:
+		return value.Equal(rhs), nil
+	case NOT_EQUALS:
+		return !value.Equal(rhs), nil
+	case LT:
+		return value.Before(rhs), nil
+	case LTE:
+		return !value.After(rhs), nil
+	case GT:
+		return value.After(rhs), nil
+	case GTE:
+		return !value.Before(rhs), nil
+	}
+	return false, badOperator(field)
+}
+
+// hasProperty evaluates field has { key = 'k' and value = 'v' }, which
+// matches if any one property matches what is in the braces
+func hasProperty(field string, test Test, properties map[string]string) (bool, error) {
+	if test.Op != HAS {
+		return false, badOperator(field)
+	}
+	malformed := fmt.Errorf("Invalid Value: expected %s has { key = 'k' and value = 'v' }", field)
+	if len(test.Sub.Ands) != 1 || len(test.Sub.Ands[0].Tests) != 2 {
+		return false, malformed
+	}
+	given := map[string]string{}
+	for _, t := range test.Sub.Ands[0].Tests {
+		if t.Not || t.Op != EQUALS || t.Lhs.Type != IDENT || !isText(t.Rhs) {
+			return false, malformed
+		}
+		given[t.Lhs.Lit] = t.Rhs.Lit
+	}
+	key, hasKey := given["key"]
+	value, hasValue := given["value"]
+	if !hasKey || !hasValue {
+		return false, malformed
+	}
+	actual, ok := properties[key]
+	return ok && actual == value, nil
+}
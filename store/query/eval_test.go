@@ -0,0 +1,70 @@
+package query
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	f := File{
+		Name:          "Hello world.txt",
+		MimeType:      "text/plain",
+		Parents:       []string{"root", "abc"},
+		CreatedTime:   time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC),
+		ModifiedTime:  time.Date(2019, 1, 2, 12, 0, 0, 0, time.UTC),
+		AppProperties: map[string]string{"ref": "master"},
+	}
+
+	for q, expected := range map[string]bool{
+		"name = 'Hello world.txt'":                               true,
+		"name = 'hello world.txt'":                               false,
+		"name != 'Hello world.txt'":                              false,
+		"name contains 'WOR'":                                    true,
+		"name contains 'orld'":                                   false,
+		"name contains 'hello world'":                            true,
+		"mimeType contains 'plain'":                              true,
+		"'abc' in parents":                                       true,
+		"not 'def' in parents":                                   true,
+		"trashed = false and starred != true":                    true,
+		"trashed = true or name = 'x'":                           false,
+		"trashed = true or not (name = 'x')":                     true,
+		"createdTime = '2019-01-01T00:00:00Z'":                   true,
+		"modifiedTime > '2019-01-02T12:00:00'":                   false,
+		"modifiedTime >= '2019-01-02T12:00:00'":                  true,
+		"modifiedTime < '2019-01-02T13:00:00+01:00'":             false,
+		"modifiedTime <= '2019-01-03'":                           true,
+		"appProperties has { key = 'ref' and value = 'master' }": true,
+		"appProperties has { value = 'master' and key = 'ref' }": true,
+		"appProperties has { key = 'ref' and value = 'other' }":  false,
+		"properties has { key = 'ref' and value = 'master' }":    false,
+	} {
+		matched, err := Match(q, f)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", q, err)
+		} else if matched != expected {
+			t.Errorf("%s: expected: %v, actual: %v", q, expected, matched)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, q := range []string{
+		"size = 1",
+		"name = true",
+		"name > 'a'",
+		"trashed = 'false'",
+		"trashed contains false",
+		"modifiedTime > 'yesterday'",
+		"'root' in name",
+		"true in parents",
+		"appProperties = 'ref'",
+		"appProperties has { key = 'ref' }",
+		"appProperties has { key = 'ref' or value = 'master' }",
+		// errors are found even when what comes before decides the result
+		"trashed = false or size = 1",
+	} {
+		if _, err := Match(q, File{}); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
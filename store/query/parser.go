@@ -9,7 +9,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Token int
@@ -25,24 +27,36 @@ const (
 	STRING
 	TRUE
 	FALSE
+	NUMBER
+	DATE // a string in RFC 3339 format, such as '2012-06-04T12:00:00'
 	endDataTokens
 
 	// Operators
 	beginOperatorTokens
 	EQUALS
+	NOT_EQUALS
+	LT
+	LTE
+	GT
+	GTE
 	IN       // list contains equal item
 	CONTAINS // text contains substring
+	HAS      // properties has { key = 'k' and value = 'v' }
 	endOperatorTokens
-	// The actual language has a lot more operators, but we don't need them
-	// for our tests, so they are omitted
 
 	// Keywords
 	AND
 	OR
 	NOT
+
+	// Brackets
+	LPAREN
+	RPAREN
+	LBRACE
+	RBRACE
 )
 
-var eof = rune(0)
+var eof = rune(-1)
 
 func isWhitespace(ch rune) bool {
 	return ch == ' ' || ch == '\t' || ch == '\n'
@@ -83,6 +97,9 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	} else if isLetter(ch) {
 		s.unread()
 		return s.scanIdent()
+	} else if isDigit(ch) || ch == '-' {
+		s.unread()
+		return s.scanNumber()
 	} else if ch == '\'' {
 		s.unread()
 		return s.scanString()
@@ -93,6 +110,31 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 		return EOF, ""
 	case '=':
 		return EQUALS, string(ch)
+	case '!':
+		if next := s.read(); next == '=' {
+			return NOT_EQUALS, "!="
+		}
+		s.unread()
+	case '<':
+		if next := s.read(); next == '=' {
+			return LTE, "<="
+		}
+		s.unread()
+		return LT, string(ch)
+	case '>':
+		if next := s.read(); next == '=' {
+			return GTE, ">="
+		}
+		s.unread()
+		return GT, string(ch)
+	case '(':
+		return LPAREN, string(ch)
+	case ')':
+		return RPAREN, string(ch)
+	case '{':
+		return LBRACE, string(ch)
+	case '}':
+		return RBRACE, string(ch)
 	}
 
 	return ILLEGAL, string(ch)
@@ -123,7 +165,7 @@ func (s *Scanner) scanIdent() (tok Token, lit string) {
 	for {
 		if ch := s.read(); ch == eof {
 			break
-		} else if !isLetter(ch) && !isDigit(ch) && ch != '_' {
+		} else if !isLetter(ch) && !isDigit(ch) && ch != '_' && ch != '.' {
 			s.unread()
 			break
 		} else {
@@ -140,6 +182,10 @@ func (s *Scanner) scanIdent() (tok Token, lit string) {
 		return OR, buf.String()
 	case "not":
 		return NOT, buf.String()
+	case "contains":
+		return CONTAINS, buf.String()
+	case "has":
+		return HAS, buf.String()
 	case "true":
 		return TRUE, buf.String()
 	case "false":
@@ -148,6 +194,35 @@ func (s *Scanner) scanIdent() (tok Token, lit string) {
 	return IDENT, buf.String()
 }
 
+// scanNumber scans an integer or decimal, which may be negative
+func (s *Scanner) scanNumber() (tok Token, lit string) {
+	var buf bytes.Buffer
+	buf.WriteRune(s.read())
+
+	seenPoint := false
+	for {
+		if ch := s.read(); ch == eof {
+			break
+		} else if ch == '.' && !seenPoint {
+			seenPoint = true
+			buf.WriteRune(ch)
+		} else if !isDigit(ch) {
+			s.unread()
+			break
+		} else {
+			buf.WriteRune(ch)
+		}
+	}
+
+	lit = buf.String()
+	if _, err := strconv.ParseFloat(lit, 64); err != nil {
+		return ILLEGAL, lit
+	}
+	return NUMBER, lit
+}
+
+// scanString scans a quoted string, in which quotes and backslashes are
+// escaped with a backslash. Strings that are dates are DATE tokens.
 func (s *Scanner) scanString() (tok Token, lit string) {
 	var buf bytes.Buffer
 	// skip '
@@ -155,8 +230,8 @@ func (s *Scanner) scanString() (tok Token, lit string) {
 
 	for {
 		if ch := s.read(); ch == eof {
-			// should be an error
-			break
+			// never closed
+			return ILLEGAL, string(strStart) + buf.String()
 		} else if ch == '\\' {
 			ch = s.read()
 			switch ch {
@@ -180,9 +255,40 @@ func (s *Scanner) scanString() (tok Token, lit string) {
 			buf.WriteRune(ch)
 		}
 	}
+	if IsDate(buf.String()) {
+		return DATE, buf.String()
+	}
 	return STRING, buf.String()
 }
 
+// dateFormats are the forms of RFC 3339 that Drive accepts. The time zone
+// defaults to UTC.
+var dateFormats = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseDate parses a date in one of the forms of RFC 3339 Drive accepts
+func ParseDate(lit string) (time.Time, error) {
+	var err error
+	for _, format := range dateFormats {
+		var t time.Time
+		if t, err = time.Parse(format, lit); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// IsDate says whether lit is a date in a form that Drive accepts
+func IsDate(lit string) bool {
+	_, err := ParseDate(lit)
+	return err == nil
+}
+
 type Parser struct {
 	s   *Scanner
 	buf struct {
@@ -219,19 +325,28 @@ func (p *Parser) nextTok() (tok Token, lit string) {
 	return
 }
 
+// Expr is a disjunction of conjunctions: Ands joined by or
 type Expr struct {
 	Ands []And
 }
+
+// And is Tests joined by and
 type And struct {
 	Tests []Test
 }
+
+// Test is a single comparison, such as name = 'x', negated if Not is set.
+// A bracketed expression is a Test with Op LPAREN, and the expression in
+// Sub. For HAS, Sub is what is in the braces.
 type Test struct {
+	Not bool
 	Lhs Datum
-	Op  Token // IN, EQUALS
+	Op  Token // IN, EQUALS, LT, ..., HAS or LPAREN
 	Rhs Datum
+	Sub *Expr
 }
 type Datum struct {
-	Type Token  // STRING, IDENT, TRUE, FALSE, NUMBER
+	Type Token  // STRING, IDENT, TRUE, FALSE, NUMBER, DATE
 	Lit  string // true, false
 }
 
@@ -251,24 +366,47 @@ func AndEqual(a1, a2 And) bool {
 		return false
 	}
 	for i, test := range a1.Tests {
-		if test != a2.Tests[i] {
+		if !TestEqual(test, a2.Tests[i]) {
 			return false
 		}
 	}
 	return true
 }
+func TestEqual(t1, t2 Test) bool {
+	if t1.Not != t2.Not || t1.Lhs != t2.Lhs || t1.Op != t2.Op || t1.Rhs != t2.Rhs {
+		return false
+	}
+	if t1.Sub == nil || t2.Sub == nil {
+		return t1.Sub == t2.Sub
+	}
+	return ExprEqual(*t1.Sub, *t2.Sub)
+}
 
 /*
 
 expr ::= conj (OR conj)*
 conj ::= test (AND test)*
-test ::= datum operator datum
-datum ::= ident | string | bool
-operator ::= 'in' | '='
+test ::= NOT test | '(' expr ')' | ident HAS '{' expr '}' | datum operator datum
+datum ::= ident | string | bool | number | date
+operator ::= 'in' | 'contains' | '=' | '!=' | '<' | '<=' | '>' | '>='
 
 */
 
+// Parse parses a whole query
 func (p *Parser) Parse() (*Expr, error) {
+	expr, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.nextTok(); tok != EOF {
+		return nil, fmt.Errorf(
+			"Error parsing expression\n  Expected: and, or or the end\n  Found: %v\n", lit)
+	}
+	return expr, nil
+}
+
+// ParseExpr parses conjunctions joined by or, up to whatever follows them
+func (p *Parser) ParseExpr() (*Expr, error) {
 
 	conjunctions := []And{}
 	conj, err := p.ParseConjuction()
@@ -278,13 +416,10 @@ func (p *Parser) Parse() (*Expr, error) {
 	conjunctions = append(conjunctions, conj)
 
 	for {
-		tok, lit := p.nextTok()
-		if tok == ILLEGAL || tok == EOF {
-			break
-		}
+		tok, _ := p.nextTok()
 		if tok != OR {
-			return nil, fmt.Errorf(
-				"Error parsing expression\n  Expected: or\n  Found: %v\n", lit)
+			p.unscan()
+			break
 		}
 
 		conj, err := p.ParseConjuction()
@@ -306,13 +441,10 @@ func (p *Parser) ParseConjuction() (And, error) {
 	tests = append(tests, test)
 
 	for {
-		tok, lit := p.nextTok()
-		if tok == ILLEGAL || tok == EOF {
-			break
-		}
+		tok, _ := p.nextTok()
 		if tok != AND {
-			return And{}, fmt.Errorf(
-				"Error parsing conjuction\n  Expected: and\n  Found: %v\n", lit)
+			p.unscan()
+			break
 		}
 
 		test, err := p.ParseTest()
@@ -327,6 +459,21 @@ func (p *Parser) ParseConjuction() (And, error) {
 
 func (p *Parser) ParseTest() (Test, error) {
 
+	switch tok, _ := p.nextTok(); tok {
+	case NOT:
+		test, err := p.ParseTest()
+		test.Not = !test.Not
+		return test, err
+	case LPAREN:
+		sub, err := p.parseBracketed(RPAREN, ")")
+		if err != nil {
+			return Test{}, err
+		}
+		return Test{Op: LPAREN, Sub: sub}, nil
+	default:
+		p.unscan()
+	}
+
 	lhs, err := p.ParseDatum()
 	if err != nil {
 		return Test{}, err
@@ -335,6 +482,17 @@ func (p *Parser) ParseTest() (Test, error) {
 	if err != nil {
 		return Test{}, err
 	}
+	if op == HAS {
+		if tok, lit := p.nextTok(); tok != LBRACE {
+			return Test{}, fmt.Errorf(
+				"Error parsing has\n  Expected: {\n  Found: %v\n", lit)
+		}
+		sub, err := p.parseBracketed(RBRACE, "}")
+		if err != nil {
+			return Test{}, err
+		}
+		return Test{Lhs: lhs, Op: op, Sub: sub}, nil
+	}
 	rhs, err := p.ParseDatum()
 	if err != nil {
 		return Test{}, err
@@ -347,13 +505,26 @@ func (p *Parser) ParseTest() (Test, error) {
 	}, nil
 }
 
+// parseBracketed parses an expression up to the closing bracket
+func (p *Parser) parseBracketed(closing Token, closingLit string) (*Expr, error) {
+	sub, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok, lit := p.nextTok(); tok != closing {
+		return nil, fmt.Errorf(
+			"Error parsing brackets\n  Expected: %s\n  Found: %v\n", closingLit, lit)
+	}
+	return sub, nil
+}
+
 func (p *Parser) ParseDatum() (Datum, error) {
 	tok, lit := p.nextTok()
 
 	if tok < beginDataTokens || tok > endDataTokens {
 		return Datum{}, fmt.Errorf(
 			"Error parsing datum\n"+
-				"  Expected: <string> or <ident> or 'true' or 'false'\n"+
+				"  Expected: <string> or <ident> or <number> or 'true' or 'false'\n"+
 				"  Found: %v\n", lit)
 	}
 
@@ -364,7 +535,7 @@ func (p *Parser) ParseOperator() (tok Token, err error) {
 	if tok < beginOperatorTokens || tok > endOperatorTokens {
 		err = fmt.Errorf(
 			"Error parsing operator\n"+
-				"  Expected: 'in', 'contains' or '='\n"+
+				"  Expected: 'in', 'contains', 'has', '=', '!=', '<', '<=', '>' or '>='\n"+
 				"  Found: %v\n",
 			lit,
 		)
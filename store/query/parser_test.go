@@ -46,3 +46,65 @@ func TestParse(t *testing.T) {
 		)
 	}
 }
+
+func TestParseQueries(t *testing.T) {
+	name := Test{Lhs: Datum{IDENT, "name"}, Op: EQUALS, Rhs: Datum{STRING, "a"}}
+	trashed := Test{Lhs: Datum{IDENT, "trashed"}, Op: EQUALS, Rhs: Datum{FALSE, "false"}}
+
+	for query, expected := range map[string]Expr{
+		"name = 'a' or trashed = false": {Ands: []And{
+			{Tests: []Test{name}},
+			{Tests: []Test{trashed}},
+		}},
+		"not name = 'a' and (name = 'a' or trashed = false)": {Ands: []And{
+			{Tests: []Test{
+				{Not: true, Lhs: name.Lhs, Op: EQUALS, Rhs: name.Rhs},
+				{Op: LPAREN, Sub: &Expr{Ands: []And{
+					{Tests: []Test{name}},
+					{Tests: []Test{trashed}},
+				}}},
+			}},
+		}},
+		"mimeType != 'application/vnd.google-apps.folder'": {Ands: []And{{Tests: []Test{
+			{Lhs: Datum{IDENT, "mimeType"}, Op: NOT_EQUALS, Rhs: Datum{STRING, "application/vnd.google-apps.folder"}},
+		}}}},
+		"modifiedTime > '2012-06-04T12:00:00' and quotaBytesUsed <= 1.5": {Ands: []And{{Tests: []Test{
+			{Lhs: Datum{IDENT, "modifiedTime"}, Op: GT, Rhs: Datum{DATE, "2012-06-04T12:00:00"}},
+			{Lhs: Datum{IDENT, "quotaBytesUsed"}, Op: LTE, Rhs: Datum{NUMBER, "1.5"}},
+		}}}},
+		`name contains 'it\'s a \\ test'`: {Ands: []And{{Tests: []Test{
+			{Lhs: Datum{IDENT, "name"}, Op: CONTAINS, Rhs: Datum{STRING, `it's a \ test`}},
+		}}}},
+		"appProperties has { key = 'ref' and value = 'master' }": {Ands: []And{{Tests: []Test{
+			{Lhs: Datum{IDENT, "appProperties"}, Op: HAS, Sub: &Expr{Ands: []And{{Tests: []Test{
+				{Lhs: Datum{IDENT, "key"}, Op: EQUALS, Rhs: Datum{STRING, "ref"}},
+				{Lhs: Datum{IDENT, "value"}, Op: EQUALS, Rhs: Datum{STRING, "master"}},
+			}}}}},
+		}}}},
+	} {
+		expr, err := NewParser(strings.NewReader(query)).Parse()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", query, err)
+		} else if !ExprEqual(*expr, expected) {
+			t.Errorf("%s\nExpected: %v\n  Actual: %v", query, expected, *expr)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"name = 'a' and",
+		"name = 'a",
+		"(name = 'a'",
+		"name = 'a')",
+		"name 'a'",
+		"name ! 'a'",
+		"appProperties has key = 'a'",
+		"name = 'a' trashed = false",
+	} {
+		if _, err := NewParser(strings.NewReader(query)).Parse(); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
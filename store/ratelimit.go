@@ -0,0 +1,97 @@
+package store
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
+// rateLimiter is a token bucket shared by all the requests a client makes,
+// from however many goroutines. Optionally it also has a budget, which is
+// the total number of requests allowed.
+type rateLimiter struct {
+	mu sync.Mutex
+	// tokens are added at rate per second, up to burst
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// budget is the number of requests left, or -1 for no limit
+	budget int64
+	// now and sleep can be replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newRateLimiter makes a limiter allowing perSecond requests a second, with
+// bursts of up to burst requests. A budget of 0 means no limit.
+func newRateLimiter(perSecond float64, burst int, budget int64) *rateLimiter {
+	if budget <= 0 {
+		budget = -1
+	}
+	return &rateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		budget: budget,
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// wait blocks until a request may be made, or returns ErrQuotaExhausted if
+// the budget has run out
+func (l *rateLimiter) wait() error {
+	l.mu.Lock()
+	if l.budget == 0 {
+		l.mu.Unlock()
+		return errors.ErrQuotaExhausted
+	}
+	if l.budget > 0 {
+		l.budget--
+	}
+	var delay time.Duration
+	if l.rate > 0 {
+		now := l.now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		// Take the token now, even if it's not there yet, so that those
+		// waiting are served in turn
+		l.tokens--
+		if l.tokens < 0 {
+			delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+	return nil
+}
+
+// limitedTransport makes every HTTP request, including retries and
+// downloads, wait for the limiter
+type limitedTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	var slept time.Duration
+	l := newRateLimiter(2, 3, 0)
+	l.last = now
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) { slept += d; now = now.Add(d) }
+
+	// the burst is free
+	for i := 0; i < 3; i++ {
+		if err := l.wait(); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if slept != 0 {
+		t.Error("expected no waiting during burst, actual:", slept)
+	}
+	// then 2 a second
+	for i := 0; i < 4; i++ {
+		if err := l.wait(); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	if slept != 2*time.Second {
+		t.Error("expected to wait 2s, actual:", slept)
+	}
+	// and the bucket fills up again
+	now = now.Add(time.Hour)
+	slept = 0
+	for i := 0; i < 3; i++ {
+		l.wait()
+	}
+	if slept != 0 {
+		t.Error("expected no waiting after a rest, actual:", slept)
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	limiter := newRateLimiter(0, 0, 2)
+	client := &http.Client{Transport: limitedTransport{nil, limiter}}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		resp.Body.Close()
+	}
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, errors.ErrQuotaExhausted) {
+		t.Fatal("expected quota to be exhausted, actual:", err)
+	}
+	if retryable, _ := classifyError(err); retryable {
+		t.Error("expected exhausted quota not to be retried")
+	}
+}
@@ -0,0 +1,326 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	builtinerrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	drive "google.golang.org/api/drive/v3"
+	googleapi "google.golang.org/api/googleapi"
+)
+
+const (
+	// files at least this big are uploaded with the resumable protocol
+	resumableThreshold = 8 << 20
+	// must be a multiple of 256KiB
+	defaultChunkSize = 8 << 20
+)
+
+// errSessionExpired means an upload session is no longer known to Drive,
+// so the upload has to start again
+var errSessionExpired = builtinerrors.New("upload session expired")
+
+// resumableUploader uploads large files using Drive's resumable upload
+// protocol, see https://developers.google.com/drive/api/guides/manage-uploads
+//
+// A session is started with the file's metadata, and Drive gives us a URI
+// to send the content to, a chunk at a time. After a failure we ask Drive
+// how much it has and carry on from there. The session URI is also saved
+// locally, so that if we give up, or are killed, running the same upload
+// again picks up where the last one left off.
+type resumableUploader struct {
+	client *http.Client
+	// e.g. https://www.googleapis.com/upload/drive/v3/files
+	uploadURL string
+	chunkSize int64
+	sessions  sessionStore
+	policy    retryPolicy
+}
+
+// uploadURL works out the upload endpoint from the base path of the API,
+// e.g. https://www.googleapis.com/drive/v3/
+func uploadURL(basePath string) string {
+	return strings.Replace(basePath, "/drive/v3/", "/upload/drive/v3/", 1) + "files"
+}
+
+// seekableContent is content that can be sent more than once, such as an
+// *os.File
+type seekableContent interface {
+	io.ReaderAt
+	io.Seeker
+}
+
+// wants decides whether to use the resumable protocol for contents,
+// returning the part of it yet to be read if so
+func (u *resumableUploader) wants(contents io.Reader) (*io.SectionReader, bool) {
+	if u == nil {
+		return nil, false
+	}
+	r, ok := contents.(seekableContent)
+	if !ok {
+		return nil, false
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil || end-start < resumableThreshold {
+		return nil, false
+	}
+	return io.NewSectionReader(r, start, end-start), true
+}
+
+// upload creates file with the given content
+func (u *resumableUploader) upload(file *drive.File, content *io.SectionReader) (*drive.File, error) {
+	size := content.Size()
+	metadata, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := sessionKey(metadata, content)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	uri, resuming := u.sessions.load(key)
+	if resuming {
+		var result *drive.File
+		err := u.policy.do(func(int) error {
+			var err error
+			offset, result, err = u.status(uri, size)
+			return err
+		})
+		if result != nil {
+			u.sessions.remove(key)
+			return result, nil
+		}
+		if err == errSessionExpired {
+			resuming = false
+		} else if err != nil {
+			return nil, err
+		} else {
+			log.Printf("resuming upload of %s at %d of %d bytes", file.Name, offset, size)
+		}
+	}
+	if !resuming {
+		if err := u.policy.do(func(int) error {
+			var err error
+			uri, err = u.start(metadata, size)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if err := u.sessions.save(key, uri); err != nil {
+			log.Println("warning: unable to save upload session:", err)
+		}
+		offset = 0
+	}
+
+	failures := 0
+	for {
+		next, result, err := u.sendChunk(uri, content, offset, size)
+		if err == nil {
+			if result != nil {
+				u.sessions.remove(key)
+				return result, nil
+			}
+			log.Printf("uploaded %d of %d bytes of %s", next, size, file.Name)
+			offset, failures = next, 0
+			continue
+		}
+		retryable, retryAfter := classifyError(err)
+		failures++
+		if !retryable || failures >= u.policy.maxAttempts {
+			// the session is kept for next time
+			return nil, err
+		}
+		delay := u.policy.backoff(failures - 1)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		log.Printf("retrying upload of %s in %v: %v", file.Name, delay, err)
+		u.policy.sleep(delay)
+
+		// find out how much arrived before carrying on
+		err = u.policy.do(func(int) error {
+			var err error
+			next, result, err = u.status(uri, size)
+			return err
+		})
+		if err == errSessionExpired {
+			u.sessions.remove(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			u.sessions.remove(key)
+			return result, nil
+		}
+		offset = next
+	}
+}
+
+// sessionKey identifies an upload: the same file, with the same content, in
+// the same place
+func sessionKey(metadata []byte, content *io.SectionReader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(content, 0, content.Size())); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(append(metadata, h.Sum(nil)...))), nil
+}
+
+// start begins an upload session, returning its URI
+func (u *resumableUploader) start(metadata []byte, size int64) (string, error) {
+	req, err := http.NewRequest("POST", u.uploadURL+"?uploadType=resumable&fields=id,name",
+		bytes.NewReader(metadata))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", err
+	}
+	uri := resp.Header.Get("Location")
+	if uri == "" {
+		return "", fmt.Errorf("no upload session URI in response")
+	}
+	return uri, nil
+}
+
+// sendChunk sends the chunk of content starting at offset. It returns the
+// offset to carry on from, or, once the upload is complete, the file.
+func (u *resumableUploader) sendChunk(uri string, content *io.SectionReader, offset, size int64) (int64, *drive.File, error) {
+	end := offset + u.chunkSize
+	if end > size {
+		end = size
+	}
+	req, err := http.NewRequest("PUT", uri, io.NewSectionReader(content, offset, end-offset))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.ContentLength = end - offset
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+	return u.progress(req)
+}
+
+// status asks how much of the upload Drive has received
+func (u *resumableUploader) status(uri string, size int64) (int64, *drive.File, error) {
+	req, err := http.NewRequest("PUT", uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	return u.progress(req)
+}
+
+// progress makes a request to an upload session and interprets the reply
+func (u *resumableUploader) progress(req *http.Request) (int64, *drive.File, error) {
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var file drive.File
+		if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+			return 0, nil, fmt.Errorf("reading uploaded file: %v", err)
+		}
+		return 0, &file, nil
+	case http.StatusPermanentRedirect:
+		// "308 Resume Incomplete", with the bytes received so far in the
+		// Range header, e.g. bytes=0-8388607, if there are any
+		io.Copy(ioutil.Discard, resp.Body)
+		received := strings.TrimPrefix(resp.Header.Get("Range"), "bytes=0-")
+		if received == "" {
+			return 0, nil, nil
+		}
+		last, err := strconv.ParseInt(received, 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid Range in upload response: %q", resp.Header.Get("Range"))
+		}
+		return last + 1, nil, nil
+	case http.StatusNotFound, http.StatusGone:
+		return 0, nil, errSessionExpired
+	}
+	return 0, nil, googleapi.CheckResponse(resp)
+}
+
+// sessionStore keeps the URIs of unfinished upload sessions in files in a
+// directory, so that they outlive the process
+type sessionStore struct {
+	dir string
+}
+
+// defaultSessionStore keeps sessions in the user's cache directory, or,
+// failing that, nowhere
+func defaultSessionStore() sessionStore {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return sessionStore{}
+	}
+	return sessionStore{filepath.Join(cacheDir, "git-remote-drive", "uploads")}
+}
+
+func (s sessionStore) load(key string) (string, bool) {
+	if s.dir == "" {
+		return "", false
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, key))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
+
+func (s sessionStore) save(key, uri string) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, "tmp_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(uri + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, key))
+}
+
+func (s sessionStore) remove(key string) {
+	if s.dir != "" {
+		os.Remove(filepath.Join(s.dir, key))
+	}
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v3"
+)
+
+// uploadServer implements enough of the resumable upload protocol to test
+// against. failPuts makes the next so many chunks fail with a 503.
+type uploadServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	sessions map[string][]byte
+	names    map[string]string
+	starts   int
+	sent     int64 // bytes of content received, including duplicates
+	failPuts int
+	done     map[string][]byte // file name to content
+}
+
+func newUploadServer() *uploadServer {
+	s := &uploadServer{
+		sessions: map[string][]byte{},
+		names:    map[string]string{},
+		done:     map[string][]byte{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *uploadServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == "POST" {
+		if r.URL.Query().Get("uploadType") != "resumable" {
+			http.Error(w, "expected a resumable upload", http.StatusBadRequest)
+			return
+		}
+		var file drive.File
+		if err := json.NewDecoder(r.Body).Decode(&file); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.starts++
+		id := fmt.Sprintf("session-%d", s.starts)
+		s.sessions[id] = []byte{}
+		s.names[id] = file.Name
+		w.Header().Set("Location", s.URL+"/"+id)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/")
+	received, ok := s.sessions[id]
+	if !ok {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	var start, end, size int64
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes */%d", &size); err == nil {
+		// a status query
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		if s.failPuts > 0 {
+			s.failPuts--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		if start != int64(len(received)) {
+			http.Error(w, "chunk out of order", http.StatusBadRequest)
+			return
+		}
+		chunk, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(chunk)) != end-start+1 {
+			http.Error(w, "bad chunk", http.StatusBadRequest)
+			return
+		}
+		s.sent += int64(len(chunk))
+		received = append(received, chunk...)
+		s.sessions[id] = received
+	} else {
+		http.Error(w, "bad Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(received)) == size {
+		s.done[s.names[id]] = received
+		delete(s.sessions, id)
+		json.NewEncoder(w).Encode(drive.File{Id: "id-" + id, Name: s.names[id]})
+		return
+	}
+	if len(received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(received)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func newTestUploader(s *uploadServer, sessionDir string, delays *[]time.Duration) *resumableUploader {
+	return &resumableUploader{
+		client:    s.Client(),
+		uploadURL: s.URL + "/upload/drive/v3/files",
+		chunkSize: 256 << 10,
+		sessions:  sessionStore{sessionDir},
+		policy:    testRetryPolicy(delays),
+	}
+}
+
+func randomContent(size int) *io.SectionReader {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return io.NewSectionReader(bytes.NewReader(content), 0, int64(size))
+}
+
+func readAllSection(t *testing.T, r *io.SectionReader) []byte {
+	b, err := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUploadURL(t *testing.T) {
+	actual := uploadURL("https://www.googleapis.com/drive/v3/")
+	expected := "https://www.googleapis.com/upload/drive/v3/files"
+	if actual != expected {
+		t.Errorf("expected: %s, actual: %s", expected, actual)
+	}
+}
+
+func TestResumableWants(t *testing.T) {
+	u := &resumableUploader{}
+
+	big := bytes.NewReader(make([]byte, resumableThreshold+10))
+	big.Seek(10, io.SeekStart)
+	content, ok := u.wants(big)
+	if !ok || content.Size() != resumableThreshold {
+		t.Errorf("expected the rest of a big reader to be wanted, was %v", ok)
+	}
+	if _, ok := u.wants(bytes.NewReader(make([]byte, 100))); ok {
+		t.Error("did not expect a small reader to be wanted")
+	}
+	if _, ok := u.wants(strings.NewReader("not seekable")); ok {
+		t.Error("did not expect a stream to be wanted")
+	}
+	var none *resumableUploader
+	if _, ok := none.wants(big); ok {
+		t.Error("did not expect a nil uploader to want anything")
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := newUploadServer()
+	defer s.Close()
+	var delays []time.Duration
+	u := newTestUploader(s, t.TempDir(), &delays)
+
+	// a short last chunk, and one failure on the way
+	content := randomContent(3<<18 + 100)
+	s.failPuts = 1
+	result, err := u.upload(&drive.File{Name: "pack-1.pack"}, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Id != "id-session-1" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if !bytes.Equal(s.done["pack-1.pack"], readAllSection(t, content)) {
+		t.Error("uploaded content differs")
+	}
+	if s.sent != content.Size() {
+		t.Errorf("expected each byte sent once, sent %d of %d", s.sent, content.Size())
+	}
+	if len(delays) != 1 {
+		t.Errorf("expected one retry, delays: %v", delays)
+	}
+	if files, _ := ioutil.ReadDir(u.sessions.dir); len(files) != 0 {
+		t.Errorf("expected the session to be forgotten, found %d", len(files))
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	s := newUploadServer()
+	defer s.Close()
+	sessionDir := t.TempDir()
+	var delays []time.Duration
+	content := randomContent(4 << 18)
+	file := drive.File{Name: "pack-2.pack", Parents: []string{"packdir"}}
+
+	// The first push gets two chunks through and then gives up
+	first := newTestUploader(s, sessionDir, &delays)
+	first.chunkSize = 1 << 18
+	sendTwo := &limitedRoundTripper{base: s.Client().Transport, puts: 2}
+	first.client = &http.Client{Transport: sendTwo}
+	if _, err := first.upload(&file, content); err == nil {
+		t.Fatal("expected the first upload to fail")
+	}
+	if s.sent != 2<<18 {
+		t.Fatalf("expected two chunks to arrive, was %d bytes", s.sent)
+	}
+
+	// The next one carries on
+	second := newTestUploader(s, sessionDir, &delays)
+	result, err := second.upload(&file, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Id != "id-session-1" || s.starts != 1 {
+		t.Errorf("expected the first session to be resumed, result: %+v, starts: %d",
+			result, s.starts)
+	}
+	if s.sent != content.Size() {
+		t.Errorf("expected each byte sent once, sent %d of %d", s.sent, content.Size())
+	}
+	if !bytes.Equal(s.done["pack-2.pack"], readAllSection(t, content)) {
+		t.Error("uploaded content differs")
+	}
+}
+
+func TestExpiredSession(t *testing.T) {
+	s := newUploadServer()
+	defer s.Close()
+	sessionDir := t.TempDir()
+	var delays []time.Duration
+	content := randomContent(2 << 18)
+	file := drive.File{Name: "pack-3.pack"}
+
+	u := newTestUploader(s, sessionDir, &delays)
+	uri, err := u.start([]byte(`{"name":"pack-3.pack"}`), content.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drive has forgotten about it
+	s.mu.Lock()
+	delete(s.sessions, strings.TrimPrefix(uri, s.URL+"/"))
+	s.mu.Unlock()
+	// as if saved by an earlier attempt at the same upload
+	metadata, _ := json.Marshal(&file)
+	key, err := sessionKey(metadata, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.sessions.save(key, uri); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := u.upload(&file, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Id != "id-session-2" {
+		t.Errorf("expected a new session, result: %+v", result)
+	}
+	if !bytes.Equal(s.done["pack-3.pack"], readAllSection(t, content)) {
+		t.Error("uploaded content differs")
+	}
+}
+
+// limitedRoundTripper lets through a number of chunk uploads and then fails
+// as though the network had gone away
+type limitedRoundTripper struct {
+	base http.RoundTripper
+	puts int
+}
+
+func (rt *limitedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "PUT" && !strings.HasPrefix(req.Header.Get("Content-Range"), "bytes */") {
+		if rt.puts == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rt.puts--
+	}
+	return rt.base.RoundTrip(req)
+}
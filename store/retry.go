@@ -0,0 +1,570 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	builtinerrors "errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	drive "google.golang.org/api/drive/v3"
+	googleapi "google.golang.org/api/googleapi"
+
+	"github.com/cakemanny/git-remote-drive/errors"
+)
+
+// retryPolicy decides how many times to try a request, and how long to wait
+// between attempts
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	// sleep and jitter can be replaced in tests
+	sleep  func(time.Duration)
+	jitter func(time.Duration) time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts: 8,
+	baseDelay:   500 * time.Millisecond,
+	maxDelay:    time.Minute,
+	sleep:       time.Sleep,
+	// "full jitter", so that goroutines which failed together don't all
+	// come back together
+	jitter: func(d time.Duration) time.Duration {
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	},
+}
+
+// do calls attempt until it succeeds, fails in a way that isn't worth
+// retrying or we run out of attempts. attempt is given the number of the
+// attempt, starting from 0.
+func (p retryPolicy) do(attempt func(n int) error) error {
+	for n := 0; ; n++ {
+		err := attempt(n)
+		if err == nil {
+			return nil
+		}
+		retryable, retryAfter := classifyError(err)
+		if !retryable || n+1 >= p.maxAttempts {
+			return err
+		}
+		delay := p.backoff(n)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		log.Printf("retrying in %v: %v", delay, err)
+		p.sleep(delay)
+	}
+}
+
+// backoff is how long to wait after the nth attempt fails
+func (p retryPolicy) backoff(n int) time.Duration {
+	delay := p.maxDelay
+	if n < 30 {
+		if d := p.baseDelay << uint(n); d < delay {
+			delay = d
+		}
+	}
+	return p.jitter(delay)
+}
+
+// classifyError says whether a request which failed with err could succeed
+// if tried again and, if the server told us, how long to wait first
+func classifyError(err error) (retryable bool, retryAfter time.Duration) {
+	if builtinerrors.Is(err, context.Canceled) ||
+		builtinerrors.Is(err, context.DeadlineExceeded) ||
+		builtinerrors.Is(err, errors.ErrQuotaExhausted) {
+		return false, 0
+	}
+	var apiErr *googleapi.Error
+	if builtinerrors.As(err, &apiErr) {
+		retryAfter = parseRetryAfter(apiErr.Header.Get("Retry-After"))
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true, retryAfter
+		case http.StatusForbidden:
+			// Drive uses 403 for both rate limits and permissions
+			for _, item := range apiErr.Errors {
+				if item.Reason == "rateLimitExceeded" ||
+					item.Reason == "userRateLimitExceeded" {
+					return true, retryAfter
+				}
+			}
+		}
+		return false, 0
+	}
+	// The connection failed, perhaps after the request got through
+	var netErr net.Error
+	if builtinerrors.As(err, &netErr) || builtinerrors.Is(err, io.ErrUnexpectedEOF) {
+		return true, 0
+	}
+	return false, 0
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of
+// seconds or a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func isStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return builtinerrors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// retryingFilesService is a FilesService which retries requests that fail
+// because of rate limits, server errors or the connection dropping.
+//
+// Requests are rebuilt for each attempt from what was passed to the
+// builder methods, with any media kept in memory so it can be sent again.
+//
+// Creating a file isn't naturally idempotent: if the response is lost we
+// can't tell whether the file was created. So that a retry can't create a
+// second file, each new file is given an ID up front. Should an earlier
+// attempt have got through, the retry fails with 409 Conflict, which we take
+// as success.
+type retryingFilesService struct {
+	files  FilesService
+	policy retryPolicy
+	ids    *idPool
+}
+
+func newRetryingFilesService(files FilesService, policy retryPolicy) retryingFilesService {
+	svc := retryingFilesService{files: files, policy: policy}
+	svc.ids = &idPool{generate: func() ([]string, error) {
+		var ids []string
+		err := policy.do(func(int) error {
+			r, err := files.GenerateIds().Count(idPoolSize).Space(appDataFolder).Do()
+			if err == nil {
+				ids = r.Ids
+			}
+			return err
+		})
+		return ids, err
+	}}
+	return svc
+}
+
+// how many file IDs to ask for at a time
+const idPoolSize = 100
+
+// idPool hands out file IDs, asking Drive for more as they run out
+type idPool struct {
+	mu       sync.Mutex
+	ids      []string
+	generate func() ([]string, error)
+}
+
+func (p *idPool) next() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ids) == 0 {
+		ids, err := p.generate()
+		if err != nil {
+			return "", err
+		}
+		p.ids = ids
+	}
+	if len(p.ids) == 0 {
+		return "", builtinerrors.New("no file IDs generated")
+	}
+	id := p.ids[0]
+	p.ids = p.ids[1:]
+	return id, nil
+}
+
+// media is the content given to a builder's Media method, read in advance
+// so that it can be sent more than once
+type media struct {
+	content []byte
+	options []googleapi.MediaOption
+	err     error
+}
+
+func readMedia(r io.Reader, options []googleapi.MediaOption) *media {
+	content, err := ioutil.ReadAll(r)
+	return &media{content, options, err}
+}
+
+func appendFields(fields []googleapi.Field, s []googleapi.Field) []googleapi.Field {
+	return append(append([]googleapi.Field(nil), fields...), s...)
+}
+
+type retryingCopyCall struct {
+	svc    retryingFilesService
+	fileId string
+	file   drive.File
+	fields []googleapi.Field
+}
+
+type retryingCreateCall struct {
+	svc    retryingFilesService
+	file   drive.File
+	fields []googleapi.Field
+	media  *media
+}
+
+type retryingUpdateCall struct {
+	svc           retryingFilesService
+	fileId        string
+	file          *drive.File
+	fields        []googleapi.Field
+	media         *media
+	addParents    string
+	removeParents string
+}
+
+type retryingDeleteCall struct {
+	svc    retryingFilesService
+	fileId string
+}
+
+type retryingGenerateIdsCall struct {
+	svc   retryingFilesService
+	count int64
+	space string
+}
+
+type retryingGetCall struct {
+	svc    retryingFilesService
+	fileId string
+	fields []googleapi.Field
+}
+
+type retryingListCall struct {
+	svc       retryingFilesService
+	spaces    string
+	pageSize  int64
+	pageToken string
+	q         string
+	fields    []googleapi.Field
+}
+
+func (svc retryingFilesService) Copy(fileId string, file *drive.File) FilesCopyCall {
+	return retryingCopyCall{svc: svc, fileId: fileId, file: *file}
+}
+func (svc retryingFilesService) Create(file *drive.File) FilesCreateCall {
+	return retryingCreateCall{svc: svc, file: *file}
+}
+func (svc retryingFilesService) Update(fileId string, file *drive.File) FilesUpdateCall {
+	return retryingUpdateCall{svc: svc, fileId: fileId, file: file}
+}
+func (svc retryingFilesService) Delete(fileId string) FilesDeleteCall {
+	return retryingDeleteCall{svc, fileId}
+}
+func (svc retryingFilesService) GenerateIds() FilesGenerateIdsCall {
+	return retryingGenerateIdsCall{svc: svc}
+}
+func (svc retryingFilesService) Get(fileId string) FilesGetCall {
+	return retryingGetCall{svc: svc, fileId: fileId}
+}
+func (svc retryingFilesService) List() FilesListCall {
+	return retryingListCall{svc: svc}
+}
+
+func (call retryingCopyCall) Fields(s ...googleapi.Field) FilesCopyCall {
+	call.fields = appendFields(call.fields, s)
+	return call
+}
+func (call retryingCopyCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	// A copy is a new file, so like Create it is given its ID up front
+	file := call.file
+	if file.Id == "" {
+		id, err := call.svc.ids.next()
+		if err != nil {
+			return nil, err
+		}
+		file.Id = id
+	}
+	var result *drive.File
+	err := call.svc.policy.do(func(n int) error {
+		c := call.svc.files.Copy(call.fileId, &file)
+		if len(call.fields) > 0 {
+			c = c.Fields(call.fields...)
+		}
+		var err error
+		result, err = c.Do(opts...)
+		if n > 0 && isStatus(err, http.StatusConflict) {
+			log.Printf("file %s was already copied", file.Id)
+			result, err = &drive.File{Id: file.Id, Name: file.Name}, nil
+		}
+		return err
+	})
+	return result, err
+}
+
+func (call retryingCreateCall) Fields(s ...googleapi.Field) FilesCreateCall {
+	call.fields = appendFields(call.fields, s)
+	return call
+}
+func (call retryingCreateCall) Media(r io.Reader, options ...googleapi.MediaOption) FilesCreateCall {
+	call.media = readMedia(r, options)
+	return call
+}
+func (call retryingCreateCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	if call.media != nil && call.media.err != nil {
+		return nil, call.media.err
+	}
+	file := call.file
+	if file.Id == "" {
+		id, err := call.svc.ids.next()
+		if err != nil {
+			return nil, err
+		}
+		file.Id = id
+	}
+	var result *drive.File
+	err := call.svc.policy.do(func(n int) error {
+		c := call.svc.files.Create(&file)
+		if len(call.fields) > 0 {
+			c = c.Fields(call.fields...)
+		}
+		if call.media != nil {
+			c = c.Media(bytes.NewReader(call.media.content), call.media.options...)
+		}
+		var err error
+		result, err = c.Do(opts...)
+		if n > 0 && isStatus(err, http.StatusConflict) {
+			// an earlier attempt got through, but we never heard back
+			log.Printf("file %s was already created", file.Id)
+			result, err = &drive.File{Id: file.Id, Name: file.Name}, nil
+		}
+		return err
+	})
+	return result, err
+}
+
+func (call retryingUpdateCall) AddParents(addParents string) FilesUpdateCall {
+	call.addParents = addParents
+	return call
+}
+func (call retryingUpdateCall) RemoveParents(removeParents string) FilesUpdateCall {
+	call.removeParents = removeParents
+	return call
+}
+func (call retryingUpdateCall) Fields(s ...googleapi.Field) FilesUpdateCall {
+	call.fields = appendFields(call.fields, s)
+	return call
+}
+func (call retryingUpdateCall) Media(r io.Reader, options ...googleapi.MediaOption) FilesUpdateCall {
+	call.media = readMedia(r, options)
+	return call
+}
+func (call retryingUpdateCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	if call.media != nil && call.media.err != nil {
+		return nil, call.media.err
+	}
+	var result *drive.File
+	err := call.svc.policy.do(func(int) error {
+		c := call.svc.files.Update(call.fileId, call.file)
+		if len(call.fields) > 0 {
+			c = c.Fields(call.fields...)
+		}
+		if call.media != nil {
+			c = c.Media(bytes.NewReader(call.media.content), call.media.options...)
+		}
+		if call.addParents != "" {
+			c = c.AddParents(call.addParents)
+		}
+		if call.removeParents != "" {
+			c = c.RemoveParents(call.removeParents)
+		}
+		var err error
+		result, err = c.Do(opts...)
+		return err
+	})
+	return result, err
+}
+
+func (call retryingDeleteCall) Do(opts ...googleapi.CallOption) error {
+	return call.svc.policy.do(func(n int) error {
+		err := call.svc.files.Delete(call.fileId).Do(opts...)
+		if n > 0 && isStatus(err, http.StatusNotFound) {
+			// an earlier attempt got through
+			return nil
+		}
+		return err
+	})
+}
+
+func (call retryingGenerateIdsCall) Count(count int64) FilesGenerateIdsCall {
+	call.count = count
+	return call
+}
+func (call retryingGenerateIdsCall) Space(space string) FilesGenerateIdsCall {
+	call.space = space
+	return call
+}
+func (call retryingGenerateIdsCall) Do(opts ...googleapi.CallOption) (*drive.GeneratedIds, error) {
+	var result *drive.GeneratedIds
+	err := call.svc.policy.do(func(int) error {
+		c := call.svc.files.GenerateIds()
+		if call.count != 0 {
+			c = c.Count(call.count)
+		}
+		if call.space != "" {
+			c = c.Space(call.space)
+		}
+		var err error
+		result, err = c.Do(opts...)
+		return err
+	})
+	return result, err
+}
+
+func (call retryingGetCall) Fields(s ...googleapi.Field) FilesGetCall {
+	call.fields = appendFields(call.fields, s)
+	return call
+}
+func (call retryingGetCall) get() FilesGetCall {
+	c := call.svc.files.Get(call.fileId)
+	if len(call.fields) > 0 {
+		c = c.Fields(call.fields...)
+	}
+	return c
+}
+func (call retryingGetCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	var result *drive.File
+	err := call.svc.policy.do(func(int) error {
+		var err error
+		result, err = call.get().Do(opts...)
+		return err
+	})
+	return result, err
+}
+func (call retryingGetCall) Download(opts ...googleapi.CallOption) (*http.Response, error) {
+	var result *http.Response
+	err := call.svc.policy.do(func(int) error {
+		var err error
+		result, err = call.get().Download(opts...)
+		return err
+	})
+	return result, err
+}
+
+func (call retryingListCall) Spaces(spaces string) FilesListCall {
+	call.spaces = spaces
+	return call
+}
+func (call retryingListCall) PageSize(pageSize int64) FilesListCall {
+	call.pageSize = pageSize
+	return call
+}
+func (call retryingListCall) PageToken(pageToken string) FilesListCall {
+	call.pageToken = pageToken
+	return call
+}
+func (call retryingListCall) Q(q string) FilesListCall {
+	call.q = q
+	return call
+}
+func (call retryingListCall) Fields(s ...googleapi.Field) FilesListCall {
+	call.fields = appendFields(call.fields, s)
+	return call
+}
+func (call retryingListCall) Do(opts ...googleapi.CallOption) (*drive.FileList, error) {
+	var result *drive.FileList
+	err := call.svc.policy.do(func(int) error {
+		c := call.svc.files.List()
+		if call.spaces != "" {
+			c = c.Spaces(call.spaces)
+		}
+		if call.pageSize != 0 {
+			c = c.PageSize(call.pageSize)
+		}
+		if call.pageToken != "" {
+			c = c.PageToken(call.pageToken)
+		}
+		if call.q != "" {
+			c = c.Q(call.q)
+		}
+		if len(call.fields) > 0 {
+			c = c.Fields(call.fields...)
+		}
+		var err error
+		result, err = c.Do(opts...)
+		return err
+	})
+	return result, err
+}
+
+// retryingRevisionsService does the same for revisions
+type retryingRevisionsService struct {
+	revisions RevisionsService
+	policy    retryPolicy
+}
+
+type retryingRevisionsDeleteCall struct {
+	svc        retryingRevisionsService
+	fileId     string
+	revisionId string
+}
+
+type retryingRevisionsListCall struct {
+	svc      retryingRevisionsService
+	fileId   string
+	pageSize int64
+	fields   []googleapi.Field
+}
+
+func (svc retryingRevisionsService) Delete(fileId string, revisionId string) RevisionsDeleteCall {
+	return retryingRevisionsDeleteCall{svc, fileId, revisionId}
+}
+func (svc retryingRevisionsService) List(fileId string) RevisionsListCall {
+	return retryingRevisionsListCall{svc: svc, fileId: fileId}
+}
+
+func (call retryingRevisionsDeleteCall) Do(opts ...googleapi.CallOption) error {
+	return call.svc.policy.do(func(n int) error {
+		err := call.svc.revisions.Delete(call.fileId, call.revisionId).Do(opts...)
+		if n > 0 && isStatus(err, http.StatusNotFound) {
+			// an earlier attempt got through
+			return nil
+		}
+		return err
+	})
+}
+
+func (call retryingRevisionsListCall) PageSize(pageSize int64) RevisionsListCall {
+	call.pageSize = pageSize
+	return call
+}
+func (call retryingRevisionsListCall) Fields(s ...googleapi.Field) RevisionsListCall {
+	call.fields = appendFields(call.fields, s)
+	return call
+}
+func (call retryingRevisionsListCall) Do(opts ...googleapi.CallOption) (*drive.RevisionList, error) {
+	var result *drive.RevisionList
+	err := call.svc.policy.do(func(int) error {
+		c := call.svc.revisions.List(call.fileId)
+		if call.pageSize != 0 {
+			c = c.PageSize(call.pageSize)
+		}
+		if len(call.fields) > 0 {
+			c = c.Fields(call.fields...)
+		}
+		var err error
+		result, err = c.Do(opts...)
+		return err
+	})
+	return result, err
+}
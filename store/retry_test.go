@@ -0,0 +1,223 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v3"
+	googleapi "google.golang.org/api/googleapi"
+)
+
+// testRetryPolicy records the delays instead of sleeping
+func testRetryPolicy(delays *[]time.Duration) retryPolicy {
+	return retryPolicy{
+		maxAttempts: 4,
+		baseDelay:   time.Second,
+		maxDelay:    5 * time.Second,
+		sleep:       func(d time.Duration) { *delays = append(*delays, d) },
+		jitter:      func(d time.Duration) time.Duration { return d },
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	rateLimited := &googleapi.Error{
+		Code:   403,
+		Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}},
+	}
+	withRetryAfter := &googleapi.Error{
+		Code:   503,
+		Header: http.Header{"Retry-After": []string{"30"}},
+	}
+	matrix := []struct {
+		err        error
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{&googleapi.Error{Code: 429}, true, 0},
+		{&googleapi.Error{Code: 500}, true, 0},
+		{withRetryAfter, true, 30 * time.Second},
+		{rateLimited, true, 0},
+		{fmt.Errorf("wrapped: %w", rateLimited), true, 0},
+		{&googleapi.Error{Code: 403}, false, 0},
+		{&googleapi.Error{Code: 404}, false, 0},
+		{&url.Error{Op: "Post", URL: "https://www.googleapis.com", Err: io.ErrUnexpectedEOF}, true, 0},
+		{fmt.Errorf("something else"), false, 0},
+	}
+	for _, m := range matrix {
+		retryable, retryAfter := classifyError(m.err)
+		if retryable != m.retryable || retryAfter != m.retryAfter {
+			t.Errorf("%v: expected %v %v, actual: %v %v", m.err,
+				m.retryable, m.retryAfter, retryable, retryAfter)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var delays []time.Duration
+	policy := testRetryPolicy(&delays)
+
+	attempts := 0
+	err := policy.do(func(n int) error {
+		attempts++
+		return &googleapi.Error{Code: 503}
+	})
+	if err == nil || attempts != 4 {
+		t.Error("expected to give up after 4 attempts, actual:", attempts, err)
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if fmt.Sprint(delays) != fmt.Sprint(expected) {
+		t.Error("expected:", expected, "actual:", delays)
+	}
+
+	// the delay is capped, but not below what the server asks for
+	delays = nil
+	err = policy.do(func(n int) error {
+		if n == 0 {
+			return &googleapi.Error{Code: 429,
+				Header: http.Header{"Retry-After": []string{"120"}}}
+		}
+		return nil
+	})
+	if err != nil || fmt.Sprint(delays) != "[2m0s]" {
+		t.Error("expected to wait 2m0s, actual:", delays, err)
+	}
+	if d := policy.backoff(10); d != 5*time.Second {
+		t.Error("expected backoff to be capped at 5s, actual:", d)
+	}
+
+	delays = nil
+	attempts = 0
+	err = policy.do(func(n int) error {
+		attempts++
+		return &googleapi.Error{Code: 404}
+	})
+	if err == nil || attempts != 1 || len(delays) != 0 {
+		t.Error("expected no retries of a 404, actual:", attempts)
+	}
+}
+
+// flakyFilesService fails each request with the next of errs, until they
+// have all been used
+type flakyFilesService struct {
+	fakeFilesService
+	errs    *[]error
+	created *[]createAttempt
+}
+
+type createAttempt struct {
+	id      string
+	content string
+}
+
+func (svc flakyFilesService) nextErr() error {
+	if len(*svc.errs) == 0 {
+		return nil
+	}
+	err := (*svc.errs)[0]
+	*svc.errs = (*svc.errs)[1:]
+	return err
+}
+
+func (svc flakyFilesService) Create(file *drive.File) FilesCreateCall {
+	return flakyCreateCall{svc: svc, id: file.Id}
+}
+
+type flakyCreateCall struct {
+	fakeFilesCreateCall
+	svc flakyFilesService
+	id  string
+}
+
+func (cc flakyCreateCall) Media(r io.Reader, options ...googleapi.MediaOption) FilesCreateCall {
+	cc.reader = r
+	return cc
+}
+func (cc flakyCreateCall) Fields(s ...googleapi.Field) FilesCreateCall {
+	return cc
+}
+func (cc flakyCreateCall) Do(opts ...googleapi.CallOption) (*drive.File, error) {
+	var content []byte
+	if cc.reader != nil {
+		content, _ = ioutil.ReadAll(cc.reader)
+	}
+	*cc.svc.created = append(*cc.svc.created, createAttempt{cc.id, string(content)})
+	if err := cc.svc.nextErr(); err != nil {
+		return nil, err
+	}
+	return &drive.File{Id: cc.id}, nil
+}
+
+func (svc flakyFilesService) Delete(fileId string) FilesDeleteCall {
+	return flakyDeleteCall{svc}
+}
+
+type flakyDeleteCall struct {
+	svc flakyFilesService
+}
+
+func (dc flakyDeleteCall) Do(opts ...googleapi.CallOption) error {
+	return dc.svc.nextErr()
+}
+
+func TestRetryingCreate(t *testing.T) {
+	var delays []time.Duration
+	var created []createAttempt
+	errs := []error{
+		&googleapi.Error{Code: 503},
+		// the second attempt went through, but the response was lost
+		&url.Error{Op: "Post", URL: "https://www.googleapis.com", Err: io.ErrUnexpectedEOF},
+		&googleapi.Error{Code: 409},
+	}
+	svc := newRetryingFilesService(
+		flakyFilesService{errs: &errs, created: &created},
+		testRetryPolicy(&delays))
+
+	result, err := svc.Create(&drive.File{Name: "pack-1.pack"}).Fields("id").
+		Media(strings.NewReader("PACK")).Do()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if result.Id != "generated-0" {
+		t.Error("expected: generated-0, actual:", result.Id)
+	}
+	if len(created) != 3 {
+		t.Fatal("expected 3 attempts, actual:", len(created))
+	}
+	for _, attempt := range created {
+		if attempt.id != "generated-0" || attempt.content != "PACK" {
+			t.Error("expected the same file each time, actual:", attempt)
+		}
+	}
+
+	// the next file gets a new ID
+	result, err = svc.Create(&drive.File{Name: "pack-1.idx"}).Do()
+	if err != nil || result.Id != "generated-1" {
+		t.Error("expected: generated-1, actual:", result, err)
+	}
+
+	// a conflict the first time round is someone else's file
+	errs = []error{&googleapi.Error{Code: 409}}
+	if _, err := svc.Create(&drive.File{Name: "x"}).Do(); err == nil {
+		t.Error("expected conflict error")
+	}
+}
+
+func TestRetryingDelete(t *testing.T) {
+	var delays []time.Duration
+	errs := []error{&googleapi.Error{Code: 500}, &googleapi.Error{Code: 404}}
+	svc := newRetryingFilesService(flakyFilesService{errs: &errs}, testRetryPolicy(&delays))
+	if err := svc.Delete("/etc/hosts").Do(); err != nil {
+		t.Error("expected 404 after a retry to count as deleted, actual:", err)
+	}
+
+	errs = []error{&googleapi.Error{Code: 404}}
+	if err := svc.Delete("/etc/hosts").Do(); err == nil {
+		t.Error("expected 404 error")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"container/heap"
+)
+
+// walkStart is an object to start walking from, along with its type
+type walkStart struct {
+	sha     string
+	objType ObjectType
+}
+
+// walkCommit is what an objectWalk knows about a commit
+type walkCommit struct {
+	sha    string
+	commit Commit
+	// reachable from something the other side has
+	uninteresting bool
+	// queued is set once the commit has been added to the queue, and done
+	// once it has been taken off it again
+	queued bool
+	done   bool
+}
+
+// commitQueue is a heap of commits, newest first
+type commitQueue []*walkCommit
+
+func (q commitQueue) Len() int           { return len(q) }
+func (q commitQueue) Less(i, j int) bool { return q[i].commit.Time > q[j].commit.Time }
+func (q commitQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *commitQueue) Push(x interface{}) {
+	*q = append(*q, x.(*walkCommit))
+}
+
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+type objectWalk struct {
+	m       Manager
+	commits map[string]*walkCommit
+	queue   commitQueue
+	// the number of commits in the queue which aren't uninteresting. Once
+	// there are none left there is nothing new further back.
+	interesting int
+	// trees, blobs and tags that have been visited
+	seen   map[string]bool
+	result map[string]bool
+	// trees, blobs and tags reached without going through a commit
+	wantRoots, haveRoots []walkStart
+}
+
+// objectsBetween lists the objects reachable from wants but not from haves,
+// like
+//
+//	git rev-list --objects <wants> --not <haves>
+//
+// Each object is read at most once. History is explored, newest first, only
+// until it joins the history of haves, so the cost depends on how much is
+// new rather than on the size of the repository.
+//
+// Should commit times be skewed, the walk may stop before noticing that
+// something is reachable from haves, and include more than necessary.
+// Nothing that is needed is ever left out.
+func objectsBetween(m Manager, wants, haves []walkStart) (map[string]bool, error) {
+	w := &objectWalk{
+		m:       m,
+		commits: map[string]*walkCommit{},
+		seen:    map[string]bool{},
+		result:  map[string]bool{},
+	}
+	for _, start := range haves {
+		if err := w.add(start, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, start := range wants {
+		if err := w.add(start, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.walkCommits(); err != nil {
+		return nil, err
+	}
+
+	// Mark everything the other side has before collecting anything.
+	// The trees of the commits at the boundary are enough to find the
+	// unchanged trees and blobs in the new commits.
+	for _, start := range w.haveRoots {
+		if err := w.walkTree(start, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range w.commits {
+		if c.uninteresting {
+			continue
+		}
+		for _, parent := range c.commit.Parents {
+			if pc := w.commits[parent]; pc != nil && pc.uninteresting {
+				if err := w.walkTree(walkStart{pc.commit.Tree, TREE}, false); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, c := range w.commits {
+		if c.uninteresting {
+			continue
+		}
+		w.result[c.sha] = true
+		if err := w.walkTree(walkStart{c.commit.Tree, TREE}, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, start := range w.wantRoots {
+		if err := w.walkTree(start, true); err != nil {
+			return nil, err
+		}
+	}
+	return w.result, nil
+}
+
+// add starts the walk at an object, following annotated tags, including
+// tags of tags, to the object they point at
+func (w *objectWalk) add(start walkStart, uninteresting bool) error {
+	roots := &w.wantRoots
+	if uninteresting {
+		roots = &w.haveRoots
+	}
+	for start.objType == TAG {
+		*roots = append(*roots, start)
+		tag, err := GetTag(w.m, start.sha)
+		if err != nil {
+			return err
+		}
+		start = walkStart{tag.Object, tag.Type}
+	}
+	if start.objType != COMMIT {
+		*roots = append(*roots, start)
+		return nil
+	}
+	return w.queueCommit(start.sha, uninteresting)
+}
+
+// queueCommit adds a commit to the queue, unless it's already been queued
+func (w *objectWalk) queueCommit(sha string, uninteresting bool) error {
+	c := w.commits[sha]
+	if c == nil {
+		commit, err := GetCommit(w.m, sha)
+		if err != nil {
+			return err
+		}
+		c = &walkCommit{sha: sha, commit: commit}
+		w.commits[sha] = c
+	}
+	if uninteresting {
+		w.markUninteresting(c)
+	}
+	if !c.queued {
+		c.queued = true
+		heap.Push(&w.queue, c)
+		if !c.uninteresting {
+			w.interesting++
+		}
+	}
+	return nil
+}
+
+// markUninteresting marks c, and the ancestors of c we've seen so far, as
+// reachable from haves
+func (w *objectWalk) markUninteresting(c *walkCommit) {
+	stack := []*walkCommit{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if c.uninteresting {
+			continue
+		}
+		c.uninteresting = true
+		if c.queued && !c.done {
+			w.interesting--
+		}
+		for _, parent := range c.commit.Parents {
+			if pc := w.commits[parent]; pc != nil {
+				stack = append(stack, pc)
+			}
+		}
+	}
+}
+
+func (w *objectWalk) walkCommits() error {
+	for w.interesting > 0 {
+		c := heap.Pop(&w.queue).(*walkCommit)
+		c.done = true
+		if !c.uninteresting {
+			w.interesting--
+		}
+		for _, parent := range c.commit.Parents {
+			if err := w.queueCommit(parent, c.uninteresting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkTree visits every object in a tree not already seen, adding them to
+// the result if include is set. Tags and blobs can be passed too.
+func (w *objectWalk) walkTree(start walkStart, include bool) error {
+	stack := []walkStart{start}
+	for len(stack) > 0 {
+		obj := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if w.seen[obj.sha] {
+			continue
+		}
+		w.seen[obj.sha] = true
+		if include {
+			w.result[obj.sha] = true
+		}
+		if obj.objType != TREE {
+			continue
+		}
+		tree, err := GetTree(w.m, obj.sha)
+		if err != nil {
+			return err
+		}
+		for _, item := range tree {
+			// submodules live in other repositories
+			if item.Type != COMMIT {
+				stack = append(stack, walkStart{item.Ref, item.Type})
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// readCounter counts how many times each object is read
+type readCounter struct {
+	Manager
+	reads map[string]int
+}
+
+func (rc readCounter) ReadObject(sha string, contents io.Writer) error {
+	rc.reads[sha]++
+	return rc.Manager.ReadObject(sha, contents)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func revListObjects(t *testing.T, gitDir string, args ...string) []string {
+	out := gitOutput(t, gitDir, append([]string{"rev-list", "--objects",
+		"--no-object-names"}, args...)...)
+	shas := strings.Fields(out)
+	sort.Strings(shas)
+	return shas
+}
+
+func TestObjectsBetween(t *testing.T) {
+	// Each merge doubles the number of paths through the history
+	srcDir := gitRepo(t, "echo 0 > f && git add f && git commit -q -m 0 && "+
+		"for i in $(seq 1 30); do "+
+		"export GIT_COMMITTER_DATE=\"@$((100000 + 10 * i)) +0000\" && "+
+		"git checkout -q -b side$i && echo $i > s$i && git add s$i && "+
+		"git commit -q -m s$i && git checkout -q master && "+
+		"echo $i > f && git commit -q -a -m m$i && "+
+		"git merge -q --no-edit side$i; done && "+
+		"git tag -a -m 'release' v1 && git tag -a -m 'tag of tag' v1-again v1 && "+
+		"git commit -q --allow-empty -m after")
+	objects, err := localGit{gitDir: srcDir}.startCatFile()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer objects.Close()
+	rc := readCounter{objects, map[string]int{}}
+	sha := func(name string) string { return gitOutput(t, srcDir, "rev-parse", name) }
+
+	matrix := []struct {
+		wants, haves []walkStart
+		revList      []string
+	}{
+		{[]walkStart{{sha("master"), COMMIT}}, nil,
+			[]string{"master"}},
+		{[]walkStart{{sha("master"), COMMIT}}, []walkStart{{sha("side20"), COMMIT}},
+			[]string{"master", "^side20"}},
+		{[]walkStart{{sha("v1-again"), TAG}}, []walkStart{{sha("master~5"), COMMIT}},
+			[]string{"v1-again", "^master~5"}},
+		{[]walkStart{{sha("master"), COMMIT}}, []walkStart{{sha("v1-again"), TAG}},
+			[]string{"master", "^v1-again"}},
+		{[]walkStart{{sha("master^{tree}"), TREE}}, []walkStart{{sha("side1"), COMMIT}},
+			[]string{"master^{tree}", "^side1"}},
+	}
+	for _, m := range matrix {
+		for k := range rc.reads {
+			delete(rc.reads, k)
+		}
+		actual, err := objectsBetween(rc, m.wants, m.haves)
+		if err != nil {
+			t.Fatal(m.revList, "unexpected error:", err)
+		}
+		expected := revListObjects(t, srcDir, m.revList...)
+		if strings.Join(sortedKeys(actual), " ") != strings.Join(expected, " ") {
+			t.Errorf("%v: expected %d objects:\n%v\nactual %d:\n%v", m.revList,
+				len(expected), expected, len(actual), sortedKeys(actual))
+		}
+		for sha, count := range rc.reads {
+			if count > 1 {
+				t.Errorf("%v: %s read %d times", m.revList, sha, count)
+			}
+		}
+	}
+
+	// Only the end of the history is looked at when the remote is nearly
+	// up to date
+	for k := range rc.reads {
+		delete(rc.reads, k)
+	}
+	_, err = objectsBetween(rc, []walkStart{{sha("master"), COMMIT}},
+		[]walkStart{{sha("master^"), COMMIT}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(rc.reads) > 10 {
+		t.Error("expected few objects to be read, actual:", len(rc.reads))
+	}
+}